@@ -0,0 +1,335 @@
+package asm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sscaling/goplayground/vmtest/vm"
+)
+
+// Assembler for the vm bytecodes. Source is line based:
+//
+//	; comments run to the end of the line (# and // work too)
+//	.entry main        ; address execution starts from (default 0)
+//	.data 4            ; number of global data slots (default 0)
+//	fib:               ; label, resolves to the address of the next instruction
+//	    LOAD 0         ; mnemonic followed by its operands
+//	    JMPF done      ; operands may be integers or label names
+//	main: CONST_I32 6  ; a label and instruction can share a line
+//	CONST_F64 2.5      ; float and bool constants are written as literals
+//	CONST_BOOL true
+//	CONST_STR "hi\n"  ; Go syntax strings are added to the constant pool
+//	CALL_NATIVE "sqrt", 1 ; quoted native names are imported by the module
+//
+// Mnemonics are the names in vm/bytecodes.go and are case insensitive.
+
+// Program is the result of assembling a source file
+type Program struct {
+	Code     []int          // bytecode, as accepted by vm.New
+	Entry    int            // initial program counter
+	DataSize int            // number of global data slots
+	Labels   map[string]int // label name -> code address
+	Lines    map[int]int    // code address -> source line of the instruction
+	Source   string         // file name, when assembled with AssembleFile
+	Consts   []string       // constant pool
+	Natives  []string       // native functions called by name
+}
+
+// constant returns the pool index of a string, adding it when needed
+func (p *Program) constant(s string) int {
+	for i, c := range p.Consts {
+		if c == s {
+			return i
+		}
+	}
+	p.Consts = append(p.Consts, s)
+	return len(p.Consts) - 1
+}
+
+// native returns the index of a native function, importing it when needed
+func (p *Program) native(name string) int {
+	for i, n := range p.Natives {
+		if n == name {
+			return i
+		}
+	}
+	p.Natives = append(p.Natives, name)
+	return len(p.Natives) - 1
+}
+
+// Module converts the program into a vm.Module, keeping labels and line
+// numbers as debug information
+func (p *Program) Module() *vm.Module {
+	return &vm.Module{
+		Entry:    p.Entry,
+		DataSize: p.DataSize,
+		Code:     p.Code,
+		Consts:   p.Consts,
+		Symbols:  p.Labels,
+		Source:   p.Source,
+		Lines:    p.Lines,
+		Natives:  p.Natives,
+	}
+}
+
+// Error is an assembly error for a given source line
+type Error struct {
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// fixup records an operand that refers to a label which is resolved once
+// all labels are known
+type fixup struct {
+	addr  int
+	label string
+	line  int
+}
+
+// Assemble reads assembly source and returns the assembled program
+func Assemble(r io.Reader) (*Program, error) {
+	prog := &Program{Labels: map[string]int{}, Lines: map[int]int{}}
+
+	var fixups []fixup
+	entry := ""
+	entryLine := 0
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields, err := tokenize(scanner.Text())
+		if err != nil {
+			return nil, &Error{line, err.Error()}
+		}
+
+		// labels
+		for len(fields) > 0 && strings.HasSuffix(fields[0], ":") {
+			name := strings.TrimSuffix(fields[0], ":")
+			if !isIdent(name) {
+				return nil, &Error{line, fmt.Sprintf("invalid label name %q", name)}
+			}
+			if _, exists := prog.Labels[name]; exists {
+				return nil, &Error{line, fmt.Sprintf("label %q already defined", name)}
+			}
+			prog.Labels[name] = len(prog.Code)
+			fields = fields[1:]
+		}
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		// directives
+		if strings.HasPrefix(fields[0], ".") {
+			if len(fields) != 2 {
+				return nil, &Error{line, fmt.Sprintf("%s expects 1 argument, got %d", fields[0], len(fields)-1)}
+			}
+			switch strings.ToLower(fields[0]) {
+			case ".entry":
+				entry = fields[1]
+				entryLine = line
+			case ".data":
+				size, err := strconv.Atoi(fields[1])
+				if err != nil || size < 0 {
+					return nil, &Error{line, fmt.Sprintf("invalid data size %q", fields[1])}
+				}
+				prog.DataSize = size
+			default:
+				return nil, &Error{line, fmt.Sprintf("unknown directive %q", fields[0])}
+			}
+			continue
+		}
+
+		// instruction
+		code, ok := vm.OpcodeByName(strings.ToUpper(fields[0]))
+		if !ok {
+			return nil, &Error{line, fmt.Sprintf("unknown opcode %q", fields[0])}
+		}
+		op := vm.Opcodes[code]
+		operands := fields[1:]
+		if len(operands) != op.Operands {
+			return nil, &Error{line, fmt.Sprintf("%s expects %d operand(s), got %d", op.Name, op.Operands, len(operands))}
+		}
+
+		prog.Lines[len(prog.Code)] = line
+		prog.Code = append(prog.Code, code)
+
+		// constants that are not plain integers
+		switch code {
+		case vm.CONST_F64:
+			value, err := strconv.ParseFloat(operands[0], 64)
+			if err != nil {
+				return nil, &Error{line, fmt.Sprintf("invalid float %q", operands[0])}
+			}
+			prog.Code = append(prog.Code, int(math.Float64bits(value)))
+			continue
+		case vm.CONST_STR:
+			if strings.HasPrefix(operands[0], "\"") {
+				value, err := strconv.Unquote(operands[0])
+				if err != nil {
+					return nil, &Error{line, fmt.Sprintf("invalid string %s", operands[0])}
+				}
+				prog.Code = append(prog.Code, prog.constant(value))
+				continue
+			}
+		case vm.CONST_BOOL:
+			value, err := strconv.ParseBool(operands[0])
+			if err != nil {
+				return nil, &Error{line, fmt.Sprintf("invalid bool %q", operands[0])}
+			}
+			prog.Code = append(prog.Code, boolOperand(value))
+			continue
+		case vm.CALL_NATIVE:
+			if strings.HasPrefix(operands[0], "\"") {
+				name, err := strconv.Unquote(operands[0])
+				if err != nil {
+					return nil, &Error{line, fmt.Sprintf("invalid native name %s", operands[0])}
+				}
+				prog.Code = append(prog.Code, prog.native(name))
+				operands = operands[1:]
+			}
+		}
+
+		for _, operand := range operands {
+			value, err := strconv.ParseInt(operand, 0, 64)
+			if err != nil {
+				if !isIdent(operand) {
+					return nil, &Error{line, fmt.Sprintf("invalid operand %q", operand)}
+				}
+				fixups = append(fixups, fixup{len(prog.Code), operand, line})
+			}
+			prog.Code = append(prog.Code, int(value))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, f := range fixups {
+		addr, ok := prog.Labels[f.label]
+		if !ok {
+			return nil, &Error{f.line, fmt.Sprintf("undefined label %q", f.label)}
+		}
+		prog.Code[f.addr] = addr
+	}
+
+	if entry != "" {
+		addr, err := resolve(prog.Labels, entry)
+		if err != nil {
+			return nil, &Error{entryLine, err.Error()}
+		}
+		prog.Entry = addr
+	}
+
+	return prog, nil
+}
+
+// AssembleString assembles source held in a string
+func AssembleString(src string) (*Program, error) {
+	return Assemble(strings.NewReader(src))
+}
+
+// AssembleFile assembles a .vasm source file
+func AssembleFile(path string) (*Program, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	prog, err := Assemble(f)
+	if e, ok := err.(*Error); ok {
+		return nil, fmt.Errorf("%s:%d: %s", path, e.Line, e.Msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	prog.Source = path
+	return prog, nil
+}
+
+// resolve an operand that is either a number or a label
+func resolve(labels map[string]int, s string) (int, error) {
+	if value, err := strconv.ParseInt(s, 0, 64); err == nil {
+		return int(value), nil
+	}
+	addr, ok := labels[s]
+	if !ok {
+		return 0, fmt.Errorf("undefined label %q", s)
+	}
+	return addr, nil
+}
+
+func boolOperand(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// tokenize strips comments and splits a line on whitespace and commas.
+// Double quoted strings are kept as a single token, quotes included.
+func tokenize(line string) ([]string, error) {
+	var tokens []string
+	start := -1
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '"':
+			end := i + 1
+			for ; end < len(line) && line[end] != '"'; end++ {
+				if line[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(line) {
+				return nil, fmt.Errorf("unterminated string %s", line[i:])
+			}
+			if start >= 0 {
+				return nil, fmt.Errorf("unexpected string after %q", line[start:i])
+			}
+			tokens = append(tokens, line[i:end+1])
+			i = end
+		case c == ';' || c == '#' || strings.HasPrefix(line[i:], "//"):
+			i = len(line)
+		case c == ',' || c == ' ' || c == '\t' || c == '\r':
+			if start >= 0 {
+				tokens = append(tokens, line[start:i])
+				start = -1
+			}
+		case start < 0:
+			start = i
+		}
+	}
+
+	if start >= 0 {
+		tokens = append(tokens, line[start:])
+	}
+	return tokens, nil
+}
+
+func isIdent(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z'):
+		case i > 0 && r >= '0' && r <= '9':
+		default:
+			return false
+		}
+	}
+	return true
+}
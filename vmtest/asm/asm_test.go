@@ -0,0 +1,183 @@
+package asm
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sscaling/goplayground/vmtest/vm"
+)
+
+func TestAssembleFibonacci(t *testing.T) {
+	prog, err := AssembleFile("testdata/fib.vasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// hand assembled version from vm_test.go
+	fib := 0
+	expected := []int{
+		vm.LOAD, 0, vm.CONST_I32, 0, vm.EQ_I32, vm.JMPF, 10, vm.CONST_I32, 0, vm.RET,
+		vm.LOAD, 0, vm.CONST_I32, 3, vm.LT_I32, vm.JMPF, 20, vm.CONST_I32, 1, vm.RET,
+		vm.LOAD, 0, vm.CONST_I32, 1, vm.SUB_I32, vm.CALL, fib, 1,
+		vm.LOAD, 0, vm.CONST_I32, 2, vm.SUB_I32, vm.CALL, fib, 1,
+		vm.ADD_I32, vm.RET,
+		vm.CONST_I32, 6, vm.CALL, fib, 1, vm.PRINT, vm.HALT,
+	}
+
+	if !reflect.DeepEqual(expected, prog.Code) {
+		t.Errorf("Expected\n%v\ngot\n%v", expected, prog.Code)
+	}
+
+	if prog.Entry != 38 {
+		t.Errorf("Expected entry 38, got %d", prog.Entry)
+	}
+
+	if prog.Labels["recurse"] != 20 {
+		t.Errorf("Expected label 'recurse' at 20, got %d", prog.Labels["recurse"])
+	}
+
+	if prog.Lines[38] != 32 {
+		t.Errorf("Expected address 38 to map to line 32, got %d", prog.Lines[38])
+	}
+}
+
+func TestAssembleDirectives(t *testing.T) {
+	prog, err := AssembleString(`
+		.data 2
+		.entry 4
+		const_i32 0x10 // lower case mnemonic, hex operand
+		gstore 1       # other comment style
+		halt
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []int{vm.CONST_I32, 16, vm.GSTORE, 1, vm.HALT}
+	if !reflect.DeepEqual(expected, prog.Code) {
+		t.Errorf("Expected %v, got %v", expected, prog.Code)
+	}
+	if prog.DataSize != 2 || prog.Entry != 4 {
+		t.Errorf("Expected data size 2 and entry 4, got %d and %d", prog.DataSize, prog.Entry)
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		line int
+		msg  string
+	}{
+		{"HALT\nFOO 1", 2, `unknown opcode "FOO"`},
+		{"\n\nCONST_I32", 3, "CONST_I32 expects 1 operand(s), got 0"},
+		{"ADD_I32 1", 1, "ADD_I32 expects 0 operand(s), got 1"},
+		{"JMP nowhere\nHALT", 1, `undefined label "nowhere"`},
+		{"a:\na: HALT", 2, `label "a" already defined`},
+		{".entry main", 1, `undefined label "main"`},
+		{".stack 10", 1, `unknown directive ".stack"`},
+		{"CONST_I32 1x", 1, `invalid operand "1x"`},
+	}
+
+	for _, test := range tests {
+		_, err := AssembleString(test.src)
+		e, ok := err.(*Error)
+		if !ok {
+			t.Errorf("%q: expected *Error, got %v", test.src, err)
+			continue
+		}
+		if e.Line != test.line || !strings.Contains(e.Msg, test.msg) {
+			t.Errorf("%q: expected line %d %q, got %v", test.src, test.line, test.msg, e)
+		}
+	}
+}
+
+func TestAssembleConstants(t *testing.T) {
+	prog, err := AssembleString(`
+		CONST_F64 2.5
+		CONST_F64 -3
+		CONST_BOOL true
+		CONST_BOOL false
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []int{
+		vm.CONST_F64, int(math.Float64bits(2.5)),
+		vm.CONST_F64, int(math.Float64bits(-3)),
+		vm.CONST_BOOL, 1,
+		vm.CONST_BOOL, 0,
+	}
+	if !reflect.DeepEqual(expected, prog.Code) {
+		t.Errorf("Expected %v, got %v", expected, prog.Code)
+	}
+
+	listing, _ := Disassemble(prog.Code)
+	for _, s := range []string{"CONST_F64 2.5\n", "CONST_F64 -3\n", "CONST_BOOL true\n", "CONST_BOOL false\n"} {
+		if !strings.Contains(listing, s) {
+			t.Errorf("Expected listing to contain %q, got\n%s", s, listing)
+		}
+	}
+
+	if _, err := AssembleString("CONST_F64 pi"); err == nil || !strings.Contains(err.Error(), `invalid float "pi"`) {
+		t.Errorf("Expected invalid float error, got %v", err)
+	}
+}
+
+func TestAssembleStrings(t *testing.T) {
+	prog, err := AssembleString(`
+		CONST_STR "hello; world" ; comment markers inside strings are kept
+		CONST_STR "tab\t\"quoted\""
+		CONST_STR "hello; world"
+		CONCAT
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []int{vm.CONST_STR, 0, vm.CONST_STR, 1, vm.CONST_STR, 0, vm.CONCAT}
+	if !reflect.DeepEqual(expected, prog.Code) {
+		t.Errorf("Expected %v, got %v", expected, prog.Code)
+	}
+	if consts := []string{"hello; world", "tab\t\"quoted\""}; !reflect.DeepEqual(consts, prog.Consts) {
+		t.Errorf("Expected constant pool %q, got %q", consts, prog.Consts)
+	}
+
+	for src, msg := range map[string]string{
+		`CONST_STR "open`:   "unterminated string",
+		`CONST_STR "\q"`:    "invalid string",
+		`CONST_STR x"y"`:    "unexpected string",
+		`CONST_STR "a" "b"`: "expects 1 operand(s), got 2",
+	} {
+		if _, err := AssembleString(src); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("%s: expected error containing %q, got %v", src, msg, err)
+		}
+	}
+}
+
+func TestAssembleNatives(t *testing.T) {
+	prog, err := AssembleString(`
+		CONST_F64 2.0
+		CALL_NATIVE "sqrt", 1
+		CALL_NATIVE "str", 1
+		CALL_NATIVE "sqrt", 1
+		CALL_NATIVE 7, 0
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []int{vm.CONST_F64, int(math.Float64bits(2)), vm.CALL_NATIVE, 0, 1, vm.CALL_NATIVE, 1, 1, vm.CALL_NATIVE, 0, 1, vm.CALL_NATIVE, 7, 0}
+	if !reflect.DeepEqual(expected, prog.Code) {
+		t.Errorf("Expected %v, got %v", expected, prog.Code)
+	}
+	if natives := []string{"sqrt", "str"}; !reflect.DeepEqual(natives, prog.Module().Natives) {
+		t.Errorf("Expected natives %q, got %q", natives, prog.Module().Natives)
+	}
+
+	if _, err := AssembleString(`CALL_NATIVE "sqrt"`); err == nil || !strings.Contains(err.Error(), "expects 2 operand(s), got 1") {
+		t.Errorf("Expected operand count error, got %v", err)
+	}
+}
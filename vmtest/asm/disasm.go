@@ -0,0 +1,123 @@
+package asm
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+
+	"github.com/sscaling/goplayground/vmtest/vm"
+)
+
+// DecodeError reports bytecode that could not be decoded
+type DecodeError struct {
+	Addr int
+	Msg  string
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("address %d: %s", e.Addr, e.Msg)
+}
+
+// instruction is a decoded opcode with its operands
+type instruction struct {
+	addr     int
+	code     int
+	op       vm.Opcode
+	operands []int
+	err      *DecodeError
+}
+
+// decode walks the code using the operand count of each opcode. Invalid
+// opcodes are skipped one word at a time so decoding can resynchronise.
+func decode(code []int) []instruction {
+	var instructions []instruction
+
+	for pc := 0; pc < len(code); {
+		op, ok := vm.LookupOpcode(code[pc])
+		if !ok {
+			instructions = append(instructions, instruction{
+				addr:     pc,
+				operands: code[pc : pc+1],
+				err:      &DecodeError{pc, fmt.Sprintf("invalid opcode %d", code[pc])},
+			})
+			pc++
+			continue
+		}
+
+		end := pc + 1 + op.Operands
+		ins := instruction{addr: pc, code: code[pc], op: op}
+		if end > len(code) {
+			end = len(code)
+			ins.err = &DecodeError{pc, fmt.Sprintf("%s truncated, expects %d operand(s), got %d", op.Name, op.Operands, end-pc-1)}
+		}
+		ins.operands = code[pc+1 : end]
+
+		instructions = append(instructions, ins)
+		pc = end
+	}
+
+	return instructions
+}
+
+// Disassemble renders bytecode as a listing of address, mnemonic and
+// operands. Branch and call targets that land on an instruction get a
+// synthesized label (L<addr>). Invalid opcodes and truncated instructions
+// are marked in the listing and the first one is also returned as a
+// *DecodeError.
+func Disassemble(code []int) (string, error) {
+	instructions := decode(code)
+
+	boundaries := map[int]bool{}
+	for _, ins := range instructions {
+		if ins.err == nil {
+			boundaries[ins.addr] = true
+		}
+	}
+
+	targets := map[int]bool{}
+	for _, ins := range instructions {
+		if ins.err == nil && ins.op.Branch && boundaries[ins.operands[0]] {
+			targets[ins.operands[0]] = true
+		}
+	}
+
+	var out bytes.Buffer
+	var firstErr error
+	for _, ins := range instructions {
+		if targets[ins.addr] {
+			fmt.Fprintf(&out, "L%d:\n", ins.addr)
+		}
+
+		if ins.err != nil && firstErr == nil {
+			firstErr = ins.err
+		}
+
+		if ins.op.Name == "" {
+			fmt.Fprintf(&out, "%04d    .word %d", ins.addr, ins.operands[0])
+		} else {
+			fmt.Fprintf(&out, "%04d    %s", ins.addr, ins.op.Name)
+			for i, operand := range ins.operands {
+				switch {
+				case i == 0 && ins.op.Branch && targets[operand]:
+					fmt.Fprintf(&out, " L%d", operand)
+				case ins.code == vm.CONST_F64:
+					fmt.Fprintf(&out, " %s", vm.Float(math.Float64frombits(uint64(operand))))
+				case ins.code == vm.CONST_BOOL:
+					fmt.Fprintf(&out, " %t", operand != 0)
+				default:
+					fmt.Fprintf(&out, " %d", operand)
+				}
+			}
+		}
+
+		switch {
+		case ins.err != nil:
+			fmt.Fprintf(&out, "    ; ERROR: %s", ins.err.Msg)
+		case ins.op.Branch && !targets[ins.operands[0]]:
+			fmt.Fprintf(&out, "    ; WARNING: target %d is not an instruction", ins.operands[0])
+		}
+		out.WriteString("\n")
+	}
+
+	return out.String(), firstErr
+}
@@ -0,0 +1,51 @@
+package asm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sscaling/goplayground/vmtest/vm"
+)
+
+func TestDisassembleFibonacci(t *testing.T) {
+	prog, err := AssembleFile("testdata/fib.vasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listing, err := Disassemble(prog.Code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"L0:\n0000    LOAD 0\n",
+		"0005    JMPF L10\n",
+		"L20:\n0020    LOAD 0\n",
+		"0025    CALL L0 1\n",
+		"0044    HALT\n",
+	} {
+		if !strings.Contains(listing, expected) {
+			t.Errorf("Expected listing to contain %q, got\n%s", expected, listing)
+		}
+	}
+}
+
+func TestDisassembleInvalid(t *testing.T) {
+	listing, err := Disassemble([]int{vm.CONST_I32, 1, 999, vm.JMP, 1, vm.CALL, 0})
+	if err == nil {
+		t.Fatal("Expected error for invalid opcode")
+	}
+	if e, ok := err.(*DecodeError); !ok || e.Addr != 2 {
+		t.Errorf("Expected decode error at address 2, got %v", err)
+	}
+
+	expected := "" +
+		"0000    CONST_I32 1\n" +
+		"0002    .word 999    ; ERROR: invalid opcode 999\n" +
+		"0003    JMP 1    ; WARNING: target 1 is not an instruction\n" +
+		"0005    CALL 0    ; ERROR: CALL truncated, expects 2 operand(s), got 1\n"
+	if listing != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, listing)
+	}
+}
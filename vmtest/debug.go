@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/sscaling/goplayground/vmtest/asm"
+	"github.com/sscaling/goplayground/vmtest/vm"
+)
+
+const debugHelp = `commands:
+  break <addr|label>      set a breakpoint
+  clear <addr|label>      remove a breakpoint
+  watch global <addr>     stop when a global changes
+  watch local <n>         stop when local slot n of the current frame changes
+  watch stack             stop when the stack depth changes
+  unwatch                 remove all watches
+  step [n]                execute n instructions (default 1)
+  continue                run to the next breakpoint, watch or HALT
+  stack                   print the stack
+  locals                  print the local slots of the current frame
+  globals                 print global memory
+  regs                    print pc, sp and fp
+  list                    disassemble the program
+  quit                    exit the debugger`
+
+// debug runs an interactive debugging session for a module, reading
+// commands from in. The program reads its own input from stdin, never the
+// commands. Program output and debugger output both go to out.
+func debug(module *vm.Module, in, stdin io.Reader, out io.Writer) {
+	machine := vm.NewFromModule(module, vm.Options{Stdout: out, Stdin: stdin})
+	machine.RegisterBuiltins()
+	d := vm.NewDebugger(machine)
+
+	listing, _ := asm.Disassemble(module.Code)
+	lines := map[int]string{}
+	for _, line := range strings.Split(listing, "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			if addr, err := strconv.Atoi(fields[0]); err == nil {
+				if n, ok := module.Lines[addr]; ok {
+					line = fmt.Sprintf("%-32s  %s:%d", line, module.Source, n)
+				}
+				lines[addr] = line
+			}
+		}
+	}
+
+	// address resolves a label or number
+	address := func(s string) (int, error) {
+		if addr, ok := module.Symbols[s]; ok {
+			return addr, nil
+		}
+		return strconv.Atoi(s)
+	}
+
+	// report prints where execution stopped
+	report := func(stop vm.Stop, err error) {
+		if err != nil {
+			fmt.Fprintf(out, "fault: %v\n", err)
+			return
+		}
+		if stop.Reason != vm.Stepped {
+			fmt.Fprintln(out, stop)
+		}
+		if stop.Reason != vm.Halted {
+			fmt.Fprintln(out, lines[stop.PC])
+		}
+	}
+
+	fmt.Fprintln(out, lines[machine.PC()])
+
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(out, "(vm) ")
+		if !scanner.Scan() {
+			return
+		}
+
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		args := fields[1:]
+		switch fields[0] {
+		case "break", "b", "clear":
+			if len(args) != 1 {
+				fmt.Fprintf(out, "usage: %s <addr|label>\n", fields[0])
+				continue
+			}
+			addr, err := address(args[0])
+			if err != nil {
+				fmt.Fprintf(out, "unknown address %q\n", args[0])
+				continue
+			}
+			if fields[0] == "clear" {
+				d.Clear(addr)
+			} else {
+				d.Break(addr)
+			}
+			fmt.Fprintf(out, "breakpoints: %v\n", d.Breakpoints())
+		case "watch", "w":
+			switch {
+			case len(args) == 1 && args[0] == "stack":
+				d.WatchStackDepth()
+			case len(args) == 2 && (args[0] == "global" || args[0] == "local"):
+				n, err := strconv.Atoi(args[1])
+				if err != nil {
+					fmt.Fprintf(out, "invalid slot %q\n", args[1])
+					continue
+				}
+				if args[0] == "global" {
+					d.WatchGlobal(n)
+				} else {
+					d.WatchLocal(n)
+				}
+			default:
+				fmt.Fprintln(out, "usage: watch global <addr> | watch local <n> | watch stack")
+			}
+		case "unwatch":
+			d.ClearWatches()
+		case "step", "s":
+			n := 1
+			if len(args) == 1 {
+				var err error
+				if n, err = strconv.Atoi(args[0]); err != nil || n < 1 {
+					fmt.Fprintf(out, "invalid count %q\n", args[0])
+					continue
+				}
+			}
+			var stop vm.Stop
+			var err error
+			for i := 0; i < n && err == nil && stop.Reason == vm.Stepped; i++ {
+				stop, err = d.Step()
+			}
+			report(stop, err)
+		case "continue", "c":
+			report(d.Continue())
+		case "stack":
+			fmt.Fprintln(out, machine.Stack())
+		case "locals":
+			fmt.Fprintln(out, machine.Locals())
+		case "globals":
+			fmt.Fprintln(out, machine.Globals())
+		case "regs":
+			fmt.Fprintf(out, "pc %d, sp %d, fp %d\n", machine.PC(), machine.SP(), machine.FP())
+		case "list", "l":
+			fmt.Fprint(out, listing)
+		case "help", "h", "?":
+			fmt.Fprintln(out, debugHelp)
+		case "quit", "q":
+			return
+		default:
+			fmt.Fprintf(out, "unknown command %q, try help\n", fields[0])
+		}
+	}
+}
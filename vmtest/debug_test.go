@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/sscaling/goplayground/vmtest/asm"
+)
+
+func TestDebugSession(t *testing.T) {
+	prog, err := asm.AssembleFile("asm/testdata/fib.vasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commands := strings.Join([]string{
+		"break recurse",
+		"continue",
+		"locals",
+		"step 2",
+		"stack",
+		"clear recurse",
+		"continue",
+	}, "\n")
+
+	var out bytes.Buffer
+	debug(prog.Module(), strings.NewReader(commands), strings.NewReader(""), &out)
+
+	for _, expected := range []string{
+		"breakpoints: [20]",
+		"breakpoint at 20\n0020    LOAD 0                    asm/testdata/fib.vasm:20",
+		"(vm) [6]\n",
+		"0024    SUB_I32",
+		"[6 6 1]", // argument N, then N and 1 pushed to compute N-1
+		"8\nhalted",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected output to contain %q, got\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestDebugInput(t *testing.T) {
+	prog, err := asm.AssembleString("READ\nREAD\nADD_I32\nPRINT\nHALT\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the program's input and the commands come from different readers
+	var out bytes.Buffer
+	debug(prog.Module(), strings.NewReader("step\nstack\ncontinue\n"), strings.NewReader("40 2\n"), &out)
+	for _, expected := range []string{"(vm) [40]\n", "42\nhalted"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected output to contain %q, got\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestDebugInvalidCount(t *testing.T) {
+	prog, err := asm.AssembleFile("asm/testdata/fib.vasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	debug(prog.Module(), strings.NewReader("step 0\nstep -2\nstep x\n"), strings.NewReader(""), &out)
+	for _, count := range []string{"0", "-2", "x"} {
+		if expected := fmt.Sprintf("invalid count %q", count); !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected output to contain %q, got\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestDebugBuiltins(t *testing.T) {
+	prog, err := asm.AssembleString("CONST_F64 16.0\nCALL_NATIVE \"sqrt\", 1\nPRINT\nHALT\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	debug(prog.Module(), strings.NewReader("continue\n"), strings.NewReader(""), &out)
+	if !strings.Contains(out.String(), "4\nhalted") {
+		t.Errorf("Expected sqrt to be registered, got\n%s", out.String())
+	}
+}
@@ -0,0 +1,108 @@
+package lang
+
+// node is an expression or statement in the syntax tree
+type node interface {
+	Line() int
+}
+
+// position is the source line a node starts on
+type position struct {
+	line int
+}
+
+func (p position) Line() int {
+	return p.line
+}
+
+// program is a parsed source file
+type program struct {
+	functions []*function
+	main      []node // top level statements, in order
+}
+
+type function struct {
+	position
+	name   string
+	params []string
+	body   []node
+}
+
+// expressions
+
+type numberLit struct {
+	position
+	value int64
+}
+
+type stringLit struct {
+	position
+	value string
+}
+
+type boolLit struct {
+	position
+	value bool
+}
+
+type nameExpr struct {
+	position
+	name string
+}
+
+type callExpr struct {
+	position
+	name string
+	args []node
+}
+
+type binaryExpr struct {
+	position
+	op          string
+	left, right node
+}
+
+type unaryExpr struct {
+	position
+	op      string
+	operand node
+}
+
+func binary(left node, op token, right node) node {
+	return &binaryExpr{position{op.line}, op.text, left, right}
+}
+
+// statements
+
+type assignStmt struct {
+	position
+	name  string
+	value node
+}
+
+type ifStmt struct {
+	position
+	cond node
+	then []node
+	els  []node // nil without an else, a single ifStmt for else if
+}
+
+type whileStmt struct {
+	position
+	cond node
+	body []node
+}
+
+type returnStmt struct {
+	position
+	value node
+}
+
+type printStmt struct {
+	position
+	value node
+}
+
+type callStmt struct {
+	position
+	call *callExpr
+}
@@ -0,0 +1,475 @@
+package lang
+
+import (
+	"fmt"
+
+	"github.com/sscaling/goplayground/vmtest/vm"
+)
+
+// compiler generates bytecode for a program. Functions come first, each
+// starting with ENTER for its locals, then the top level statements which
+// are the entry point and end with HALT.
+type compiler struct {
+	code   []int
+	lines  map[int]int // code address -> source line
+	line   int         // line of the statement being compiled
+	consts []string
+
+	functions map[string]*function
+	addrs     map[string]int // function name -> code address
+	calls     []call         // CALL operands to resolve once all addresses are known
+	globals   map[string]int // name -> global data address
+	locals    map[string]int // name -> slot, nil at the top level
+
+	globalValues map[string][]node // values assigned to each global, nil when assigned in a function
+	localValues  map[string][]node // values assigned to each local of the current function
+	inferring    map[string]bool   // names whose kind is being inferred
+}
+
+// call is the address of a CALL operand and the function it refers to
+type call struct {
+	addr int
+	name string
+}
+
+// compile generates the module. Errors are raised with panic, in the same
+// way as vm faults, and returned as *Error.
+func compile(prog *program) (module *vm.Module, err error) {
+	c := &compiler{
+		lines:     map[int]int{},
+		functions: map[string]*function{},
+		addrs:     map[string]int{},
+		globals:   map[string]int{},
+
+		globalValues: map[string][]node{},
+		inferring:    map[string]bool{},
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			module, err = nil, e
+		}
+	}()
+
+	for _, fn := range prog.functions {
+		if _, exists := c.functions[fn.name]; exists {
+			c.fail(fn.Line(), "function %s already declared", fn.name)
+		}
+		c.functions[fn.name] = fn
+	}
+	for _, name := range assigned(prog.main) {
+		c.globals[name] = len(c.globals)
+	}
+	for _, s := range assignments(prog.main) {
+		c.globalValues[s.name] = append(c.globalValues[s.name], s.value)
+	}
+	for _, fn := range prog.functions {
+		for _, s := range assignments(fn.body) {
+			if _, ok := c.globals[s.name]; ok && !isParam(fn, s.name) {
+				c.globalValues[s.name] = append(c.globalValues[s.name], nil)
+			}
+		}
+	}
+
+	for _, fn := range prog.functions {
+		c.function(fn)
+	}
+
+	entry := len(c.code)
+	c.locals = nil
+	c.statements(prog.main)
+	c.emit(vm.HALT)
+
+	for _, call := range c.calls {
+		c.code[call.addr] = c.addrs[call.name]
+	}
+
+	return &vm.Module{
+		Entry:    entry,
+		DataSize: len(c.globals),
+		Code:     c.code,
+		Consts:   c.consts,
+		Symbols:  c.addrs,
+		Lines:    c.lines,
+	}, nil
+}
+
+func (c *compiler) fail(line int, format string, args ...interface{}) {
+	panic(&Error{line, fmt.Sprintf(format, args...)})
+}
+
+// emit appends an instruction, returning its address
+func (c *compiler) emit(code int, operands ...int) int {
+	addr := len(c.code)
+	c.lines[addr] = c.line
+	c.code = append(c.code, code)
+	c.code = append(c.code, operands...)
+	return addr
+}
+
+// patch sets the jump target of the branch at addr to the next address
+func (c *compiler) patch(addr int) {
+	c.code[addr+1] = len(c.code)
+}
+
+func (c *compiler) function(fn *function) {
+	c.line = fn.Line()
+	c.addrs[fn.name] = len(c.code)
+
+	c.locals = map[string]int{}
+	for i, param := range fn.params {
+		c.locals[param] = i
+	}
+	var locals int
+	for _, name := range assigned(fn.body) {
+		if _, ok := c.locals[name]; ok {
+			continue
+		}
+		if _, ok := c.globals[name]; ok {
+			continue
+		}
+		c.locals[name] = len(c.locals)
+		locals++
+	}
+	if locals > 0 {
+		c.emit(vm.ENTER, locals)
+	}
+
+	c.localValues = map[string][]node{}
+	for _, s := range assignments(fn.body) {
+		if _, ok := c.locals[s.name]; ok && !isParam(fn, s.name) {
+			c.localValues[s.name] = append(c.localValues[s.name], s.value)
+		}
+	}
+
+	c.statements(fn.body)
+	if n := len(fn.body); n == 0 || !returns(fn.body[n-1]) {
+		c.emit(vm.CONST_I32, 0)
+		c.emit(vm.RET)
+	}
+}
+
+func (c *compiler) statements(stmts []node) {
+	for _, stmt := range stmts {
+		c.statement(stmt)
+	}
+}
+
+func (c *compiler) statement(stmt node) {
+	c.line = stmt.Line()
+
+	switch s := stmt.(type) {
+	case *assignStmt:
+		c.expression(s.value)
+		if slot, ok := c.locals[s.name]; ok {
+			c.emit(vm.STORE, slot)
+		} else {
+			c.emit(vm.GSTORE, c.globals[s.name])
+		}
+
+	case *ifStmt:
+		c.expression(s.cond)
+		jmpf := c.emit(vm.JMPF, 0)
+		c.statements(s.then)
+		if s.els == nil {
+			c.patch(jmpf)
+			break
+		}
+		jmp := c.emit(vm.JMP, 0)
+		c.patch(jmpf)
+		c.statements(s.els)
+		c.patch(jmp)
+
+	case *whileStmt:
+		top := len(c.code)
+		c.expression(s.cond)
+		jmpf := c.emit(vm.JMPF, 0)
+		c.statements(s.body)
+		c.line = s.Line()
+		c.emit(vm.JMP, top)
+		c.patch(jmpf)
+
+	case *returnStmt:
+		if c.locals == nil {
+			c.fail(s.Line(), "return outside of a function")
+		}
+		c.expression(s.value)
+		c.emit(vm.RET)
+
+	case *printStmt:
+		c.expression(s.value)
+		c.emit(vm.PRINT)
+
+	case *callStmt:
+		c.expression(s.call)
+		c.emit(vm.POP)
+
+	default:
+		panic(fmt.Sprintf("unexpected statement %T", stmt))
+	}
+}
+
+// binaryOps maps operators to the instruction computing them
+var binaryOps = map[string]int{
+	"+":  vm.ADD_I32,
+	"-":  vm.SUB_I32,
+	"*":  vm.MUL_I32,
+	"/":  vm.DIV_I32,
+	"%":  vm.MOD_I32,
+	"==": vm.EQ_I32,
+	"!=": vm.NE_I32,
+	"<":  vm.LT_I32,
+	"<=": vm.LE_I32,
+	">":  vm.GT_I32,
+	">=": vm.GE_I32,
+}
+
+// expression leaves the value of expr on the stack
+func (c *compiler) expression(expr node) {
+	switch e := expr.(type) {
+	case *numberLit:
+		c.emit(vm.CONST_I32, int(e.value))
+
+	case *stringLit:
+		c.emit(vm.CONST_STR, c.constant(e.value))
+
+	case *boolLit:
+		value := 0
+		if e.value {
+			value = 1
+		}
+		c.emit(vm.CONST_BOOL, value)
+
+	case *nameExpr:
+		if slot, ok := c.locals[e.name]; ok {
+			c.emit(vm.LOAD, slot)
+		} else if addr, ok := c.globals[e.name]; ok {
+			c.emit(vm.CONST_I32, addr)
+			c.emit(vm.GLOAD)
+		} else {
+			c.fail(e.Line(), "undefined: %s", e.name)
+		}
+
+	case *callExpr:
+		fn, ok := c.functions[e.name]
+		if !ok {
+			c.fail(e.Line(), "undefined function: %s", e.name)
+		}
+		if len(e.args) != len(fn.params) {
+			c.fail(e.Line(), "%s expects %d argument(s), got %d", e.name, len(fn.params), len(e.args))
+		}
+		for _, arg := range e.args {
+			c.expression(arg)
+		}
+		addr := c.emit(vm.CALL, 0, len(e.args))
+		c.calls = append(c.calls, call{addr + 1, e.name})
+
+	case *unaryExpr:
+		c.expression(e.operand)
+		if e.op == "-" {
+			c.emit(vm.NEG_I32)
+		} else {
+			c.emit(vm.NOT_I32)
+		}
+
+	case *binaryExpr:
+		c.expression(e.left)
+		switch e.op {
+		case "==", "!=":
+			c.expression(e.right)
+			c.equality(e)
+		case "&&", "||":
+			// keep the left value as the result when it decides
+			branch := vm.JMPF
+			if e.op == "||" {
+				branch = vm.JMPT
+			}
+			c.emit(vm.DUP)
+			jump := c.emit(branch, 0)
+			c.emit(vm.POP)
+			c.expression(e.right)
+			c.patch(jump)
+		default:
+			c.expression(e.right)
+			c.emit(binaryOps[e.op])
+		}
+
+	default:
+		panic(fmt.Sprintf("unexpected expression %T", expr))
+	}
+}
+
+// equality compares the two values on the stack for == or !=, as ints or
+// as bools depending on the kinds of the operands
+func (c *compiler) equality(e *binaryExpr) {
+	left, right := c.kind(e.left), c.kind(e.right)
+	switch {
+	case left == stringKind || right == stringKind:
+		c.fail(e.Line(), "strings can not be compared with %s", e.op)
+	case left != unknownKind && right != unknownKind && left != right:
+		c.fail(e.Line(), "mismatched types %s %s %s", left, e.op, right)
+	case left == boolKind || right == boolKind:
+		c.emit(vm.XOR_I32) // true when they differ
+		if e.op == "==" {
+			c.emit(vm.NOT_I32)
+		}
+	default:
+		c.emit(binaryOps[e.op])
+	}
+}
+
+// valueKind is what is known at compile time about the value of an
+// expression
+type valueKind int
+
+const (
+	unknownKind valueKind = iota
+	intKind
+	boolKind
+	stringKind
+	pendingKind // the kind of a name that is being inferred
+)
+
+func (k valueKind) String() string {
+	switch k {
+	case intKind:
+		return "int"
+	case boolKind:
+		return "bool"
+	case stringKind:
+		return "string"
+	}
+	return "unknown"
+}
+
+// kind returns the kind of an expression. Literals and operators have a
+// known kind, a variable has the kind of every value assigned to it when
+// they all agree. Parameters, calls and globals assigned inside functions
+// are unknown.
+func (c *compiler) kind(expr node) valueKind {
+	switch e := expr.(type) {
+	case *numberLit:
+		return intKind
+	case *stringLit:
+		return stringKind
+	case *boolLit:
+		return boolKind
+	case *nameExpr:
+		return c.nameKind(e.name)
+	case *unaryExpr:
+		if e.op == "-" {
+			return intKind
+		}
+		return c.kind(e.operand) // ! is bitwise on ints
+	case *binaryExpr:
+		switch e.op {
+		case "+", "-", "*", "/", "%":
+			return intKind
+		}
+		return boolKind
+	}
+	return unknownKind
+}
+
+func (c *compiler) nameKind(name string) valueKind {
+	values := c.globalValues[name]
+	if _, ok := c.locals[name]; ok {
+		values = c.localValues[name]
+	}
+	if c.inferring[name] {
+		return pendingKind // assume the other assignments decide
+	}
+	c.inferring[name] = true
+	defer delete(c.inferring, name)
+
+	kind := pendingKind
+	for _, value := range values {
+		if value == nil {
+			return unknownKind
+		}
+		switch k := c.kind(value); {
+		case k == pendingKind:
+		case k == unknownKind, kind != pendingKind && k != kind:
+			return unknownKind
+		default:
+			kind = k
+		}
+	}
+	if kind == pendingKind {
+		return unknownKind
+	}
+	return kind
+}
+
+// constant returns the pool index of a string, adding it when needed
+func (c *compiler) constant(s string) int {
+	for i, existing := range c.consts {
+		if existing == s {
+			return i
+		}
+	}
+	c.consts = append(c.consts, s)
+	return len(c.consts) - 1
+}
+
+// assigned returns the names assigned in stmts, in order of first
+// assignment
+func assigned(stmts []node) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, s := range assignments(stmts) {
+		if !seen[s.name] {
+			seen[s.name] = true
+			names = append(names, s.name)
+		}
+	}
+	return names
+}
+
+// assignments returns the assignments in stmts, including those nested in
+// if and while statements
+func assignments(stmts []node) []*assignStmt {
+	var found []*assignStmt
+
+	var walk func(stmts []node)
+	walk = func(stmts []node) {
+		for _, stmt := range stmts {
+			switch s := stmt.(type) {
+			case *assignStmt:
+				found = append(found, s)
+			case *ifStmt:
+				walk(s.then)
+				walk(s.els)
+			case *whileStmt:
+				walk(s.body)
+			}
+		}
+	}
+	walk(stmts)
+	return found
+}
+
+func isParam(fn *function, name string) bool {
+	for _, param := range fn.params {
+		if param == name {
+			return true
+		}
+	}
+	return false
+}
+
+// returns reports whether stmt always ends with a return
+func returns(stmt node) bool {
+	switch s := stmt.(type) {
+	case *returnStmt:
+		return true
+	case *ifStmt:
+		n, m := len(s.then), len(s.els)
+		return n > 0 && m > 0 && returns(s.then[n-1]) && returns(s.els[m-1])
+	}
+	return false
+}
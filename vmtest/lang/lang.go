@@ -0,0 +1,95 @@
+package lang
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/sscaling/goplayground/vmtest/vm"
+)
+
+// The parser is generated from lang.y
+//go:generate goyacc -o parser.go -v y.output lang.y
+
+// Compiler for a small language targeting the vm bytecodes:
+//
+//	# comments start with # or //
+//	fib(n) {                      # function declaration
+//	    if n < 3 { return 1 }
+//	    return fib(n-1) + fib(n-2)
+//	}
+//
+//	i = 1                         # top level assignments create globals
+//	while i <= 10 {
+//	    print fib(i)
+//	    i = i + 1
+//	}
+//
+// Statements are assignment, if/else, while, return, print and function
+// calls, there are no separators. Values are 64 bit integers, written in
+// decimal or in hex with a 0x prefix, true and false, and string literals
+// which can be printed or assigned. Operators are, loosest binding first:
+// || && == != < <= > >= + - * / % and the unary - and !. && and || short
+// circuit.
+//
+// == and != compare two ints or two bools, they are compared as bools when
+// either side is known to be one: a bool literal, a comparison, a logical
+// operator or a variable only ever assigned those. Comparing strings, or
+// an int with a bool, is a compile error. Otherwise, as for parameters and
+// call results, the values are compared as ints and comparing two bools
+// faults with a type error.
+//
+// Names assigned at the top level are globals. Inside a function the
+// parameters and any other name assigned in its body are locals, unless
+// the name is a global. Functions may be declared after their callers,
+// return 0 when they end without a return and must be called with as many
+// arguments as they have parameters.
+
+// Error is a compile error for a given source line
+type Error struct {
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// Compile reads source and returns the compiled module, with function
+// names as symbols and the source line of each instruction
+func Compile(r io.Reader) (*vm.Module, error) {
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return CompileString(string(src))
+}
+
+// CompileString compiles source held in a string
+func CompileString(src string) (*vm.Module, error) {
+	prog, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+	return compile(prog)
+}
+
+// CompileFile compiles a source file
+func CompileFile(path string) (*vm.Module, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	module, err := Compile(f)
+	if e, ok := err.(*Error); ok {
+		return nil, fmt.Errorf("%s:%d: %s", path, e.Line, e.Msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	module.Source = path
+	return module, nil
+}
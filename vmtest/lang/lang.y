@@ -0,0 +1,172 @@
+/* Grammar for the toy language, see lang.go */
+
+%{
+package lang
+%}
+
+%union {
+    tok   token
+    node  node
+    nodes []node
+}
+
+%token <tok> IDENT NUMBER STRING
+%token <tok> IF ELSE WHILE RETURN PRINT TRUE FALSE
+%token <tok> OROR ANDAND EQ NE LE GE
+%token <tok> '(' ')' '{' '}' ',' '=' '<' '>' '+' '-' '*' '/' '%' '!'
+
+%type <node> stmt ifstmt expr primary call
+%type <nodes> stmts block args exprs
+
+%left OROR
+%left ANDAND
+%left EQ NE
+%left '<' LE '>' GE
+%left '+' '-'
+%left '*' '/' '%'
+%right UNARY
+
+%start program
+
+%%
+
+program : /* empty */
+        | program stmt
+          {
+              l := yylex.(*lexer)
+              l.program.main = append(l.program.main, $2)
+          }
+        | program IDENT '(' args ')' block
+          {
+              yylex.(*lexer).function($2, $4, $6)
+          }
+        ;
+
+block   : '{' stmts '}'
+          {
+              $$ = $2
+          }
+        ;
+
+stmts   : /* empty */
+          {
+              $$ = nil
+          }
+        | stmts stmt
+          {
+              $$ = append($1, $2)
+          }
+        ;
+
+stmt    : IDENT '=' expr
+          {
+              $$ = &assignStmt{position{$1.line}, $1.text, $3}
+          }
+        | ifstmt
+        | WHILE expr block
+          {
+              $$ = &whileStmt{position{$1.line}, $2, $3}
+          }
+        | RETURN expr
+          {
+              $$ = &returnStmt{position{$1.line}, $2}
+          }
+        | PRINT expr
+          {
+              $$ = &printStmt{position{$1.line}, $2}
+          }
+        | call
+          {
+              $$ = &callStmt{position{$1.Line()}, $1.(*callExpr)}
+          }
+        ;
+
+ifstmt  : IF expr block
+          {
+              $$ = &ifStmt{position{$1.line}, $2, $3, nil}
+          }
+        | IF expr block ELSE block
+          {
+              $$ = &ifStmt{position{$1.line}, $2, $3, $5}
+          }
+        | IF expr block ELSE ifstmt
+          {
+              $$ = &ifStmt{position{$1.line}, $2, $3, []node{$5}}
+          }
+        ;
+
+expr    : primary
+        | expr OROR expr   { $$ = binary($1, $2, $3) }
+        | expr ANDAND expr { $$ = binary($1, $2, $3) }
+        | expr EQ expr     { $$ = binary($1, $2, $3) }
+        | expr NE expr     { $$ = binary($1, $2, $3) }
+        | expr '<' expr    { $$ = binary($1, $2, $3) }
+        | expr LE expr     { $$ = binary($1, $2, $3) }
+        | expr '>' expr    { $$ = binary($1, $2, $3) }
+        | expr GE expr     { $$ = binary($1, $2, $3) }
+        | expr '+' expr    { $$ = binary($1, $2, $3) }
+        | expr '-' expr    { $$ = binary($1, $2, $3) }
+        | expr '*' expr    { $$ = binary($1, $2, $3) }
+        | expr '/' expr    { $$ = binary($1, $2, $3) }
+        | expr '%' expr    { $$ = binary($1, $2, $3) }
+        | '-' expr %prec UNARY
+          {
+              $$ = &unaryExpr{position{$1.line}, $1.text, $2}
+          }
+        | '!' expr %prec UNARY
+          {
+              $$ = &unaryExpr{position{$1.line}, $1.text, $2}
+          }
+        ;
+
+primary : NUMBER
+          {
+              $$ = &numberLit{position{$1.line}, $1.value}
+          }
+        | STRING
+          {
+              $$ = &stringLit{position{$1.line}, $1.text}
+          }
+        | TRUE
+          {
+              $$ = &boolLit{position{$1.line}, true}
+          }
+        | FALSE
+          {
+              $$ = &boolLit{position{$1.line}, false}
+          }
+        | IDENT
+          {
+              $$ = &nameExpr{position{$1.line}, $1.text}
+          }
+        | call
+        | '(' expr ')'
+          {
+              $$ = $2
+          }
+        ;
+
+call    : IDENT '(' args ')'
+          {
+              $$ = &callExpr{position{$1.line}, $1.text, $3}
+          }
+        ;
+
+args    : /* empty */
+          {
+              $$ = nil
+          }
+        | exprs
+        ;
+
+exprs   : expr
+          {
+              $$ = []node{$1}
+          }
+        | exprs ',' expr
+          {
+              $$ = append($1, $3)
+          }
+        ;
+
+%%
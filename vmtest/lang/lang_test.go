@@ -0,0 +1,136 @@
+package lang
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/sscaling/goplayground/vmtest/vm"
+)
+
+// run compiles, verifies and executes src, returning what it printed. The
+// optimized program must print the same.
+func run(t *testing.T, src string) string {
+	module, err := CompileString(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diagnostics := vm.Verify(module); len(diagnostics) > 0 {
+		t.Fatalf("verify: %v", diagnostics)
+	}
+
+	optimized, err := vm.Optimize(module)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out, optOut bytes.Buffer
+	if err := vm.NewFromModule(module, vm.Options{Stdout: &out}).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.NewFromModule(optimized, vm.Options{Stdout: &optOut}).Run(); err != nil {
+		t.Fatalf("optimized: %v", err)
+	}
+	if out.String() != optOut.String() {
+		t.Errorf("%q: optimized program printed %q instead of %q", src, optOut.String(), out.String())
+	}
+	return out.String()
+}
+
+func TestFibonacci(t *testing.T) {
+	out := run(t, `fib(n) { if n < 3 { return 1 } return fib(n-1)+fib(n-2) } print fib(20)`)
+	if out != "6765\n" {
+		t.Errorf("Expected 6765, got %q", out)
+	}
+}
+
+func TestCompileFile(t *testing.T) {
+	module, err := CompileFile("testdata/fib.vl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := vm.NewFromModule(module, vm.Options{Stdout: &out}).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "1\n1\n2\n3\n5\n8\n13\n21\n34\n55\n"; out.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, out.String())
+	}
+
+	if module.Source != "testdata/fib.vl" || module.Symbols["fib"] != 0 {
+		t.Errorf("Expected debug information, got source %q and symbols %v", module.Source, module.Symbols)
+	}
+	if line := module.Lines[module.Entry]; line != 7 {
+		t.Errorf("Expected the entry point on line 7, got %d", line)
+	}
+}
+
+func TestStatements(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		out  string
+	}{
+		{"arithmetic", `print 1 + 2 * 3 - 8 / 4 % 3`, "5\n"},
+		{"precedence", `print (1 + 2) * -3`, "-9\n"},
+		{"comparison", `print 1 < 2 print 2 != 2`, "true\nfalse\n"},
+		{"logical", `print !(1 > 2) && 2 >= 2 || false`, "true\n"},
+		{"short circuit", `f() { print "called" return true } print false && f() print true || f()`, "false\ntrue\n"},
+		{"if else", `x = 5 if x < 3 { print "small" } else if x < 10 { print "medium" } else { print "large" }`, "medium\n"},
+		{"while", `i = 0 total = 0 while i < 5 { total = total + i i = i + 1 } print total`, "10\n"},
+		{"strings", `s = "hi\tthere" print s`, "hi\tthere\n"},
+		{"locals", `f(a) { b = a * 2 c = b + 1 return c } print f(4)`, "9\n"},
+		{"globals", `count = 0 bump() { count = count + 1 } bump() bump() print count`, "2\n"},
+		{"shadowing", `n = 7 f(n) { return n } print f(1) print n`, "1\n7\n"},
+		{"implicit return", `f() { } print f()`, "0\n"},
+		{"forward call", `print twice(21) twice(x) { return x * 2 }`, "42\n"},
+		{"comments", "# hash\nprint 1 // slash\n", "1\n"},
+		{"hex", `print 0x10`, "16\n"},
+		{"leading zeros", `print 010 print 08`, "10\n8\n"},
+		{"bool equality", `t = true f = !t print t == f print t != f print (1 < 2) == true`, "false\ntrue\ntrue\n"},
+		{"inferred bools", `b = false i = 0 while i < 3 { b = !b i = i + 1 } print b == true`, "true\n"},
+		{"int equality", `x = 2 print x == 1 + 1 print x != 2`, "true\nfalse\n"},
+	}
+
+	for _, test := range tests {
+		if out := run(t, test.src); out != test.out {
+			t.Errorf("%s: expected %q, got %q", test.name, test.out, out)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		line int
+		msg  string
+	}{
+		{"print x", 1, "undefined: x"},
+		{"\nprint f()", 2, "undefined function: f"},
+		{"f(a) { return a }\nprint f(1, 2)", 2, "f expects 1 argument(s), got 2"},
+		{"f() { }\nf() { }", 2, "function f already declared"},
+		{"f(a, a) { }", 1, "duplicate parameter a in f"},
+		{"f(1) { }", 1, "parameters of f must be names"},
+		{"return 1", 1, "return outside of a function"},
+		{"print 1 +", 1, "syntax error"},
+		{"x = 1\nprint @", 2, "unexpected character '@'"},
+		{`print "open`, 1, "unterminated string"},
+		{"print 0b1", 1, `invalid number "0b1"`},
+		{"print 0x", 1, `invalid number "0x"`},
+		{"s = \"a\"\nprint s == \"a\"", 2, "strings can not be compared with =="},
+		{"print 1 != (2 < 3)", 1, "mismatched types int != bool"},
+	}
+
+	for _, test := range tests {
+		_, err := CompileString(test.src)
+		e, ok := err.(*Error)
+		if !ok {
+			t.Errorf("%q: expected *Error, got %v", test.src, err)
+			continue
+		}
+		if e.Line != test.line || !strings.Contains(e.Msg, test.msg) {
+			t.Errorf("%q: expected line %d: %s, got %v", test.src, test.line, test.msg, e)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package lang
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// token is the value of a terminal symbol
+type token struct {
+	line  int
+	text  string // identifier name, operator or unquoted string
+	value int64  // NUMBER
+}
+
+var keywords = map[string]int{
+	"if":     IF,
+	"else":   ELSE,
+	"while":  WHILE,
+	"return": RETURN,
+	"print":  PRINT,
+	"true":   TRUE,
+	"false":  FALSE,
+}
+
+// two character operators
+var operators = map[string]int{
+	"||": OROR,
+	"&&": ANDAND,
+	"==": EQ,
+	"!=": NE,
+	"<=": LE,
+	">=": GE,
+}
+
+// lexer implements the yyLexer interface. It also collects the parsed
+// program, as the grammar actions only have access to the lexer.
+type lexer struct {
+	src  string
+	pos  int
+	line int // line of the last token returned
+
+	program *program
+	err     *Error // first error, syntax or lexical
+}
+
+func newLexer(src string) *lexer {
+	return &lexer{src: src, line: 1, program: &program{}}
+}
+
+func (l *lexer) Lex(lval *yySymType) int {
+	l.skip()
+	if l.pos >= len(l.src) {
+		return 0
+	}
+
+	start := l.pos
+	c := l.src[l.pos]
+	lval.tok = token{line: l.line}
+
+	switch {
+	case isLetter(c):
+		for l.pos < len(l.src) && (isLetter(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		lval.tok.text = l.src[start:l.pos]
+		if kw, ok := keywords[lval.tok.text]; ok {
+			return kw
+		}
+		return IDENT
+
+	case isDigit(c):
+		for l.pos < len(l.src) && (isLetter(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		lval.tok.text = l.src[start:l.pos]
+		digits, base := lval.tok.text, 10 // a leading 0 is not octal
+		if len(digits) > 2 && digits[0] == '0' && (digits[1] == 'x' || digits[1] == 'X') {
+			digits, base = digits[2:], 16
+		}
+		value, err := strconv.ParseInt(digits, base, 64)
+		if err != nil {
+			l.fail("invalid number %q", lval.tok.text)
+			return 0
+		}
+		lval.tok.value = value
+		return NUMBER
+
+	case c == '"':
+		for l.pos++; l.pos < len(l.src) && l.src[l.pos] != '"' && l.src[l.pos] != '\n'; l.pos++ {
+			if l.src[l.pos] == '\\' {
+				l.pos++
+			}
+		}
+		if l.pos >= len(l.src) || l.src[l.pos] != '"' {
+			l.fail("unterminated string")
+			return 0
+		}
+		l.pos++
+		value, err := strconv.Unquote(l.src[start:l.pos])
+		if err != nil {
+			l.fail("invalid string %s", l.src[start:l.pos])
+			return 0
+		}
+		lval.tok.text = value
+		return STRING
+	}
+
+	if l.pos+2 <= len(l.src) {
+		if op, ok := operators[l.src[l.pos:l.pos+2]]; ok {
+			lval.tok.text = l.src[l.pos : l.pos+2]
+			l.pos += 2
+			return op
+		}
+	}
+
+	if strings.IndexByte("(){},=<>+-*/%!", c) < 0 {
+		l.fail("unexpected character %q", c)
+		return 0
+	}
+	lval.tok.text = string(c)
+	l.pos++
+	return int(c)
+}
+
+// skip moves past white space and comments, counting lines
+func (l *lexer) skip() {
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case c == '#' || strings.HasPrefix(l.src[l.pos:], "//"):
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Error is called by the parser on a syntax error
+func (l *lexer) Error(s string) {
+	l.fail("%s", s)
+}
+
+func (l *lexer) fail(format string, args ...interface{}) {
+	if l.err == nil {
+		l.err = &Error{l.line, fmt.Sprintf(format, args...)}
+	}
+}
+
+// function adds a function declaration. The parameters are parsed as
+// call arguments, which keeps the grammar free of conflicts between a
+// call statement and a declaration, so they are checked here.
+func (l *lexer) function(name token, args []node, body []node) {
+	fn := &function{position: position{name.line}, name: name.text, body: body}
+	for _, arg := range args {
+		param, ok := arg.(*nameExpr)
+		if !ok {
+			l.fail("parameters of %s must be names", name.text)
+			return
+		}
+		for _, p := range fn.params {
+			if p == param.name {
+				l.fail("duplicate parameter %s in %s", p, name.text)
+				return
+			}
+		}
+		fn.params = append(fn.params, param.name)
+	}
+	l.program.functions = append(l.program.functions, fn)
+}
+
+func isLetter(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func init() {
+	yyErrorVerbose = true // syntax errors name the unexpected token
+}
+
+// parse returns the syntax tree of a source file
+func parse(src string) (*program, error) {
+	l := newLexer(src)
+	yyParse(l)
+	if l.err != nil {
+		return nil, l.err
+	}
+	return l.program, nil
+}
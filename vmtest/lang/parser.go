@@ -0,0 +1,762 @@
+// Code generated by goyacc -o parser.go -v y.output lang.y. DO NOT EDIT.
+
+//line lang.y:4
+package lang
+
+import __yyfmt__ "fmt"
+
+//line lang.y:4
+
+//line lang.y:7
+type yySymType struct {
+	yys   int
+	tok   token
+	node  node
+	nodes []node
+}
+
+const IDENT = 57346
+const NUMBER = 57347
+const STRING = 57348
+const IF = 57349
+const ELSE = 57350
+const WHILE = 57351
+const RETURN = 57352
+const PRINT = 57353
+const TRUE = 57354
+const FALSE = 57355
+const OROR = 57356
+const ANDAND = 57357
+const EQ = 57358
+const NE = 57359
+const LE = 57360
+const GE = 57361
+const UNARY = 57362
+
+var yyToknames = [...]string{
+	"$end",
+	"error",
+	"$unk",
+	"IDENT",
+	"NUMBER",
+	"STRING",
+	"IF",
+	"ELSE",
+	"WHILE",
+	"RETURN",
+	"PRINT",
+	"TRUE",
+	"FALSE",
+	"OROR",
+	"ANDAND",
+	"EQ",
+	"NE",
+	"LE",
+	"GE",
+	"'('",
+	"')'",
+	"'{'",
+	"'}'",
+	"','",
+	"'='",
+	"'<'",
+	"'>'",
+	"'+'",
+	"'-'",
+	"'*'",
+	"'/'",
+	"'%'",
+	"'!'",
+	"UNARY",
+}
+
+var yyStatenames = [...]string{}
+
+const yyEofCode = 1
+const yyErrCode = 2
+const yyInitialStackSize = 16
+
+//line lang.y:172
+
+//line yacctab:1
+var yyExca = [...]int8{
+	-1, 1,
+	1, -1,
+	-2, 0,
+}
+
+const yyPrivate = 57344
+
+const yyLast = 198
+
+var yyAct = [...]int8{
+	28, 4, 30, 21, 51, 8, 12, 23, 24, 2,
+	25, 26, 29, 44, 9, 45, 46, 39, 40, 41,
+	42, 43, 47, 48, 41, 42, 43, 11, 49, 44,
+	74, 50, 52, 53, 54, 55, 56, 57, 58, 59,
+	60, 61, 62, 63, 64, 10, 47, 68, 1, 27,
+	11, 65, 70, 69, 36, 38, 13, 0, 0, 66,
+	0, 0, 35, 37, 39, 40, 41, 42, 43, 8,
+	76, 75, 0, 0, 0, 72, 31, 32, 33, 34,
+	36, 38, 0, 67, 0, 0, 0, 0, 35, 37,
+	39, 40, 41, 42, 43, 31, 32, 33, 34, 36,
+	38, 0, 0, 44, 0, 0, 0, 35, 37, 39,
+	40, 41, 42, 43, 31, 32, 33, 34, 36, 38,
+	0, 0, 0, 0, 0, 0, 35, 37, 39, 40,
+	41, 42, 43, 32, 33, 34, 36, 38, 0, 0,
+	0, 0, 0, 0, 35, 37, 39, 40, 41, 42,
+	43, 33, 34, 36, 38, 0, 0, 0, 0, 0,
+	0, 35, 37, 39, 40, 41, 42, 43, 20, 16,
+	17, 0, 0, 0, 0, 73, 18, 19, 9, 0,
+	5, 6, 7, 3, 22, 0, 9, 0, 5, 6,
+	7, 0, 0, 14, 71, 0, 0, 15,
+}
+
+var yyPact = [...]int16{
+	-32768, 179, -32768, 25, -32768, 164, 164, 164, -32768, 164,
+	164, 164, 81, -32768, 164, 164, -32768, -32768, -32768, -32768,
+	26, -32768, 164, 100, 100, 81, 10, -20, 100, 100,
+	-32768, 164, 164, 164, 164, 164, 164, 164, 164, 164,
+	164, 164, 164, 164, -32768, -32768, -32768, 164, 62, 39,
+	-9, 164, 118, 135, 36, 36, -11, -11, -11, -11,
+	-6, -6, -32768, -32768, -32768, 171, 9, -32768, 7, -32768,
+	100, -32768, -32768, 2, -32768, -32768, -32768,
+}
+
+var yyPgo = [...]int8{
+	0, 9, 1, 0, 56, 3, 51, 2, 11, 49,
+	48,
+}
+
+var yyR1 = [...]int8{
+	0, 10, 10, 10, 7, 6, 6, 1, 1, 1,
+	1, 1, 1, 2, 2, 2, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 4, 4, 4, 4, 4, 4, 4, 5,
+	8, 8, 9, 9,
+}
+
+var yyR2 = [...]int8{
+	0, 0, 2, 6, 3, 0, 2, 3, 1, 3,
+	2, 2, 1, 3, 5, 5, 1, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	2, 2, 1, 1, 1, 1, 1, 1, 3, 4,
+	0, 1, 1, 3,
+}
+
+var yyChk = [...]int16{
+	-32768, -10, -1, 4, -2, 9, 10, 11, -5, 7,
+	20, 25, -3, -4, 29, 33, 5, 6, 12, 13,
+	4, -5, 20, -3, -3, -3, -8, -9, -3, -3,
+	-7, 14, 15, 16, 17, 26, 18, 27, 19, 28,
+	29, 30, 31, 32, 22, -3, -3, 20, -3, -7,
+	21, 24, -3, -3, -3, -3, -3, -3, -3, -3,
+	-3, -3, -3, -3, -3, -6, -8, 21, 8, -7,
+	-3, 23, -1, 4, 21, -7, -2,
+}
+
+var yyDef = [...]int8{
+	1, -2, 2, 0, 8, 0, 0, 0, 12, 0,
+	40, 0, 0, 16, 0, 0, 32, 33, 34, 35,
+	36, 37, 0, 10, 11, 0, 0, 41, 42, 7,
+	9, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 5, 30, 31, 40, 0, 13,
+	39, 0, 17, 18, 19, 20, 21, 22, 23, 24,
+	25, 26, 27, 28, 29, 0, 0, 38, 0, 3,
+	43, 4, 6, 0, 39, 14, 15,
+}
+
+var yyTok1 = [...]int8{
+	1, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 33, 3, 3, 3, 32, 3, 3,
+	20, 21, 30, 28, 24, 29, 3, 31, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	26, 25, 27, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 22, 3, 23,
+}
+
+var yyTok2 = [...]int8{
+	2, 3, 4, 5, 6, 7, 8, 9, 10, 11,
+	12, 13, 14, 15, 16, 17, 18, 19, 34,
+}
+
+var yyTok3 = [...]int8{
+	0,
+}
+
+var yyErrorMessages = [...]struct {
+	state int
+	token int
+	msg   string
+}{}
+
+//line yaccpar:1
+
+/*	parser for yacc output	*/
+
+var (
+	yyDebug        = 0
+	yyErrorVerbose = false
+)
+
+type yyLexer interface {
+	Lex(lval *yySymType) int
+	Error(s string)
+}
+
+type yyParser interface {
+	Parse(yyLexer) int
+	Lookahead() int
+}
+
+type yyParserImpl struct {
+	lval  yySymType
+	stack [yyInitialStackSize]yySymType
+	char  int
+}
+
+func (p *yyParserImpl) Lookahead() int {
+	return p.char
+}
+
+func yyNewParser() yyParser {
+	return &yyParserImpl{}
+}
+
+const yyFlag = -32768
+
+func yyTokname(c int) string {
+	if c >= 1 && c-1 < len(yyToknames) {
+		if yyToknames[c-1] != "" {
+			return yyToknames[c-1]
+		}
+	}
+	return __yyfmt__.Sprintf("tok-%v", c)
+}
+
+func yyStatname(s int) string {
+	if s >= 0 && s < len(yyStatenames) {
+		if yyStatenames[s] != "" {
+			return yyStatenames[s]
+		}
+	}
+	return __yyfmt__.Sprintf("state-%v", s)
+}
+
+func yyErrorMessage(state, lookAhead int) string {
+	const TOKSTART = 4
+
+	if !yyErrorVerbose {
+		return "syntax error"
+	}
+
+	for _, e := range yyErrorMessages {
+		if e.state == state && e.token == lookAhead {
+			return "syntax error: " + e.msg
+		}
+	}
+
+	res := "syntax error: unexpected " + yyTokname(lookAhead)
+
+	// To match Bison, suggest at most four expected tokens.
+	expected := make([]int, 0, 4)
+
+	// Look for shiftable tokens.
+	base := int(yyPact[state])
+	for tok := TOKSTART; tok-1 < len(yyToknames); tok++ {
+		if n := base + tok; n >= 0 && n < yyLast && int(yyChk[int(yyAct[n])]) == tok {
+			if len(expected) == cap(expected) {
+				return res
+			}
+			expected = append(expected, tok)
+		}
+	}
+
+	if yyDef[state] == -2 {
+		i := 0
+		for yyExca[i] != -1 || int(yyExca[i+1]) != state {
+			i += 2
+		}
+
+		// Look for tokens that we accept or reduce.
+		for i += 2; yyExca[i] >= 0; i += 2 {
+			tok := int(yyExca[i])
+			if tok < TOKSTART || yyExca[i+1] == 0 {
+				continue
+			}
+			if len(expected) == cap(expected) {
+				return res
+			}
+			expected = append(expected, tok)
+		}
+
+		// If the default action is to accept or reduce, give up.
+		if yyExca[i+1] != 0 {
+			return res
+		}
+	}
+
+	for i, tok := range expected {
+		if i == 0 {
+			res += ", expecting "
+		} else {
+			res += " or "
+		}
+		res += yyTokname(tok)
+	}
+	return res
+}
+
+func yylex1(lex yyLexer, lval *yySymType) (char, token int) {
+	token = 0
+	char = lex.Lex(lval)
+	if char <= 0 {
+		token = int(yyTok1[0])
+		goto out
+	}
+	if char < len(yyTok1) {
+		token = int(yyTok1[char])
+		goto out
+	}
+	if char >= yyPrivate {
+		if char < yyPrivate+len(yyTok2) {
+			token = int(yyTok2[char-yyPrivate])
+			goto out
+		}
+	}
+	for i := 0; i < len(yyTok3); i += 2 {
+		token = int(yyTok3[i+0])
+		if token == char {
+			token = int(yyTok3[i+1])
+			goto out
+		}
+	}
+
+out:
+	if token == 0 {
+		token = int(yyTok2[1]) /* unknown char */
+	}
+	if yyDebug >= 3 {
+		__yyfmt__.Printf("lex %s(%d)\n", yyTokname(token), uint(char))
+	}
+	return char, token
+}
+
+func yyParse(yylex yyLexer) int {
+	return yyNewParser().Parse(yylex)
+}
+
+func (yyrcvr *yyParserImpl) Parse(yylex yyLexer) int {
+	var yyn int
+	var yyVAL yySymType
+	var yyDollar []yySymType
+	_ = yyDollar // silence set and not used
+	yyS := yyrcvr.stack[:]
+
+	Nerrs := 0   /* number of errors */
+	Errflag := 0 /* error recovery flag */
+	yystate := 0
+	yyrcvr.char = -1
+	yytoken := -1 // yyrcvr.char translated into internal numbering
+	defer func() {
+		// Make sure we report no lookahead when not parsing.
+		yystate = -1
+		yyrcvr.char = -1
+		yytoken = -1
+	}()
+	yyp := -1
+	goto yystack
+
+ret0:
+	return 0
+
+ret1:
+	return 1
+
+yystack:
+	/* put a state and value onto the stack */
+	if yyDebug >= 4 {
+		__yyfmt__.Printf("char %v in %v\n", yyTokname(yytoken), yyStatname(yystate))
+	}
+
+	yyp++
+	if yyp >= len(yyS) {
+		nyys := make([]yySymType, len(yyS)*2)
+		copy(nyys, yyS)
+		yyS = nyys
+	}
+	yyS[yyp] = yyVAL
+	yyS[yyp].yys = yystate
+
+yynewstate:
+	yyn = int(yyPact[yystate])
+	if yyn <= yyFlag {
+		goto yydefault /* simple state */
+	}
+	if yyrcvr.char < 0 {
+		yyrcvr.char, yytoken = yylex1(yylex, &yyrcvr.lval)
+	}
+	yyn += yytoken
+	if yyn < 0 || yyn >= yyLast {
+		goto yydefault
+	}
+	yyn = int(yyAct[yyn])
+	if int(yyChk[yyn]) == yytoken { /* valid shift */
+		yyrcvr.char = -1
+		yytoken = -1
+		yyVAL = yyrcvr.lval
+		yystate = yyn
+		if Errflag > 0 {
+			Errflag--
+		}
+		goto yystack
+	}
+
+yydefault:
+	/* default state action */
+	yyn = int(yyDef[yystate])
+	if yyn == -2 {
+		if yyrcvr.char < 0 {
+			yyrcvr.char, yytoken = yylex1(yylex, &yyrcvr.lval)
+		}
+
+		/* look through exception table */
+		xi := 0
+		for {
+			if yyExca[xi+0] == -1 && int(yyExca[xi+1]) == yystate {
+				break
+			}
+			xi += 2
+		}
+		for xi += 2; ; xi += 2 {
+			yyn = int(yyExca[xi+0])
+			if yyn < 0 || yyn == yytoken {
+				break
+			}
+		}
+		yyn = int(yyExca[xi+1])
+		if yyn < 0 {
+			goto ret0
+		}
+	}
+	if yyn == 0 {
+		/* error ... attempt to resume parsing */
+		switch Errflag {
+		case 0: /* brand new error */
+			yylex.Error(yyErrorMessage(yystate, yytoken))
+			Nerrs++
+			if yyDebug >= 1 {
+				__yyfmt__.Printf("%s", yyStatname(yystate))
+				__yyfmt__.Printf(" saw %s\n", yyTokname(yytoken))
+			}
+			fallthrough
+
+		case 1, 2: /* incompletely recovered error ... try again */
+			Errflag = 3
+
+			/* find a state where "error" is a legal shift action */
+			for yyp >= 0 {
+				yyn = int(yyPact[yyS[yyp].yys]) + yyErrCode
+				if yyn >= 0 && yyn < yyLast {
+					yystate = int(yyAct[yyn]) /* simulate a shift of "error" */
+					if int(yyChk[yystate]) == yyErrCode {
+						goto yystack
+					}
+				}
+
+				/* the current p has no shift on "error", pop stack */
+				if yyDebug >= 2 {
+					__yyfmt__.Printf("error recovery pops state %d\n", yyS[yyp].yys)
+				}
+				yyp--
+			}
+			/* there is no state on the stack with an error shift ... abort */
+			goto ret1
+
+		case 3: /* no shift yet; clobber input char */
+			if yyDebug >= 2 {
+				__yyfmt__.Printf("error recovery discards %s\n", yyTokname(yytoken))
+			}
+			if yytoken == yyEofCode {
+				goto ret1
+			}
+			yyrcvr.char = -1
+			yytoken = -1
+			goto yynewstate /* try again in the same state */
+		}
+	}
+
+	/* reduction by production yyn */
+	if yyDebug >= 2 {
+		__yyfmt__.Printf("reduce %v in:\n\t%v\n", yyn, yyStatname(yystate))
+	}
+
+	yynt := yyn
+	yypt := yyp
+	_ = yypt // guard against "declared and not used"
+
+	yyp -= int(yyR2[yyn])
+	// yyp is now the index of $0. Perform the default action. Iff the
+	// reduced production is ε, $1 is possibly out of range.
+	if yyp+1 >= len(yyS) {
+		nyys := make([]yySymType, len(yyS)*2)
+		copy(nyys, yyS)
+		yyS = nyys
+	}
+	yyVAL = yyS[yyp+1]
+
+	/* consult goto table to find next state */
+	yyn = int(yyR1[yyn])
+	yyg := int(yyPgo[yyn])
+	yyj := yyg + yyS[yyp].yys + 1
+
+	if yyj >= yyLast {
+		yystate = int(yyAct[yyg])
+	} else {
+		yystate = int(yyAct[yyj])
+		if int(yyChk[yystate]) != -yyn {
+			yystate = int(yyAct[yyg])
+		}
+	}
+	// dummy call; replaced with literal code
+	switch yynt {
+
+	case 2:
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line lang.y:35
+		{
+			l := yylex.(*lexer)
+			l.program.main = append(l.program.main, yyDollar[2].node)
+		}
+	case 3:
+		yyDollar = yyS[yypt-6 : yypt+1]
+//line lang.y:40
+		{
+			yylex.(*lexer).function(yyDollar[2].tok, yyDollar[4].nodes, yyDollar[6].nodes)
+		}
+	case 4:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line lang.y:46
+		{
+			yyVAL.nodes = yyDollar[2].nodes
+		}
+	case 5:
+		yyDollar = yyS[yypt-0 : yypt+1]
+//line lang.y:52
+		{
+			yyVAL.nodes = nil
+		}
+	case 6:
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line lang.y:56
+		{
+			yyVAL.nodes = append(yyDollar[1].nodes, yyDollar[2].node)
+		}
+	case 7:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line lang.y:62
+		{
+			yyVAL.node = &assignStmt{position{yyDollar[1].tok.line}, yyDollar[1].tok.text, yyDollar[3].node}
+		}
+	case 9:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line lang.y:67
+		{
+			yyVAL.node = &whileStmt{position{yyDollar[1].tok.line}, yyDollar[2].node, yyDollar[3].nodes}
+		}
+	case 10:
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line lang.y:71
+		{
+			yyVAL.node = &returnStmt{position{yyDollar[1].tok.line}, yyDollar[2].node}
+		}
+	case 11:
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line lang.y:75
+		{
+			yyVAL.node = &printStmt{position{yyDollar[1].tok.line}, yyDollar[2].node}
+		}
+	case 12:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line lang.y:79
+		{
+			yyVAL.node = &callStmt{position{yyDollar[1].node.Line()}, yyDollar[1].node.(*callExpr)}
+		}
+	case 13:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line lang.y:85
+		{
+			yyVAL.node = &ifStmt{position{yyDollar[1].tok.line}, yyDollar[2].node, yyDollar[3].nodes, nil}
+		}
+	case 14:
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line lang.y:89
+		{
+			yyVAL.node = &ifStmt{position{yyDollar[1].tok.line}, yyDollar[2].node, yyDollar[3].nodes, yyDollar[5].nodes}
+		}
+	case 15:
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line lang.y:93
+		{
+			yyVAL.node = &ifStmt{position{yyDollar[1].tok.line}, yyDollar[2].node, yyDollar[3].nodes, []node{yyDollar[5].node}}
+		}
+	case 17:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line lang.y:99
+		{
+			yyVAL.node = binary(yyDollar[1].node, yyDollar[2].tok, yyDollar[3].node)
+		}
+	case 18:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line lang.y:100
+		{
+			yyVAL.node = binary(yyDollar[1].node, yyDollar[2].tok, yyDollar[3].node)
+		}
+	case 19:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line lang.y:101
+		{
+			yyVAL.node = binary(yyDollar[1].node, yyDollar[2].tok, yyDollar[3].node)
+		}
+	case 20:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line lang.y:102
+		{
+			yyVAL.node = binary(yyDollar[1].node, yyDollar[2].tok, yyDollar[3].node)
+		}
+	case 21:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line lang.y:103
+		{
+			yyVAL.node = binary(yyDollar[1].node, yyDollar[2].tok, yyDollar[3].node)
+		}
+	case 22:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line lang.y:104
+		{
+			yyVAL.node = binary(yyDollar[1].node, yyDollar[2].tok, yyDollar[3].node)
+		}
+	case 23:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line lang.y:105
+		{
+			yyVAL.node = binary(yyDollar[1].node, yyDollar[2].tok, yyDollar[3].node)
+		}
+	case 24:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line lang.y:106
+		{
+			yyVAL.node = binary(yyDollar[1].node, yyDollar[2].tok, yyDollar[3].node)
+		}
+	case 25:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line lang.y:107
+		{
+			yyVAL.node = binary(yyDollar[1].node, yyDollar[2].tok, yyDollar[3].node)
+		}
+	case 26:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line lang.y:108
+		{
+			yyVAL.node = binary(yyDollar[1].node, yyDollar[2].tok, yyDollar[3].node)
+		}
+	case 27:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line lang.y:109
+		{
+			yyVAL.node = binary(yyDollar[1].node, yyDollar[2].tok, yyDollar[3].node)
+		}
+	case 28:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line lang.y:110
+		{
+			yyVAL.node = binary(yyDollar[1].node, yyDollar[2].tok, yyDollar[3].node)
+		}
+	case 29:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line lang.y:111
+		{
+			yyVAL.node = binary(yyDollar[1].node, yyDollar[2].tok, yyDollar[3].node)
+		}
+	case 30:
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line lang.y:113
+		{
+			yyVAL.node = &unaryExpr{position{yyDollar[1].tok.line}, yyDollar[1].tok.text, yyDollar[2].node}
+		}
+	case 31:
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line lang.y:117
+		{
+			yyVAL.node = &unaryExpr{position{yyDollar[1].tok.line}, yyDollar[1].tok.text, yyDollar[2].node}
+		}
+	case 32:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line lang.y:123
+		{
+			yyVAL.node = &numberLit{position{yyDollar[1].tok.line}, yyDollar[1].tok.value}
+		}
+	case 33:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line lang.y:127
+		{
+			yyVAL.node = &stringLit{position{yyDollar[1].tok.line}, yyDollar[1].tok.text}
+		}
+	case 34:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line lang.y:131
+		{
+			yyVAL.node = &boolLit{position{yyDollar[1].tok.line}, true}
+		}
+	case 35:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line lang.y:135
+		{
+			yyVAL.node = &boolLit{position{yyDollar[1].tok.line}, false}
+		}
+	case 36:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line lang.y:139
+		{
+			yyVAL.node = &nameExpr{position{yyDollar[1].tok.line}, yyDollar[1].tok.text}
+		}
+	case 38:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line lang.y:144
+		{
+			yyVAL.node = yyDollar[2].node
+		}
+	case 39:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line lang.y:150
+		{
+			yyVAL.node = &callExpr{position{yyDollar[1].tok.line}, yyDollar[1].tok.text, yyDollar[3].nodes}
+		}
+	case 40:
+		yyDollar = yyS[yypt-0 : yypt+1]
+//line lang.y:156
+		{
+			yyVAL.nodes = nil
+		}
+	case 42:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line lang.y:163
+		{
+			yyVAL.nodes = []node{yyDollar[1].node}
+		}
+	case 43:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line lang.y:167
+		{
+			yyVAL.nodes = append(yyDollar[1].nodes, yyDollar[3].node)
+		}
+	}
+	goto yystack /* stack new state and value */
+}
@@ -1,14 +1,239 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sscaling/goplayground/vmtest/asm"
+	"github.com/sscaling/goplayground/vmtest/lang"
 	"github.com/sscaling/goplayground/vmtest/vm"
 )
 
 func main() {
-	fmt.Println("Start")
+	debugFlag := flag.Bool("debug", false, "start an interactive debugger")
+	output := flag.String("o", "", "write the assembled module to `file` instead of running it")
+	noVerify := flag.Bool("noverify", false, "skip static verification of the program")
+	optimize := flag.Bool("O", false, "run the peephole optimizer over the program")
+	timeout := flag.Duration("timeout", 0, "stop the program after `duration`, zero for no limit")
+	maxInstructions := flag.Int64("maxinstructions", 0, "stop the program after `n` instructions, zero for no limit")
+	profileFile := flag.String("profile", "", "write a pprof instruction profile to `file`")
+	report := flag.Bool("report", false, "print an instruction profile report to stderr")
+	traceFile := flag.String("trace", "", "record an execution trace to `file`, as JSON lines")
+	traceBinary := flag.Bool("tracebinary", false, "record the -trace in the compact binary format")
+	replayFile := flag.String("replay", "", "run with the input recorded in the trace `file` and report where the traces diverge")
+	stdinFile := flag.String("stdin", "", "read the program's input from `file`, with -debug the program has no input otherwise")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [-debug] [-stdin file] [-noverify] [-O] [-timeout d] [-maxinstructions n] [-profile file] [-report] [-trace file [-tracebinary]] [-replay file] [-o file] program.vasm|program.vl|module\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	module, err := load(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if !*noVerify {
+		if diagnostics := vm.Verify(module); len(diagnostics) > 0 {
+			for _, d := range diagnostics {
+				if line, ok := module.Lines[d.Addr]; ok {
+					fmt.Fprintf(os.Stderr, "%s:%d: %s\n", flag.Arg(0), line, d.Msg)
+				} else {
+					fmt.Fprintf(os.Stderr, "%s: address %s\n", flag.Arg(0), d)
+				}
+			}
+			os.Exit(1)
+		}
+	}
+
+	if *optimize {
+		if module, err = vm.Optimize(module); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	// the program reads stdin unless it is debugged, when stdin has the
+	// debugger's commands
+	var stdin io.Reader = os.Stdin
+	if *debugFlag {
+		stdin = strings.NewReader("")
+	}
+	if *stdinFile != "" {
+		f, err := os.Open(*stdinFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		stdin = f
+	}
+
+	switch {
+	case *output != "":
+		err = write(module, *output)
+	case *debugFlag:
+		debug(module, os.Stdin, stdin, os.Stdout)
+	default:
+		ctx := context.Background()
+		if *timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, *timeout)
+			defer cancel()
+		}
+		opts := vm.Options{Stdin: stdin, MaxInstructions: *maxInstructions}
+		if *profileFile != "" || *report {
+			opts.Profile = vm.NewProfile()
+		}
+
+		var recorded []vm.TraceEvent
+		var replayed bytes.Buffer
+		switch {
+		case *replayFile != "":
+			if recorded, err = readTrace(*replayFile); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			opts.Trace, opts.Stdin = &replayed, vm.TraceInput(recorded)
+		case *traceFile != "":
+			f, err := os.Create(*traceFile)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			opts.Trace = f
+			if *traceBinary {
+				opts.TraceFormat = vm.TraceBinary
+			}
+		}
+
+		machine := vm.NewFromModule(module, opts)
+		machine.RegisterBuiltins()
+		err = machine.RunContext(ctx)
+		if opts.Profile != nil {
+			// a profile of a faulted program is still useful
+			if perr := writeProfile(opts.Profile, module, *profileFile, *report); perr != nil && err == nil {
+				err = perr
+			}
+		}
+		if recorded != nil {
+			err = compareTrace(recorded, &replayed, err)
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// load assembles .vasm source files, compiles .vl source files, anything
+// else is read as a module
+func load(path string) (*vm.Module, error) {
+	switch filepath.Ext(path) {
+	case ".vasm":
+		prog, err := asm.AssembleFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return prog.Module(), nil
+	case ".vl":
+		return lang.CompileFile(path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	module, err := vm.Load(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return module, nil
+}
+
+func write(module *vm.Module, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := module.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readTrace(path string) ([]vm.TraceEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	events, err := vm.ReadTrace(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return events, nil
+}
+
+// compareTrace reports where a replay diverged from the recorded trace. A
+// fault is recorded like any other instruction, so it only fails the replay
+// when the traces differ.
+func compareTrace(recorded []vm.TraceEvent, replayed io.Reader, runErr error) error {
+	events, err := vm.ReadTrace(replayed)
+	if err != nil {
+		return err
+	}
+	if d := vm.DiffTrace(recorded, events); d != nil {
+		if runErr != nil {
+			fmt.Fprintln(os.Stderr, runErr)
+		}
+		return errors.New(d.String())
+	}
+	if runErr != nil {
+		fmt.Fprintln(os.Stderr, runErr)
+	}
+	fmt.Fprintf(os.Stderr, "replay matches the %d recorded instructions\n", len(events))
+	return nil
+}
 
-	vm.New([]int{vm.HALT}, 0, 0).Run()
+// writeProfile writes the pprof file and prints the report as requested
+func writeProfile(profile *vm.Profile, module *vm.Module, path string, report bool) error {
+	if report {
+		if err := profile.WriteReport(os.Stderr, module); err != nil {
+			return err
+		}
+	}
+	if path == "" {
+		return nil
+	}
 
-	fmt.Println("Stop")
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := profile.WritePprof(f, module); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
@@ -0,0 +1,89 @@
+package vm
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+// benchmark runs code from pc b.N times on the stack machine and, as
+// translated by Translate, on the register machine
+func benchmark(b *testing.B, code []int, pc int, datasize int) {
+	m := &Module{Entry: pc, DataSize: datasize, Code: code}
+	if diagnostics := Verify(m); len(diagnostics) > 0 {
+		b.Fatal(diagnostics)
+	}
+	p, err := Translate(m)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("stack", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := New(code, pc, datasize, Options{Stdout: ioutil.Discard}).Run(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("compiled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			machine := New(code, pc, datasize, Options{Stdout: ioutil.Discard})
+			if err := machine.Compile(); err != nil {
+				b.Fatal(err)
+			}
+			if err := machine.Run(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("register", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := NewRegisterMachine(p, Options{Stdout: ioutil.Discard}).Run(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkFibonacci(b *testing.B) {
+	code := append([]int(nil), fibonacci...)
+	code[fibMain+1] = 20
+	benchmark(b, code, fibMain, 0)
+}
+
+// BenchmarkGlobalLoop counts to 100000 in global 0
+func BenchmarkGlobalLoop(b *testing.B) {
+	benchmark(b, []int{
+		CONST_I32, 0, GLOAD, CONST_I32, 100000, LT_I32, JMPF, 18, // 0 - while g0 < 100000
+		CONST_I32, 0, GLOAD, CONST_I32, 1, ADD_I32, GSTORE, 0, // 8 - g0++
+		JMP, 0, // 16
+		HALT, // 18
+	}, 0, 1)
+}
+
+// BenchmarkLocalLoop sums 0..99999 in frame locals
+func BenchmarkLocalLoop(b *testing.B) {
+	benchmark(b, []int{
+		ENTER, 2, // 0 - i, sum
+		LOAD, 0, CONST_I32, 100000, LT_I32, JMPF, 25, // 2 - while i < 100000
+		LOAD, 1, LOAD, 0, ADD_I32, STORE, 1, // 9 - sum += i
+		LOAD, 0, CONST_I32, 1, ADD_I32, STORE, 0, // 16 - i++
+		JMP, 2, // 23
+		HALT, // 25
+	}, 0, 0)
+}
+
+// BenchmarkFloatLoop accumulates floats on the stack
+func BenchmarkFloatLoop(b *testing.B) {
+	benchmark(b, []int{
+		ENTER, 1, // 0 - i
+		CONST_F64, 0, // 2 - total, left on the stack
+		LOAD, 0, CONST_I32, 100000, LT_I32, JMPF, 24, // 4 - while i < 100000
+		LOAD, 0, I2F, ADD_F64, // 11 - total += float(i)
+		LOAD, 0, CONST_I32, 1, ADD_I32, STORE, 0, // 15 - i++
+		JMP, 4, // 22
+		HALT, // 24
+	}, 0, 0)
+}
@@ -2,22 +2,214 @@ package vm
 
 // Bytecodes
 const (
-	ADD_I32   = 1  // int add
-	SUB_I32   = 2  // int sub
-	MUL_I32   = 3  // int mul
-	LT_I32    = 4  // int less than
-	EQ_I32    = 5  // int equal
-	JMP       = 6  // branch
-	JMPT      = 7  // branch if true
-	JMPF      = 8  // branch if false
-	CONST_I32 = 9  // push constant integer
-	LOAD      = 10 // load from local
-	GLOAD     = 11 // load from global
-	STORE     = 12 // store in local
-	GSTORE    = 13 // store in global memory
-	PRINT     = 14 // print value on top of the stack
-	POP       = 15 // throw away top of the stack
-	HALT      = 16 // stop program
-	CALL      = 17 // call procedure
-	RET       = 18 // return from procedure
+	ADD_I32     = 1  // int add
+	SUB_I32     = 2  // int sub
+	MUL_I32     = 3  // int mul
+	LT_I32      = 4  // int less than
+	EQ_I32      = 5  // int equal
+	JMP         = 6  // branch
+	JMPT        = 7  // branch if true
+	JMPF        = 8  // branch if false
+	CONST_I32   = 9  // push constant integer
+	LOAD        = 10 // load from local slot (arguments first, then ENTER locals)
+	GLOAD       = 11 // load from global
+	STORE       = 12 // store in local slot
+	GSTORE      = 13 // store in global memory
+	PRINT       = 14 // print value on top of the stack
+	POP         = 15 // throw away top of the stack
+	HALT        = 16 // stop program
+	CALL        = 17 // call procedure, operands are address and argument count
+	RET         = 18 // return from procedure
+	READ        = 19 // read an integer from input onto the stack
+	DIV_I32     = 20 // int divide, truncated towards zero
+	MOD_I32     = 21 // int remainder, sign follows the dividend
+	NEG_I32     = 22 // int negate
+	AND_I32     = 23 // bitwise and
+	OR_I32      = 24 // bitwise or
+	XOR_I32     = 25 // bitwise exclusive or
+	NOT_I32     = 26 // bitwise complement
+	SHL_I32     = 27 // shift left, count is taken modulo 64
+	SHR_I32     = 28 // arithmetic shift right, count is taken modulo 64
+	GT_I32      = 29 // int greater than
+	LE_I32      = 30 // int less than or equal
+	GE_I32      = 31 // int greater than or equal
+	NE_I32      = 32 // int not equal
+	DUP         = 33 // duplicate top of the stack
+	SWAP        = 34 // exchange the top two values
+	OVER        = 35 // push a copy of the value below the top
+	CONST_F64   = 36 // push constant float, operand is the IEEE 754 bits
+	CONST_BOOL  = 37 // push constant bool, operand 0 is false anything else true
+	ADD_F64     = 38 // float add
+	SUB_F64     = 39 // float sub
+	MUL_F64     = 40 // float mul
+	DIV_F64     = 41 // float divide
+	NEG_F64     = 42 // float negate
+	LT_F64      = 43 // float less than
+	GT_F64      = 44 // float greater than
+	LE_F64      = 45 // float less than or equal
+	GE_F64      = 46 // float greater than or equal
+	EQ_F64      = 47 // float equal
+	NE_F64      = 48 // float not equal
+	I2F         = 49 // convert int to float
+	F2I         = 50 // convert float to int, truncating towards zero
+	CONST_STR   = 51 // push string from the constant pool, operand is the pool index
+	NEW_ARRAY   = 52 // pop length, push a new array of int 0 elements
+	ALOAD       = 53 // pop index and array, push the element
+	ASTORE      = 54 // pop value, index and array, store the element
+	ALEN        = 55 // pop array or string, push its length
+	CONCAT      = 56 // pop two strings, push their concatenation
+	ENTER       = 57 // reserve local slots in the current frame, zero initialised
+	CALL_NATIVE = 58 // call a Go function, operands are native index and argument count
+	TRY         = 59 // install an exception handler, operand is the catch address
+	END_TRY     = 60 // remove the handler installed by the matching TRY
+	THROW       = 61 // pop a value and throw it to the innermost handler
+	SPAWN       = 62 // start a thread, operands are function address and argument count
+	YIELD       = 63 // let the other runnable threads run
+	MAKE_CHAN   = 64 // pop capacity, push a new channel
+	SEND        = 65 // pop value and channel, send the value
+	RECV        = 66 // pop channel, push the value received
+	SELECT      = 67 // receive from one of several channels, operands are count and wait
 )
+
+// The _I32 instructions operate on 64 bit int values (the name predates
+// typed values), _F64 on floats. Comparisons push a bool, which is what
+// JMPT/JMPF expect. AND/OR/XOR/NOT are bitwise on ints and logical on bools.
+// An operand of the wrong kind is a TypeError fault.
+//
+// A function call creates a frame whose local slots are the arguments, in
+// the order they were pushed, followed by the locals reserved with ENTER n
+// (normally the first instruction of the function). LOAD/STORE address
+// those slots by index. RET pops the return value, discards the frame and
+// its arguments and pushes the return value for the caller.
+//
+// Strings and arrays live on the heap, the stack holds references to them.
+// Array operands are pushed array first, then index, then (for ASTORE) the
+// value.
+//
+// Binary instructions pop their right hand operand first: to compute a - b
+// push a, then b.
+//
+// CALL_NATIVE calls a Go function registered with RegisterNative. The
+// arguments stay on the stack while it runs and are replaced by its result,
+// there is no frame.
+//
+// TRY addr installs a handler that lasts until the matching END_TRY or
+// until the function that installed it returns. THROW, and any fault that
+// is not a limit, unwinds the call frames and the stack back to where they
+// were at the TRY, pushes the thrown value (for a fault, a string
+// describing it) and continues at addr.
+//
+// SPAWN addr, argc starts a thread with its own stack, running the
+// function at addr with the top argc values as its arguments. The thread
+// ends when the function returns, the return value is discarded. Threads
+// are scheduled cooperatively, see thread.go. Channels are heap objects,
+// SEND and RECV block until the other side is ready, or while the buffer
+// of a channel made with a capacity is full or empty. SELECT n, wait pops
+// n channels and receives from the first one with a value, pushing the
+// value and the channel's index. With wait 0 it does not block, pushing
+// int 0 and index -1 when no channel is ready.
+
+// Opcode describes a bytecode for tools that read, write or check programs
+// (assembler, disassembler, verifier). Operands is the number of ints that
+// follow the opcode in the code stream, Branch is set when the first
+// operand is a code address. Pops and Pushes are the effect on the stack;
+// CALL and CALL_NATIVE additionally pop their argument count, ENTER
+// reserves slots rather than pushing values and RET pops the return value
+// and leaves the frame.
+type Opcode struct {
+	Name     string
+	Operands int
+	Branch   bool
+	Pops     int
+	Pushes   int
+}
+
+// Opcodes is indexed by bytecode value, unused slots have an empty Name.
+// Fields are Name, Operands, Branch, Pops, Pushes.
+var Opcodes = [...]Opcode{
+	ADD_I32:     {"ADD_I32", 0, false, 2, 1},
+	SUB_I32:     {"SUB_I32", 0, false, 2, 1},
+	MUL_I32:     {"MUL_I32", 0, false, 2, 1},
+	LT_I32:      {"LT_I32", 0, false, 2, 1},
+	EQ_I32:      {"EQ_I32", 0, false, 2, 1},
+	JMP:         {"JMP", 1, true, 0, 0},
+	JMPT:        {"JMPT", 1, true, 1, 0},
+	JMPF:        {"JMPF", 1, true, 1, 0},
+	CONST_I32:   {"CONST_I32", 1, false, 0, 1},
+	LOAD:        {"LOAD", 1, false, 0, 1},
+	GLOAD:       {"GLOAD", 0, false, 1, 1},
+	STORE:       {"STORE", 1, false, 1, 0},
+	GSTORE:      {"GSTORE", 1, false, 1, 0},
+	PRINT:       {"PRINT", 0, false, 1, 0},
+	POP:         {"POP", 0, false, 1, 0},
+	HALT:        {"HALT", 0, false, 0, 0},
+	CALL:        {"CALL", 2, true, 0, 1},
+	RET:         {"RET", 0, false, 1, 0},
+	READ:        {"READ", 0, false, 0, 1},
+	DIV_I32:     {"DIV_I32", 0, false, 2, 1},
+	MOD_I32:     {"MOD_I32", 0, false, 2, 1},
+	NEG_I32:     {"NEG_I32", 0, false, 1, 1},
+	AND_I32:     {"AND_I32", 0, false, 2, 1},
+	OR_I32:      {"OR_I32", 0, false, 2, 1},
+	XOR_I32:     {"XOR_I32", 0, false, 2, 1},
+	NOT_I32:     {"NOT_I32", 0, false, 1, 1},
+	SHL_I32:     {"SHL_I32", 0, false, 2, 1},
+	SHR_I32:     {"SHR_I32", 0, false, 2, 1},
+	GT_I32:      {"GT_I32", 0, false, 2, 1},
+	LE_I32:      {"LE_I32", 0, false, 2, 1},
+	GE_I32:      {"GE_I32", 0, false, 2, 1},
+	NE_I32:      {"NE_I32", 0, false, 2, 1},
+	DUP:         {"DUP", 0, false, 1, 2},
+	SWAP:        {"SWAP", 0, false, 2, 2},
+	OVER:        {"OVER", 0, false, 2, 3},
+	CONST_F64:   {"CONST_F64", 1, false, 0, 1},
+	CONST_BOOL:  {"CONST_BOOL", 1, false, 0, 1},
+	ADD_F64:     {"ADD_F64", 0, false, 2, 1},
+	SUB_F64:     {"SUB_F64", 0, false, 2, 1},
+	MUL_F64:     {"MUL_F64", 0, false, 2, 1},
+	DIV_F64:     {"DIV_F64", 0, false, 2, 1},
+	NEG_F64:     {"NEG_F64", 0, false, 1, 1},
+	LT_F64:      {"LT_F64", 0, false, 2, 1},
+	GT_F64:      {"GT_F64", 0, false, 2, 1},
+	LE_F64:      {"LE_F64", 0, false, 2, 1},
+	GE_F64:      {"GE_F64", 0, false, 2, 1},
+	EQ_F64:      {"EQ_F64", 0, false, 2, 1},
+	NE_F64:      {"NE_F64", 0, false, 2, 1},
+	I2F:         {"I2F", 0, false, 1, 1},
+	F2I:         {"F2I", 0, false, 1, 1},
+	CONST_STR:   {"CONST_STR", 1, false, 0, 1},
+	NEW_ARRAY:   {"NEW_ARRAY", 0, false, 1, 1},
+	ALOAD:       {"ALOAD", 0, false, 2, 1},
+	ASTORE:      {"ASTORE", 0, false, 3, 0},
+	ALEN:        {"ALEN", 0, false, 1, 1},
+	CONCAT:      {"CONCAT", 0, false, 2, 1},
+	ENTER:       {"ENTER", 1, false, 0, 0},
+	CALL_NATIVE: {"CALL_NATIVE", 2, false, 0, 1},
+	TRY:         {"TRY", 1, true, 0, 0},
+	END_TRY:     {"END_TRY", 0, false, 0, 0},
+	THROW:       {"THROW", 0, false, 1, 0},
+	SPAWN:       {"SPAWN", 2, true, 0, 0},
+	YIELD:       {"YIELD", 0, false, 0, 0},
+	MAKE_CHAN:   {"MAKE_CHAN", 0, false, 1, 1},
+	SEND:        {"SEND", 0, false, 2, 0},
+	RECV:        {"RECV", 0, false, 1, 1},
+	SELECT:      {"SELECT", 2, false, 0, 2},
+}
+
+// LookupOpcode returns the opcode description for a bytecode value
+func LookupOpcode(code int) (Opcode, bool) {
+	if code <= 0 || code >= len(Opcodes) || Opcodes[code].Name == "" {
+		return Opcode{}, false
+	}
+	return Opcodes[code], true
+}
+
+// OpcodeByName returns the bytecode value for a mnemonic, e.g. "CONST_I32"
+func OpcodeByName(name string) (int, bool) {
+	for code, op := range Opcodes {
+		if op.Name != "" && op.Name == name {
+			return code, true
+		}
+	}
+	return 0, false
+}
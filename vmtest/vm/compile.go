@@ -0,0 +1,371 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"math"
+)
+
+// Compilation of bytecode into Go closures. Compile binds each instruction
+// to a closure with its operands, the address of the next instruction and
+// any branch target captured, so running it skips decoding the operands
+// and the dispatch switch: the run loop calls the closure at pc, which does
+// the work and sets pc. The closures share the interpreter's state and
+// helpers, so faults, exception handlers, threads, snapshots, tracing and
+// the limits behave exactly as when interpreting.
+//
+// Instructions that mostly call into the heap allocator, natives, exception
+// handlers or the scheduler have no closure of their own, the run loop
+// hands them to the interpreter.
+
+type compiledOp func(machine *vm)
+
+// Compile verifies the program and compiles it, Run and RunContext then
+// execute the closures. Step, and so the Debugger, keeps interpreting.
+func (machine *vm) Compile() error {
+	m := &Module{Entry: machine.frames[0].fn, DataSize: len(machine.locals), Code: machine.code, Consts: machine.consts}
+	if diagnostics := Verify(m); len(diagnostics) > 0 {
+		return fmt.Errorf("compile: program does not verify, %s", diagnostics[0])
+	}
+
+	code := machine.code
+	ops := make([]compiledOp, len(code))
+	for addr := 0; addr < len(code); {
+		op, _ := LookupOpcode(code[addr])
+		next := addr + 1 + op.Operands
+		ops[addr] = compileOp(code[addr], code[addr+1:next], next)
+		addr = next
+	}
+	machine.ops = ops
+	return nil
+}
+
+// compileOp returns the closure for an instruction, nil when the
+// interpreter executes it. Each closure sets pc before doing its work, as
+// step does after reading the operands.
+func compileOp(code int, operands []int, next int) compiledOp {
+	switch code {
+	case CONST_I32, CONST_F64, CONST_BOOL:
+		value := Int(int64(operands[0]))
+		if code == CONST_F64 {
+			value = Float(math.Float64frombits(uint64(operands[0])))
+		} else if code == CONST_BOOL {
+			value = Bool(operands[0] != 0)
+		}
+		return func(machine *vm) {
+			machine.pc = next
+			machine.StackPush(value)
+		}
+	case ADD_I32:
+		return func(machine *vm) {
+			machine.pc = next
+			a, b := machine.pop2Int()
+			machine.StackPush(Int(a + b))
+		}
+	case SUB_I32:
+		return func(machine *vm) {
+			machine.pc = next
+			a, b := machine.pop2Int()
+			machine.StackPush(Int(a - b))
+		}
+	case MUL_I32:
+		return func(machine *vm) {
+			machine.pc = next
+			a, b := machine.pop2Int()
+			machine.StackPush(Int(a * b))
+		}
+	case DIV_I32:
+		return func(machine *vm) {
+			machine.pc = next
+			value, f := divInt(machine.pop2Int())
+			if f != nil {
+				machine.raise(f)
+			}
+			machine.StackPush(Int(value))
+		}
+	case MOD_I32:
+		return func(machine *vm) {
+			machine.pc = next
+			value, f := modInt(machine.pop2Int())
+			if f != nil {
+				machine.raise(f)
+			}
+			machine.StackPush(Int(value))
+		}
+	case SHL_I32:
+		return func(machine *vm) {
+			machine.pc = next
+			a, b := machine.pop2Int()
+			machine.StackPush(Int(shiftLeft(a, b)))
+		}
+	case SHR_I32:
+		return func(machine *vm) {
+			machine.pc = next
+			a, b := machine.pop2Int()
+			machine.StackPush(Int(shiftRight(a, b)))
+		}
+	case LT_I32:
+		return func(machine *vm) {
+			machine.pc = next
+			a, b := machine.pop2Int()
+			machine.StackPush(Bool(a < b))
+		}
+	case GT_I32:
+		return func(machine *vm) {
+			machine.pc = next
+			a, b := machine.pop2Int()
+			machine.StackPush(Bool(a > b))
+		}
+	case LE_I32:
+		return func(machine *vm) {
+			machine.pc = next
+			a, b := machine.pop2Int()
+			machine.StackPush(Bool(a <= b))
+		}
+	case GE_I32:
+		return func(machine *vm) {
+			machine.pc = next
+			a, b := machine.pop2Int()
+			machine.StackPush(Bool(a >= b))
+		}
+	case EQ_I32:
+		return func(machine *vm) {
+			machine.pc = next
+			a, b := machine.pop2Int()
+			machine.StackPush(Bool(a == b))
+		}
+	case NE_I32:
+		return func(machine *vm) {
+			machine.pc = next
+			a, b := machine.pop2Int()
+			machine.StackPush(Bool(a != b))
+		}
+	case NEG_I32:
+		return func(machine *vm) {
+			machine.pc = next
+			machine.StackPush(Int(-machine.popInt()))
+		}
+	case AND_I32, OR_I32, XOR_I32:
+		return func(machine *vm) {
+			machine.pc = next
+			a, b := machine.pop2()
+			value, f := logical(code, a, b)
+			if f != nil {
+				machine.raise(f)
+			}
+			machine.StackPush(value)
+		}
+	case NOT_I32:
+		return func(machine *vm) {
+			machine.pc = next
+			value, f := not(machine.StackPop())
+			if f != nil {
+				machine.raise(f)
+			}
+			machine.StackPush(value)
+		}
+	case ADD_F64:
+		return func(machine *vm) {
+			machine.pc = next
+			a, b := machine.pop2Float()
+			machine.StackPush(Float(a + b))
+		}
+	case SUB_F64:
+		return func(machine *vm) {
+			machine.pc = next
+			a, b := machine.pop2Float()
+			machine.StackPush(Float(a - b))
+		}
+	case MUL_F64:
+		return func(machine *vm) {
+			machine.pc = next
+			a, b := machine.pop2Float()
+			machine.StackPush(Float(a * b))
+		}
+	case DIV_F64:
+		return func(machine *vm) {
+			machine.pc = next
+			a, b := machine.pop2Float()
+			machine.StackPush(Float(a / b))
+		}
+	case LT_F64, GT_F64, LE_F64, GE_F64, EQ_F64, NE_F64:
+		return func(machine *vm) {
+			machine.pc = next
+			a, b := machine.pop2Float()
+			machine.StackPush(Bool(compareFloat(code, a, b)))
+		}
+	case NEG_F64:
+		return func(machine *vm) {
+			machine.pc = next
+			machine.StackPush(Float(-machine.popFloat()))
+		}
+	case I2F:
+		return func(machine *vm) {
+			machine.pc = next
+			machine.StackPush(Float(float64(machine.popInt())))
+		}
+	case F2I:
+		return func(machine *vm) {
+			machine.pc = next
+			value, f := f2i(machine.popFloat())
+			if f != nil {
+				machine.raise(f)
+			}
+			machine.StackPush(Int(value))
+		}
+	case DUP:
+		return func(machine *vm) {
+			machine.pc = next
+			a := machine.StackPop()
+			machine.StackPush(a)
+			machine.StackPush(a)
+		}
+	case SWAP:
+		return func(machine *vm) {
+			machine.pc = next
+			a, b := machine.pop2()
+			machine.StackPush(b)
+			machine.StackPush(a)
+		}
+	case OVER:
+		return func(machine *vm) {
+			machine.pc = next
+			a, b := machine.pop2()
+			machine.StackPush(a)
+			machine.StackPush(b)
+			machine.StackPush(a)
+		}
+	case POP:
+		return func(machine *vm) {
+			machine.pc = next
+			machine.StackPop()
+		}
+	case JMP:
+		target := operands[0]
+		return func(machine *vm) {
+			machine.pc = target
+		}
+	case JMPT, JMPF:
+		target, jumpIf := operands[0], code == JMPT
+		return func(machine *vm) {
+			machine.pc = next
+			if machine.popBool() == jumpIf {
+				machine.pc = target
+			}
+		}
+	case GLOAD:
+		return func(machine *vm) {
+			machine.pc = next
+			addr := int(machine.popInt())
+			machine.StackPush(machine.locals[machine.global(addr)])
+		}
+	case GSTORE:
+		addr := operands[0]
+		return func(machine *vm) {
+			machine.pc = next
+			value := machine.StackPop()
+			machine.locals[machine.global(addr)] = value
+		}
+	case LOAD:
+		slot := operands[0]
+		return func(machine *vm) {
+			machine.pc = next
+			machine.StackPush(machine.stack[machine.local(slot)])
+		}
+	case STORE:
+		slot := operands[0]
+		return func(machine *vm) {
+			machine.pc = next
+			value := machine.StackPop()
+			machine.stack[machine.local(slot)] = value
+		}
+	case ENTER:
+		n := operands[0]
+		if n < 0 {
+			return nil // the interpreter faults
+		}
+		return func(machine *vm) {
+			machine.pc = next
+			for i := 0; i < n; i++ {
+				machine.StackPush(Value{})
+			}
+			machine.frames[len(machine.frames)-1].size += n
+		}
+	case CALL:
+		addr, argc := operands[0], operands[1]
+		return func(machine *vm) {
+			machine.pc = next
+			machine.call(addr, argc)
+		}
+	case RET:
+		return func(machine *vm) {
+			machine.pc = next
+			machine.ret()
+		}
+	case ALOAD:
+		return func(machine *vm) {
+			machine.pc = next
+			index := machine.popInt()
+			array := machine.deref(machine.StackPop(), KindArray).array
+			machine.StackPush(array[machine.index(index, len(array))])
+		}
+	case ASTORE:
+		return func(machine *vm) {
+			machine.pc = next
+			value := machine.StackPop()
+			index := machine.popInt()
+			array := machine.deref(machine.StackPop(), KindArray).array
+			array[machine.index(index, len(array))] = value
+		}
+	case ALEN:
+		return func(machine *vm) {
+			machine.pc = next
+			value := machine.StackPop()
+			if value.Kind == KindString {
+				machine.StackPush(Int(int64(len(machine.deref(value, KindString).str))))
+			} else {
+				machine.StackPush(Int(int64(len(machine.deref(value, KindArray).array))))
+			}
+		}
+	case PRINT:
+		return func(machine *vm) {
+			machine.pc = next
+			fmt.Fprintln(machine.stdout, machine.Format(machine.StackPop()))
+		}
+	case HALT:
+		return func(machine *vm) {
+			machine.pc = next
+			machine.halted = true
+		}
+	}
+	return nil
+}
+
+// runCompiled is run for a compiled program, falling back to step for the
+// instructions without a closure
+func (machine *vm) runCompiled(ctx context.Context) error {
+	ops, done := machine.ops, ctx.Done()
+	for !machine.halted {
+		if done != nil && machine.executed%cancelCheckInterval == 0 {
+			if err := machine.canceled(ctx); err != nil {
+				return err
+			}
+		}
+
+		pc := machine.pc
+		if uint(pc) >= uint(len(ops)) || ops[pc] == nil {
+			machine.step()
+			continue
+		}
+		machine.ip = pc
+		machine.executed++
+		if machine.instrumented {
+			machine.instrument(machine.code[pc])
+		}
+		ops[pc](machine)
+		if machine.tracing {
+			machine.tracer.end(machine)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestCompiledTrace(t *testing.T) {
+	code := append([]int(nil), fibonacci...)
+	code[fibMain+1] = 5
+	m := &Module{Code: code, Entry: fibMain}
+
+	var interpreted, compiled bytes.Buffer
+	NewFromModule(m, Options{Stdout: ioutil.Discard, Trace: &interpreted}).Run()
+	machine := NewFromModule(m, Options{Stdout: ioutil.Discard, Trace: &compiled})
+	if err := machine.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	machine.Run()
+
+	recorded, _ := ReadTrace(&interpreted)
+	replayed, _ := ReadTrace(&compiled)
+	if d := DiffTrace(recorded, replayed); d != nil || len(recorded) == 0 {
+		t.Errorf("Expected the same trace, got %v", d)
+	}
+}
+
+func TestCompileUnverifiable(t *testing.T) {
+	machine := New([]int{ADD_I32, HALT}, 0, 0, Options{})
+	if err := machine.Compile(); err == nil || !strings.Contains(err.Error(), "does not verify") {
+		t.Errorf("Expected a verification error, got %v", err)
+	}
+	if machine.ops != nil {
+		t.Error("Expected the program to stay interpreted")
+	}
+}
+
+func TestCompiledLimits(t *testing.T) {
+	machine := New(spin, 0, 0, Options{MaxInstructions: 1000})
+	if err := machine.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	if fault, ok := machine.Run().(*Fault); !ok || fault.Kind != InstructionLimit {
+		t.Errorf("Expected the instruction limit, got %v", fault)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	machine = New(spin, 0, 0, Options{})
+	if err := machine.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.RunContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected errors.Is context.Canceled, got %v", err)
+	}
+}
+
+func TestCompiledRestore(t *testing.T) {
+	code := append([]int(nil), fibonacci...)
+	code[fibMain+1] = 10
+	machine := New(code, fibMain, 0, Options{Stdout: ioutil.Discard})
+	if err := machine.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		machine.Step()
+	}
+	snapshot, err := machine.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if machine.ops != nil {
+		t.Error("Expected Restore to discard the compiled program")
+	}
+}
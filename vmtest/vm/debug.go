@@ -0,0 +1,215 @@
+package vm
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Inspection of the machine state, used by the Debugger
+
+// PC returns the address of the next instruction to execute
+func (machine *vm) PC() int {
+	return machine.pc
+}
+
+// SP returns the stack pointer, -1 when the stack is empty
+func (machine *vm) SP() int {
+	return machine.sp
+}
+
+// FP returns the frame pointer
+func (machine *vm) FP() int {
+	return machine.fp
+}
+
+// Stack returns a copy of the stack, bottom first
+func (machine *vm) Stack() []Value {
+	stack := make([]Value, machine.sp+1)
+	copy(stack, machine.stack)
+	return stack
+}
+
+// Globals returns a copy of global memory
+func (machine *vm) Globals() []Value {
+	globals := make([]Value, len(machine.locals))
+	copy(globals, machine.locals)
+	return globals
+}
+
+// Locals returns the slots of the current frame, arguments followed by
+// the locals reserved with ENTER
+func (machine *vm) Locals() []Value {
+	size := machine.frames[len(machine.frames)-1].size
+	locals := make([]Value, size)
+	copy(locals, machine.stack[machine.fp:machine.fp+size])
+	return locals
+}
+
+// CallDepth returns the number of active CALLs
+func (machine *vm) CallDepth() int {
+	return len(machine.frames) - 1
+}
+
+// StopReason describes why the Debugger handed back control
+type StopReason int
+
+const (
+	Stepped    StopReason = iota // a single instruction was executed
+	Breakpoint                   // pc reached a breakpoint
+	Watchpoint                   // a watched value changed
+	Halted                       // the program executed HALT
+)
+
+// Stop is returned each time the Debugger stops executing
+type Stop struct {
+	Reason StopReason
+	PC     int    // address of the next instruction
+	Watch  string // watch that triggered, for Watchpoint
+	Old    Value  // value of the watch before the instruction
+	New    Value  // value of the watch after the instruction
+}
+
+func (s Stop) String() string {
+	switch s.Reason {
+	case Breakpoint:
+		return fmt.Sprintf("breakpoint at %d", s.PC)
+	case Watchpoint:
+		return fmt.Sprintf("%s changed %v -> %v, pc %d", s.Watch, s.Old, s.New, s.PC)
+	case Halted:
+		return "halted"
+	default:
+		return fmt.Sprintf("pc %d", s.PC)
+	}
+}
+
+// watch is a value that stops execution when it changes. Values that do
+// not currently exist (e.g. a local outside of a frame) read as absent.
+type watch struct {
+	name  string
+	value func() (Value, bool)
+}
+
+// Debugger drives a vm one instruction at a time, stopping at breakpoints
+// and when watched values change
+type Debugger struct {
+	machine     *vm
+	breakpoints map[int]bool
+	watches     []watch
+}
+
+func NewDebugger(machine *vm) *Debugger {
+	return &Debugger{
+		machine:     machine,
+		breakpoints: map[int]bool{},
+	}
+}
+
+// Machine returns the vm being debugged, for inspection
+func (d *Debugger) Machine() *vm {
+	return d.machine
+}
+
+// Break sets a breakpoint on an instruction address
+func (d *Debugger) Break(addr int) {
+	d.breakpoints[addr] = true
+}
+
+// Clear removes a breakpoint
+func (d *Debugger) Clear(addr int) {
+	delete(d.breakpoints, addr)
+}
+
+// Breakpoints returns the sorted addresses with a breakpoint set
+func (d *Debugger) Breakpoints() []int {
+	var addrs []int
+	for addr := range d.breakpoints {
+		addrs = append(addrs, addr)
+	}
+	sort.Ints(addrs)
+	return addrs
+}
+
+// WatchGlobal stops execution when the global at addr changes
+func (d *Debugger) WatchGlobal(addr int) {
+	d.watches = append(d.watches, watch{fmt.Sprintf("global[%d]", addr), func() (Value, bool) {
+		if addr < 0 || addr >= len(d.machine.locals) {
+			return Value{}, false
+		}
+		return d.machine.locals[addr], true
+	}})
+}
+
+// WatchLocal stops execution when slot i of Locals() changes, including
+// when a CALL or RET switches to a frame where the slot differs
+func (d *Debugger) WatchLocal(i int) {
+	d.watches = append(d.watches, watch{fmt.Sprintf("local[%d]", i), func() (Value, bool) {
+		locals := d.machine.Locals()
+		if i < 0 || i >= len(locals) {
+			return Value{}, false
+		}
+		return locals[i], true
+	}})
+}
+
+// WatchStackDepth stops execution when the number of values on the stack
+// changes
+func (d *Debugger) WatchStackDepth() {
+	d.watches = append(d.watches, watch{"stack depth", func() (Value, bool) {
+		return Int(int64(d.machine.sp + 1)), true
+	}})
+}
+
+// ClearWatches removes all watches
+func (d *Debugger) ClearWatches() {
+	d.watches = nil
+}
+
+// Step executes one instruction, reporting a watchpoint if it changed a
+// watched value
+func (d *Debugger) Step() (Stop, error) {
+	if d.machine.halted {
+		return Stop{Reason: Halted, PC: d.machine.pc}, nil
+	}
+
+	type reading struct {
+		value  Value
+		exists bool
+	}
+	before := make([]reading, len(d.watches))
+	for i, w := range d.watches {
+		before[i].value, before[i].exists = w.value()
+	}
+
+	if err := d.machine.Step(); err != nil {
+		return Stop{PC: d.machine.pc}, err
+	}
+
+	if d.machine.halted {
+		return Stop{Reason: Halted, PC: d.machine.pc}, nil
+	}
+
+	for i, w := range d.watches {
+		value, exists := w.value()
+		if value != before[i].value || exists != before[i].exists {
+			return Stop{Reason: Watchpoint, PC: d.machine.pc, Watch: w.name, Old: before[i].value, New: value}, nil
+		}
+	}
+
+	return Stop{Reason: Stepped, PC: d.machine.pc}, nil
+}
+
+// Continue executes until a breakpoint, watchpoint, HALT or fault. At least
+// one instruction is executed so continuing from a breakpoint moves on.
+func (d *Debugger) Continue() (Stop, error) {
+	for {
+		stop, err := d.Step()
+		if err != nil || stop.Reason != Stepped {
+			return stop, err
+		}
+
+		if d.breakpoints[stop.PC] {
+			stop.Reason = Breakpoint
+			return stop, nil
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package vm
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestDebuggerStep(t *testing.T) {
+	d := NewDebugger(New(fibonacci, fibMain, 0, Options{Stdout: ioutil.Discard}))
+
+	stop, err := d.Step()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stop.Reason != Stepped || stop.PC != 40 {
+		t.Errorf("Expected to step to 40, got %v", stop)
+	}
+
+	machine := d.Machine()
+	if !reflect.DeepEqual(machine.Stack(), []Value{Int(6)}) || machine.SP() != 0 {
+		t.Errorf("Expected stack [6], got %v", machine.Stack())
+	}
+
+	// CALL fib, 1 makes the argument slot 0 of the new frame
+	if _, err := d.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if machine.PC() != fib || machine.FP() != 0 || machine.CallDepth() != 1 {
+		t.Errorf("Expected pc %d, fp 0 and depth 1, got pc %d, fp %d and depth %d", fib, machine.PC(), machine.FP(), machine.CallDepth())
+	}
+	if !reflect.DeepEqual(machine.Locals(), []Value{Int(6)}) {
+		t.Errorf("Expected locals [6], got %v", machine.Locals())
+	}
+}
+
+func TestDebuggerBreakpoint(t *testing.T) {
+	d := NewDebugger(New(fibonacci, fibMain, 0, Options{Stdout: ioutil.Discard}))
+	d.Break(25) // CALL fib(N-1)
+
+	// first hit is fib(6), then fib(5), ...
+	for _, n := range []int64{6, 5, 4, 3} {
+		stop, err := d.Continue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stop.Reason != Breakpoint || stop.PC != 25 {
+			t.Fatalf("Expected breakpoint at 25, got %v", stop)
+		}
+		if locals := d.Machine().Locals(); locals[0] != Int(n) {
+			t.Errorf("Expected N=%d, got %v", n, locals)
+		}
+	}
+
+	d.Clear(25)
+	stop, err := d.Continue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stop.Reason != Halted || !d.Machine().Halted() {
+		t.Errorf("Expected program to halt, got %v", stop)
+	}
+}
+
+func TestDebuggerWatch(t *testing.T) {
+	code := []int{
+		CONST_I32, 1, GSTORE, 0, // 0
+		CONST_I32, 1, GSTORE, 0, // 4 - same value, not a change
+		CONST_I32, 2, GSTORE, 0, // 8
+		HALT,
+	}
+
+	d := NewDebugger(New(code, 0, 1, Options{}))
+	d.WatchGlobal(0)
+
+	stop, _ := d.Continue()
+	if stop.Reason != Watchpoint || stop.PC != 4 || stop.Old != Int(0) || stop.New != Int(1) {
+		t.Errorf("Expected global[0] 0 -> 1 at 4, got %v", stop)
+	}
+
+	stop, _ = d.Continue()
+	if stop.Reason != Watchpoint || stop.PC != 12 || stop.Old != Int(1) || stop.New != Int(2) {
+		t.Errorf("Expected global[0] 1 -> 2 at 12, got %v", stop)
+	}
+
+	d.ClearWatches()
+	d.WatchStackDepth()
+	d.machine = New(code, 0, 1, Options{})
+	stop, _ = d.Continue()
+	if stop.Reason != Watchpoint || stop.PC != 2 || stop.New != Int(1) {
+		t.Errorf("Expected stack depth 0 -> 1 at 2, got %v", stop)
+	}
+}
+
+func TestDebuggerFault(t *testing.T) {
+	d := NewDebugger(New([]int{POP}, 0, 0, Options{}))
+
+	_, err := d.Continue()
+	if fault, ok := err.(*Fault); !ok || fault.Kind != StackUnderflow {
+		t.Errorf("Expected stack underflow, got %v", err)
+	}
+}
@@ -0,0 +1,167 @@
+package vm
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A backend runs a module some other way than the stack machine, the
+// differential tests expect the same output, globals and fault from it.
+// Programs using the heap or exceptions are only run by backends with heap.
+type backend struct {
+	name string
+	heap bool
+	load func(m *Module, opts Options) (runner, error)
+}
+
+type runner interface {
+	Run() error
+	Globals() []Value
+}
+
+var backends = []backend{
+	{"compiled", true, func(m *Module, opts Options) (runner, error) {
+		machine := NewFromModule(m, opts)
+		machine.RegisterBuiltins()
+		return machine, machine.Compile()
+	}},
+	{"register", false, func(m *Module, opts Options) (runner, error) {
+		p, err := Translate(m)
+		if err != nil {
+			return nil, err
+		}
+		return NewRegisterMachine(p, opts), nil
+	}},
+}
+
+// sameAsStack runs a module on the stack machine and on a backend,
+// expecting the same output, globals and fault, and for a compiled
+// machine the same instruction count
+func sameAsStack(t *testing.T, b backend, name string, m *Module, input string) {
+	t.Helper()
+	var expected, out bytes.Buffer
+	machine := NewFromModule(m, Options{Stdout: &expected, Stdin: strings.NewReader(input)})
+	machine.RegisterBuiltins()
+	expectedErr := machine.Run()
+
+	r, err := b.load(m, Options{Stdout: &out, Stdin: strings.NewReader(input)})
+	if err != nil {
+		t.Fatalf("%s %s: %v", b.name, name, err)
+	}
+	err = r.Run()
+
+	if out.String() != expected.String() {
+		t.Errorf("%s %s: expected %q, got %q", b.name, name, expected.String(), out.String())
+	}
+	if !reflect.DeepEqual(r.Globals(), machine.Globals()) {
+		t.Errorf("%s %s: expected globals %v, got %v", b.name, name, machine.Globals(), r.Globals())
+	}
+	if compiled, ok := r.(*vm); ok && compiled.executed != machine.executed {
+		t.Errorf("%s %s: expected %d instructions, got %d", b.name, name, machine.executed, compiled.executed)
+	}
+	if expectedErr == nil || err == nil {
+		if expectedErr != err {
+			t.Errorf("%s %s: expected error %v, got %v", b.name, name, expectedErr, err)
+		}
+		return
+	}
+	f, expectedFault := err.(*Fault), expectedErr.(*Fault)
+	if f.Kind != expectedFault.Kind || f.PC != expectedFault.PC || f.Detail != expectedFault.Detail {
+		t.Errorf("%s %s: expected %v, got %v", b.name, name, expectedErr, err)
+	}
+}
+
+// differentialPrograms are run on every backend, those marked heap only
+// on the backends that have one
+var differentialPrograms = []struct {
+	name     string
+	code     []int
+	datasize int
+	input    string
+	heap     bool
+}{
+	{"loop", []int{
+		ENTER, 2, // 0 - i, sum
+		LOAD, 0, CONST_I32, 100, LT_I32, JMPF, 25, // 2
+		LOAD, 1, LOAD, 0, ADD_I32, STORE, 1, // 9
+		LOAD, 0, CONST_I32, 1, ADD_I32, STORE, 0, // 16
+		JMP, 2, // 23
+		LOAD, 1, PRINT, // 25 - runs off the end
+	}, 0, "", false},
+	{"globals", []int{
+		CONST_I32, 0, GLOAD, CONST_I32, 10, LT_I32, JMPF, 24, // 0
+		CONST_I32, 0, GLOAD, CONST_I32, 1, ADD_I32, GSTORE, 0, // 8
+		CONST_I32, 0, GLOAD, GSTORE, 1, // 16
+		JMP, 0, // 21
+		HALT,                                                    // 23
+		CONST_I32, 1, CONST_I32, 0, ADD_I32, GLOAD, PRINT, HALT, // 24 - computed address
+	}, 2, "", false},
+	{"stack shuffles", []int{
+		CONST_I32, 1, CONST_I32, 2, SWAP, SUB_I32, PRINT, // 2 - 1
+		CONST_I32, 3, DUP, MUL_I32, PRINT, // 9
+		CONST_I32, 4, CONST_I32, 5, OVER, SUB_I32, SUB_I32, PRINT, // 4 - (5 - 4)
+		CONST_I32, 6, CONST_I32, 7, ADD_I32, DUP, SWAP, POP, PRINT, // 13
+		HALT,
+	}, 0, "", false},
+	{"store over a loaded value", []int{
+		ENTER, 1, CONST_I32, 1, STORE, 0,
+		LOAD, 0, CONST_I32, 2, STORE, 0, // the 1 is still on the stack
+		LOAD, 0, DUP, CONST_I32, 3, STORE, 0, SWAP, // both copies of 2 stay
+		PRINT, PRINT, PRINT, LOAD, 0, PRINT, HALT,
+	}, 0, "", false},
+	{"floats and bools", []int{
+		CONST_F64, f64(1.5), CONST_I32, 2, I2F, MUL_F64, PRINT,
+		CONST_F64, f64(7.9), F2I, NEG_I32, PRINT,
+		CONST_F64, f64(2), CONST_F64, f64(3), LE_F64, PRINT,
+		CONST_BOOL, 1, CONST_BOOL, 0, XOR_I32, NOT_I32, PRINT,
+		CONST_I32, 12, CONST_I32, 10, AND_I32, CONST_I32, 2, SHL_I32, PRINT,
+		CONST_I32, -8, CONST_I32, 65, SHR_I32, CONST_I32, 7, MOD_I32, PRINT,
+		HALT,
+	}, 0, "", false},
+	{"arrays and strings", []int{
+		CONST_I32, 3, NEW_ARRAY, DUP, // 0
+		CONST_I32, 1, CONST_I32, 42, ASTORE, // 4
+		DUP, CONST_I32, 1, ALOAD, PRINT, // 9
+		ALEN, PRINT, // 14
+		CONST_STR, 0, CONST_STR, 1, CONCAT, DUP, PRINT, ALEN, PRINT, // 16
+		HALT,
+	}, 0, "", true},
+	{"read", []int{READ, READ, MUL_I32, PRINT, HALT}, 0, "6 7", false},
+	{"caught fault", []int{
+		TRY, 10, CONST_I32, 1, CONST_I32, 0, DIV_I32, END_TRY, PRINT, HALT, // 0
+		PRINT, HALT, // 10 - the fault
+	}, 0, "", true},
+	{"division by zero", []int{CONST_I32, 1, CONST_I32, 0, DIV_I32, PRINT, HALT}, 0, "", false},
+	{"modulo by zero", []int{CONST_I32, 1, CONST_I32, 0, MOD_I32, PRINT, HALT}, 0, "", false},
+	{"type error", []int{CONST_I32, 1, CONST_BOOL, 1, ADD_I32, HALT}, 0, "", false},
+	{"logical type error", []int{CONST_I32, 1, CONST_BOOL, 1, AND_I32, HALT}, 0, "", false},
+	{"branch on an int", []int{CONST_I32, 1, JMPF, 4, HALT}, 0, "", false},
+	{"bad global", []int{CONST_I32, 5, GLOAD, HALT}, 1, "", false},
+	{"bad conversion", []int{CONST_F64, f64(1e300), F2I, HALT}, 0, "", false},
+	{"index out of range", []int{CONST_I32, 2, NEW_ARRAY, CONST_I32, 2, ALOAD, HALT}, 0, "", true},
+	{"input error", []int{READ, HALT}, 0, "x", false},
+}
+
+func TestBackendFibonacci(t *testing.T) {
+	for _, b := range backends {
+		for _, n := range []int{0, 1, 2, 10, 15} {
+			code := append([]int(nil), fibonacci...)
+			code[fibMain+1] = n
+			sameAsStack(t, b, "fib", &Module{Code: code, Entry: fibMain}, "")
+		}
+	}
+}
+
+func TestBackendPrograms(t *testing.T) {
+	for _, b := range backends {
+		for _, test := range differentialPrograms {
+			if test.heap && !b.heap {
+				continue
+			}
+			m := &Module{Code: test.code, DataSize: test.datasize, Consts: []string{"ab", "cde"}}
+			sameAsStack(t, b, test.name, m, test.input)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package vm
+
+// Exceptions. TRY records a handler with the frame count and stack pointer
+// at the time, THROW unwinds back to them. Faults are raised with panic
+// and so leave an instruction half done, they are only turned into
+// exceptions once Run or Step has recovered them, see handle.
+
+type handler struct {
+	catch  int // address the handler continues at
+	frames int // number of call frames when TRY executed
+	sp     int // stack pointer when TRY executed
+}
+
+// throw unwinds to the innermost handler and continues there with value
+// on the stack
+func (machine *vm) throw(value Value) {
+	n := len(machine.handlers)
+	if n == 0 {
+		machine.fault(Uncaught, "%s", machine.Format(value))
+	}
+
+	h := machine.handlers[n-1]
+	if machine.sp < h.sp {
+		// the values the handler expects back have been popped
+		machine.fault(BadHandler, "stack popped below the TRY for %d", h.catch)
+	}
+	machine.handlers = machine.handlers[:n-1]
+	machine.frames = machine.frames[:h.frames]
+	machine.fp = machine.frames[h.frames-1].base
+	machine.sp = h.sp
+	machine.StackPush(value)
+	machine.pc = h.catch
+}
+
+// handle throws a fault returned by run or Step to the innermost handler,
+// returning nil once it is caught. Faults that are not Catchable, or with
+// no handler installed, are returned unchanged.
+func (machine *vm) handle(err error) (result error) {
+	fault, ok := err.(*Fault)
+	if !ok || !fault.Kind.Catchable() || len(machine.handlers) == 0 {
+		return err
+	}
+	defer machine.recoverFault(&result)
+
+	// the handler gets a description of the fault, allocating it may raise
+	// a HeapLimit fault of its own
+	msg := fault.Kind.String()
+	if fault.Detail != "" {
+		msg += ": " + fault.Detail
+	}
+	machine.throw(machine.NewString(msg))
+	return nil
+}
+
+// dropHandlers removes the handlers installed by frames that have returned
+func (machine *vm) dropHandlers() {
+	n := len(machine.handlers)
+	for n > 0 && machine.handlers[n-1].frames > len(machine.frames) {
+		n--
+	}
+	machine.handlers = machine.handlers[:n]
+}
@@ -0,0 +1,225 @@
+package vm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// runVerified runs a program that must verify, returning its output and
+// error
+func runVerified(t *testing.T, m *Module, opts Options) (string, error) {
+	t.Helper()
+	if diagnostics := Verify(m); len(diagnostics) > 0 {
+		t.Fatalf("Expected the program to verify, got %v", diagnostics)
+	}
+
+	var out bytes.Buffer
+	opts.Stdout = &out
+	err := NewFromModule(m, opts).Run()
+	return out.String(), err
+}
+
+func TestThrowCaught(t *testing.T) {
+	out, err := runVerified(t, &Module{Code: []int{
+		CONST_I32, 1, // 0 - below the handler, survives the throw
+		TRY, 13, // 2
+		CONST_I32, 2, CONST_I32, 42, THROW, // 4 - 2 is discarded
+		END_TRY, CONST_I32, 0, HALT, // 9 - not reached
+		PRINT, PRINT, HALT, // 13 - catch: 42 then 1
+	}}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "42\n1\n" {
+		t.Errorf("Expected 42 and 1, got %q", out)
+	}
+}
+
+func TestThrowUnwindsFrames(t *testing.T) {
+	const thrower, nested, main = 0, 4, 8
+	m := &Module{Code: []int{
+		CONST_I32, 7, THROW, RET, // 0 - thrower()
+		CALL, thrower, 0, RET, // 4 - nested()
+		TRY, 16, // 8 - main
+		CALL, nested, 0, POP, // 10 - throws from 2 frames deep
+		END_TRY, HALT, // 14
+		PRINT, HALT, // 16 - catch
+	}, Entry: main}
+	if diagnostics := Verify(m); len(diagnostics) > 0 {
+		t.Fatal(diagnostics)
+	}
+
+	var out bytes.Buffer
+	machine := NewFromModule(m, Options{Stdout: &out})
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "7\n" {
+		t.Errorf("Expected 7, got %q", out.String())
+	}
+	if machine.CallDepth() != 0 || len(machine.handlers) != 0 || machine.sp != -1 {
+		t.Errorf("Expected the frames, handler and stack to be unwound, depth %d, %d handler(s), sp %d", machine.CallDepth(), len(machine.handlers), machine.sp)
+	}
+}
+
+func TestFaultCaught(t *testing.T) {
+	tests := []struct {
+		name     string
+		fault    []int
+		expected string
+	}{
+		{"division by zero", []int{CONST_I32, 1, CONST_I32, 0, DIV_I32}, "division by zero"},
+		{"type error", []int{CONST_I32, 1, CONST_BOOL, 1, ADD_I32}, "type error"},
+		{"index", []int{CONST_I32, 2, NEW_ARRAY, CONST_I32, 5, ALOAD}, "index out of range"},
+	}
+
+	for _, test := range tests {
+		// main calls a function that faults, the handler prints the fault
+		fn := append(append([]int(nil), test.fault...), RET)
+		main := len(fn)
+		code := append(fn,
+			TRY, main+8, // main
+			CALL, 0, 0, POP, // main+2
+			END_TRY, HALT, // main+6
+			PRINT, HALT, // main+8 - catch
+		)
+
+		out, err := runVerified(t, &Module{Code: code, Entry: main}, Options{})
+		if err != nil {
+			t.Errorf("%s: expected the fault to be caught, got %v", test.name, err)
+			continue
+		}
+		if !strings.HasPrefix(out, test.expected) {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, out)
+		}
+	}
+}
+
+func TestThrowUncaught(t *testing.T) {
+	err := New([]int{CONST_I32, 3, THROW}, 0, 0, Options{}).Run()
+	if fault, ok := err.(*Fault); !ok || fault.Kind != Uncaught || fault.Detail != "3" {
+		t.Errorf("Expected an uncaught exception of 3, got %v", err)
+	}
+
+	// the handler installed by a function ends when it returns
+	err = New([]int{
+		TRY, 4, CONST_I32, 0, RET, // 0 - no END_TRY
+		CALL, 0, 0, THROW, // 5
+	}, 5, 0, Options{}).Run()
+	if fault, ok := err.(*Fault); !ok || fault.Kind != Uncaught {
+		t.Errorf("Expected an uncaught exception after RET, got %v", err)
+	}
+
+	err = New([]int{END_TRY, HALT}, 0, 0, Options{}).Run()
+	if fault, ok := err.(*Fault); !ok || fault.Kind != BadHandler {
+		t.Errorf("Expected a bad handler fault, got %v", err)
+	}
+}
+
+func TestLimitsNotCaught(t *testing.T) {
+	code := []int{TRY, 4, JMP, 2, PRINT, HALT}
+	err := New(code, 0, 0, Options{MaxInstructions: 100}).Run()
+	if fault, ok := err.(*Fault); !ok || fault.Kind != InstructionLimit {
+		t.Errorf("Expected the instruction limit to stop the program, got %v", err)
+	}
+}
+
+func TestStepCatches(t *testing.T) {
+	var out bytes.Buffer
+	machine := New([]int{TRY, 7, CONST_I32, 1, CONST_I32, 0, DIV_I32, PRINT, HALT}, 0, 0, Options{Stdout: &out})
+
+	for !machine.Halted() {
+		if err := machine.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !strings.HasPrefix(out.String(), "division by zero") {
+		t.Errorf("Expected the fault to be printed, got %q", out.String())
+	}
+}
+
+func TestCatchBelowTry(t *testing.T) {
+	// DIV_I32 consumes the 1 pushed before the TRY, so the handler could
+	// not get the stack it expects back: Verify rejects the program and
+	// unverified it faults rather than being caught
+	m := &Module{Code: []int{
+		CONST_I32, 1, // 0
+		TRY, 11, // 2
+		CONST_I32, 0, DIV_I32, // 4
+		END_TRY, PRINT, HALT, HALT, // 7
+		PRINT, POP, HALT, // 11 - catch
+	}}
+	if diagnostics := Verify(m); len(diagnostics) == 0 {
+		t.Error("Expected Verify to reject popping below the TRY")
+	}
+	if fault, ok := NewFromModule(m, Options{}).Run().(*Fault); !ok || fault.Kind != BadHandler {
+		t.Errorf("Expected a bad handler fault, got %v", fault)
+	}
+
+	// with the dividend pushed inside the TRY it is caught
+	var out bytes.Buffer
+	m = &Module{Code: []int{
+		CONST_I32, 1, // 0
+		TRY, 13, // 2
+		CONST_I32, 1, CONST_I32, 0, DIV_I32, // 4
+		END_TRY, PRINT, HALT, HALT, // 9
+		PRINT, PRINT, HALT, // 13 - catch
+	}}
+	if diagnostics := Verify(m); len(diagnostics) > 0 {
+		t.Fatalf("Expected the program to verify, got %v", diagnostics)
+	}
+	if err := NewFromModule(m, Options{Stdout: &out}).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "division by zero: 1 / 0\n1\n" {
+		t.Errorf("Expected the fault to be caught, got %q", out.String())
+	}
+}
+
+func TestSnapshotHandlers(t *testing.T) {
+	code := []int{
+		TRY, 9, // 0
+		CONST_I32, 5, CONST_I32, 0, DIV_I32, // 2
+		END_TRY, HALT, // 7
+		PRINT, HALT, // 9
+	}
+	machine := New(code, 0, 0, Options{})
+	for i := 0; i < 3; i++ {
+		if err := machine.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshot, err := machine.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	restored := New(nil, 0, 0, Options{Stdout: &out})
+	if err := restored.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "division by zero") {
+		t.Errorf("Expected the restored handler to catch the fault, got %q", out.String())
+	}
+}
+
+func TestOptimizeExceptions(t *testing.T) {
+	code := []int{
+		TRY, 11, // 0
+		CONST_I32, 1, CONST_I32, 0, DIV_I32, // 2 - not folded, it faults
+		PRINT, END_TRY, // 7
+		HALT,    // 9
+		HALT,    // 10 - unreachable
+		JMP, 13, // 11 - catch, threaded
+		PRINT, HALT, // 13
+	}
+	optimized := optimize(t, &Module{Code: code})
+	if optimized.Code[1] != len(optimized.Code)-2 {
+		t.Errorf("Expected TRY to go straight to the PRINT, got %v", optimized.Code)
+	}
+}
@@ -0,0 +1,135 @@
+package vm
+
+import (
+	"fmt"
+)
+
+// FaultKind classifies why a program stopped abnormally
+type FaultKind int
+
+const (
+	StackOverflow    FaultKind = iota + 1 // push beyond STACK_SIZE
+	StackUnderflow                        // pop from an empty stack
+	BadOpcode                             // unknown bytecode
+	BadAddress                            // code, global or local address out of range
+	DivisionByZero                        // integer division or modulo by zero
+	InputError                            // READ could not get an integer
+	TypeError                             // operand of the wrong Kind
+	BadConversion                         // F2I of NaN or a float out of int range
+	IndexOutOfRange                       // array or string index outside its length
+	InstructionLimit                      // Options.MaxInstructions executed
+	StackLimit                            // push beyond Options.MaxStackDepth
+	HeapLimit                             // live heap would exceed Options.MaxHeapBytes
+	Canceled                              // the context passed to RunContext is done
+	BadNative                             // CALL_NATIVE of an unregistered native or with the wrong argument count
+	NativeError                           // a native function returned an error
+	Uncaught                              // THROW without an exception handler
+	BadHandler                            // END_TRY without a matching TRY in the current frame, or its stack popped
+	Deadlock                              // every thread is blocked on a channel
+)
+
+var faultNames = map[FaultKind]string{
+	StackOverflow:    "stack overflow",
+	StackUnderflow:   "stack underflow",
+	BadOpcode:        "bad opcode",
+	BadAddress:       "bad address",
+	DivisionByZero:   "division by zero",
+	InputError:       "input error",
+	TypeError:        "type error",
+	BadConversion:    "bad conversion",
+	IndexOutOfRange:  "index out of range",
+	InstructionLimit: "instruction limit",
+	StackLimit:       "stack limit",
+	HeapLimit:        "heap limit",
+	Canceled:         "canceled",
+	BadNative:        "bad native call",
+	NativeError:      "native error",
+	Uncaught:         "uncaught exception",
+	BadHandler:       "bad exception handler",
+	Deadlock:         "deadlock",
+}
+
+// Catchable reports whether TRY handlers catch the fault. The limits set
+// through Options, cancellation and deadlocks always stop the program.
+func (k FaultKind) Catchable() bool {
+	switch k {
+	case InstructionLimit, StackLimit, HeapLimit, Canceled, Deadlock:
+		return false
+	}
+	return true
+}
+
+func (k FaultKind) String() string {
+	if name, ok := faultNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("fault(%d)", int(k))
+}
+
+// Fault is returned by Run when the program can not continue
+type Fault struct {
+	Kind   FaultKind
+	PC     int     // address of the faulting instruction
+	Detail string  // extra context, e.g. the offending opcode or address
+	Stack  []Value // snapshot of the stack, bottom first
+	Err    error   // underlying cause, the context error for Canceled or a native's error
+}
+
+func (f *Fault) Error() string {
+	msg := fmt.Sprintf("%s at pc %d", f.Kind, f.PC)
+	if f.Detail != "" {
+		msg += ": " + f.Detail
+	}
+	return msg
+}
+
+// Unwrap returns the underlying cause, so errors.Is(err,
+// context.DeadlineExceeded) holds for a timed out RunContext
+func (f *Fault) Unwrap() error {
+	return f.Err
+}
+
+// fault aborts the current instruction. The panic is recovered by Run and
+// turned into a returned *Fault, which keeps the opcode implementations
+// free of error plumbing.
+func (machine *vm) fault(kind FaultKind, format string, args ...interface{}) {
+	panic(machine.newFault(kind, nil, format, args...))
+}
+
+// newFault describes a fault at the current instruction
+func (machine *vm) newFault(kind FaultKind, cause error, format string, args ...interface{}) *Fault {
+	stack := make([]Value, machine.sp+1)
+	copy(stack, machine.stack)
+
+	return &Fault{
+		Kind:   kind,
+		PC:     machine.ip,
+		Detail: fmt.Sprintf(format, args...),
+		Stack:  stack,
+		Err:    cause,
+	}
+}
+
+// trap is raised with panic by the inlined stack accessors, which can not
+// afford a call to fault. recoverFault turns it into the same *Fault.
+type trap int
+
+const (
+	trapOverflow trap = iota + 1
+	trapUnderflow
+	trapLocal // LOAD or STORE slot outside the frame
+)
+
+func (machine *vm) trapFault(t trap) *Fault {
+	switch t {
+	case trapOverflow:
+		return machine.newFault(machine.stackFault, nil, "stack size %d", len(machine.stack))
+	case trapLocal:
+		slot := HALT // what operand reads past the end of the code
+		if machine.ip+1 < len(machine.code) {
+			slot = machine.code[machine.ip+1]
+		}
+		return machine.newFault(BadAddress, nil, "local slot %d, frame has %d", slot, machine.frames[len(machine.frames)-1].size)
+	}
+	return machine.newFault(StackUnderflow, nil, "")
+}
@@ -0,0 +1,93 @@
+package vm
+
+import (
+	"testing"
+)
+
+func TestArgumentsByIndex(t *testing.T) {
+	code := []int{
+		// int sub(a, b) { return a - b }
+		LOAD, 0, LOAD, 1, SUB_I32, RET, // 0
+		// main
+		CONST_I32, 10, CONST_I32, 3, CALL, 0, 2, PRINT, HALT, // 6
+	}
+
+	if out := run(t, code, 6, 0); out != "7\n" {
+		t.Errorf("Expected 7, got %q", out)
+	}
+}
+
+func TestRecursionWithLocals(t *testing.T) {
+	code := []int{
+		// int fib(n) {
+		//     int a, b
+		ENTER, 2, // 0
+		//     if (n < 3) return 1
+		LOAD, 0, CONST_I32, 3, LT_I32, JMPF, 12, // 2
+		CONST_I32, 1, RET, // 9
+		//     a = fib(n-1)
+		LOAD, 0, CONST_I32, 1, SUB_I32, CALL, 0, 1, STORE, 1, // 12
+		//     b = fib(n-2)
+		LOAD, 0, CONST_I32, 2, SUB_I32, CALL, 0, 1, STORE, 2, // 22
+		//     return a + b
+		LOAD, 1, LOAD, 2, ADD_I32, RET, // 32
+		// }
+		CONST_I32, 20, CALL, 0, 1, PRINT, HALT, // 38
+	}
+
+	if out := run(t, code, 38, 0); out != "6765\n" {
+		t.Errorf("Expected 6765, got %q", out)
+	}
+}
+
+func TestTopLevelLocals(t *testing.T) {
+	code := []int{
+		ENTER, 1, // int i
+		LOAD, 0, CONST_I32, 1, ADD_I32, STORE, 0, // 2 - i++
+		LOAD, 0, CONST_I32, 5, LT_I32, JMPT, 2, // 9 - while i < 5
+		LOAD, 0, PRINT, HALT, // 16
+	}
+
+	if out := run(t, code, 0, 0); out != "5\n" {
+		t.Errorf("Expected 5, got %q", out)
+	}
+}
+
+func TestRetDiscardsFrame(t *testing.T) {
+	machine := New([]int{
+		ENTER, 1, LOAD, 0, CONST_I32, 7, RET, // 0 - leaves extra values on the stack
+		CONST_I32, 1, CONST_I32, 2, CALL, 0, 1, HALT, // 7
+	}, 7, 0, Options{})
+
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if stack := machine.Stack(); len(stack) != 2 || stack[0] != Int(1) || stack[1] != Int(7) {
+		t.Errorf("Expected stack [1 7], got %v", stack)
+	}
+	if machine.CallDepth() != 0 {
+		t.Errorf("Expected to be back at the top level, depth %d", machine.CallDepth())
+	}
+}
+
+func TestFrameFaults(t *testing.T) {
+	tests := []struct {
+		name string
+		code []int
+		kind FaultKind
+	}{
+		{"load past frame", []int{CONST_I32, 1, CALL, 5, 1, LOAD, 1}, BadAddress},
+		{"store negative", []int{ENTER, 1, CONST_I32, 1, STORE, -1}, BadAddress},
+		{"load of caller value", []int{CONST_I32, 1, CALL, 5, 0, LOAD, 0}, BadAddress},
+		{"too few arguments", []int{CONST_I32, 1, CALL, 0, 2}, StackUnderflow},
+		{"ret at top level", []int{CONST_I32, 1, RET}, StackUnderflow},
+		{"infinite recursion", []int{CALL, 0, 0}, StackOverflow},
+	}
+
+	for _, test := range tests {
+		err := New(test.code, 0, 0, Options{}).Run()
+		if fault, ok := err.(*Fault); !ok || fault.Kind != test.kind {
+			t.Errorf("%s: expected %s, got %v", test.name, test.kind, err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package vm
+
+import (
+	"time"
+)
+
+// Mark and sweep garbage collector for the heap. Roots are the values on
+// the stack of every thread, which include the arguments of every call
+// frame, and global memory. A collection runs before an allocation once
+// the heap has grown past the threshold, after which the threshold is
+// raised to twice the live size so collections stay proportional to
+// allocation.
+
+// DefaultGCThreshold is the heap size that triggers the first collection
+const DefaultGCThreshold = 1 << 20
+
+// Stats reports heap and garbage collector counters
+type Stats struct {
+	HeapObjects  int           // live objects plus garbage not yet collected
+	HeapBytes    int           // accounted size of HeapObjects
+	Collections  int           // number of collections run
+	ObjectsFreed int           // total objects reclaimed
+	BytesFreed   int           // total bytes reclaimed
+	PauseTotal   time.Duration // time spent collecting
+	LastPause    time.Duration // duration of the most recent collection
+}
+
+// Stats returns the current heap and collector counters
+func (machine *vm) Stats() Stats {
+	stats := machine.gcStats
+	stats.HeapObjects = len(machine.heap) - len(machine.free)
+	stats.HeapBytes = machine.heapBytes
+	return stats
+}
+
+// GC runs a collection immediately
+func (machine *vm) GC() {
+	start := time.Now()
+
+	machine.mark()
+	objects, bytes := machine.sweep()
+
+	live := machine.heapBytes
+	machine.nextGC = 2 * live
+	if machine.nextGC < machine.gcThreshold {
+		machine.nextGC = machine.gcThreshold
+	}
+
+	pause := time.Since(start)
+	machine.gcStats.Collections++
+	machine.gcStats.ObjectsFreed += objects
+	machine.gcStats.BytesFreed += bytes
+	machine.gcStats.PauseTotal += pause
+	machine.gcStats.LastPause = pause
+}
+
+// maybeGC collects when an allocation of size bytes would take the heap
+// past the threshold
+func (machine *vm) maybeGC(size int) {
+	if machine.heapBytes+size > machine.nextGC {
+		machine.GC()
+	}
+}
+
+// mark flags every object reachable from the roots
+func (machine *vm) mark() {
+	var pending []Value
+	pending = append(pending, machine.stack[:machine.sp+1]...)
+	pending = append(pending, machine.locals...)
+	for _, t := range machine.threads {
+		if t != machine.current {
+			pending = append(pending, t.stack[:t.sp+1]...)
+		}
+	}
+
+	for len(pending) > 0 {
+		value := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		if value.Kind != KindString && value.Kind != KindArray && value.Kind != KindChan {
+			continue
+		}
+		if value.bits >= uint64(len(machine.heap)) {
+			continue
+		}
+
+		obj := machine.heap[value.bits]
+		if obj == nil || obj.marked {
+			continue
+		}
+		obj.marked = true
+		pending = append(pending, obj.array...)
+		if obj.ch != nil {
+			pending = append(pending, obj.ch.buffer...)
+		}
+	}
+}
+
+// sweep frees unmarked objects, putting their slots on the free list, and
+// clears the mark on the rest
+func (machine *vm) sweep() (objects int, bytes int) {
+	for i, obj := range machine.heap {
+		if obj == nil {
+			continue
+		}
+		if obj.marked {
+			obj.marked = false
+			continue
+		}
+
+		size := obj.size()
+		machine.heap[i] = nil
+		machine.free = append(machine.free, i)
+		machine.heapBytes -= size
+		objects++
+		bytes += size
+	}
+	return objects, bytes
+}
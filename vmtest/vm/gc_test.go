@@ -0,0 +1,84 @@
+package vm
+
+import (
+	"bytes"
+	"testing"
+)
+
+// allocLoop allocates a 10 element array n times, keeping only the last
+// one in global 1. Global 0 is the loop counter.
+func allocLoop(n int) []int {
+	return []int{
+		CONST_I32, 0, GSTORE, 0, // 0 - i = 0
+		CONST_I32, 0, GLOAD, CONST_I32, n, LT_I32, JMPF, 30, // 4 - while i < n
+		CONST_I32, 10, NEW_ARRAY, GSTORE, 1, // 12 - keep = new array
+		CONST_STR, 0, POP, // 17 - garbage string
+		CONST_I32, 0, GLOAD, CONST_I32, 1, ADD_I32, GSTORE, 0, // 20 - i++
+		JMP, 4, // 28
+		CONST_I32, 1, GLOAD, ALEN, PRINT, // 30 - print len(keep)
+		HALT,
+	}
+}
+
+func TestGCStress(t *testing.T) {
+	var out bytes.Buffer
+	m := &Module{Code: allocLoop(10000), DataSize: 2, Consts: []string{"garbage"}}
+	machine := NewFromModule(m, Options{Stdout: &out, GCThreshold: 4096})
+
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "10\n" {
+		t.Errorf("Expected 10, got %q", out.String())
+	}
+
+	stats := machine.Stats()
+	if stats.Collections == 0 {
+		t.Fatal("Expected at least one collection")
+	}
+	if stats.ObjectsFreed < 19000 {
+		t.Errorf("Expected most of the 20000 objects to be freed, got %+v", stats)
+	}
+	if stats.HeapBytes > 2*4096 || len(machine.heap) > 1000 {
+		t.Errorf("Expected heap to stay near the threshold, got %+v with %d slots", stats, len(machine.heap))
+	}
+	if stats.PauseTotal <= 0 || stats.BytesFreed <= 0 {
+		t.Errorf("Expected pause time and bytes freed to be recorded, got %+v", stats)
+	}
+}
+
+func TestGCKeepsReachable(t *testing.T) {
+	machine := New(nil, 0, 1, Options{})
+
+	// global 0 -> array -> [string, array -> [string]]
+	outer := machine.NewArray(2)
+	inner := machine.NewArray(1)
+	machine.heap[outer.bits].array[0] = machine.NewString("a")
+	machine.heap[outer.bits].array[1] = inner
+	machine.heap[inner.bits].array[0] = machine.NewString("b")
+	machine.locals[0] = outer
+
+	// on the stack
+	machine.StackPush(machine.NewString("c"))
+
+	// unreachable, including a cycle
+	cycle := machine.NewArray(1)
+	machine.heap[cycle.bits].array[0] = cycle
+	machine.NewString("d")
+
+	machine.GC()
+
+	stats := machine.Stats()
+	if stats.HeapObjects != 5 || stats.ObjectsFreed != 2 {
+		t.Errorf("Expected 5 live and 2 freed objects, got %+v", stats)
+	}
+	if s := machine.Format(machine.locals[0]); s != `["a" ["b"]]` {
+		t.Errorf("Expected reachable objects intact, got %s", s)
+	}
+
+	// freed slots are reused
+	machine.NewString("e")
+	if len(machine.heap) != 7 {
+		t.Errorf("Expected a freed slot to be reused, heap has %d slots", len(machine.heap))
+	}
+}
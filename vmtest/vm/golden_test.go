@@ -0,0 +1,143 @@
+package vm_test
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sscaling/goplayground/vmtest/asm"
+	"github.com/sscaling/goplayground/vmtest/lang"
+	"github.com/sscaling/goplayground/vmtest/vm"
+)
+
+// Golden file tests. Every program in testdata, assembly (.vasm) or source
+// (.vl), is run with the input in its .in file, if there is one. What it
+// prints must match its .out file and, when it faults, the error must match
+// its .fault file. A program without a .fault file must not fault. Each
+// program is run again compiled, see Compile, against the same files. Run
+//
+//	go test ./vm -run Golden -update
+//
+// to rewrite the golden files from the current behaviour.
+
+var update = flag.Bool("update", false, "rewrite the golden .out and .fault files")
+
+// goldenLimit stops programs that would otherwise run forever
+const goldenLimit = 10000000
+
+func TestGolden(t *testing.T) {
+	var programs []string
+	for _, pattern := range []string{"*.vasm", "*.vl"} {
+		matches, err := filepath.Glob(filepath.Join("testdata", pattern))
+		if err != nil {
+			t.Fatal(err)
+		}
+		programs = append(programs, matches...)
+	}
+	if len(programs) == 0 {
+		t.Fatal("No programs in testdata")
+	}
+
+	for _, path := range programs {
+		path := path
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			golden(t, path, false)
+			if !*update {
+				t.Run("compiled", func(t *testing.T) {
+					golden(t, path, true)
+				})
+			}
+		})
+	}
+}
+
+func golden(t *testing.T, path string, compile bool) {
+	module, err := load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diagnostics := vm.Verify(module); len(diagnostics) > 0 {
+		t.Fatalf("Expected the program to verify, got %v", diagnostics)
+	}
+
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	input, err := ioutil.ReadFile(base + ".in")
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	machine := vm.NewFromModule(module, vm.Options{
+		Stdout:          &out,
+		Stdin:           bytes.NewReader(input),
+		MaxInstructions: goldenLimit,
+	})
+	machine.RegisterBuiltins()
+	if compile {
+		if err := machine.Compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runErr := machine.Run()
+
+	if *update {
+		writeGolden(t, base+".out", out.String(), true)
+		fault := ""
+		if runErr != nil {
+			fault = runErr.Error() + "\n"
+		}
+		writeGolden(t, base+".fault", fault, runErr != nil)
+		return
+	}
+
+	expected, err := ioutil.ReadFile(base + ".out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != string(expected) {
+		t.Errorf("Expected output\n%s\ngot\n%s", expected, out.String())
+	}
+
+	expectedFault, err := ioutil.ReadFile(base + ".fault")
+	switch {
+	case os.IsNotExist(err):
+		if runErr != nil {
+			t.Errorf("Expected the program to succeed, got %v", runErr)
+		}
+	case err != nil:
+		t.Fatal(err)
+	case runErr == nil:
+		t.Errorf("Expected the program to fail with %s", strings.TrimSpace(string(expectedFault)))
+	case runErr.Error() != strings.TrimSpace(string(expectedFault)):
+		t.Errorf("Expected the program to fail with %s, got %v", strings.TrimSpace(string(expectedFault)), runErr)
+	}
+}
+
+// load assembles or compiles a program by its extension
+func load(path string) (*vm.Module, error) {
+	if filepath.Ext(path) == ".vl" {
+		return lang.CompileFile(path)
+	}
+	prog, err := asm.AssembleFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return prog.Module(), nil
+}
+
+// writeGolden writes a golden file, or removes it when it should not exist
+func writeGolden(t *testing.T, path, contents string, keep bool) {
+	if !keep {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		return
+	}
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,152 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Heap objects are referenced from Values of kind KindString or KindArray,
+// the Value payload is the index of the object in machine.heap. References
+// compare equal only when they point at the same object.
+
+// objectHeader is the accounted size of an object besides its contents
+const objectHeader = 16
+
+// valueSize is the accounted size of one array element
+const valueSize = 16
+
+type object struct {
+	kind   Kind     // KindString, KindArray or KindChan
+	str    string   // contents of a string
+	array  []Value  // elements of an array
+	ch     *channel // state of a channel
+	marked bool     // reachable, set during garbage collection
+}
+
+// size is an estimate of the memory used by the object, used for heap
+// accounting
+func (obj *object) size() int {
+	size := objectHeader + len(obj.str) + valueSize*len(obj.array)
+	if obj.ch != nil {
+		size += valueSize * obj.ch.capacity
+	}
+	return size
+}
+
+// alloc puts an object on the heap and returns a reference to it, reusing
+// a slot freed by the garbage collector when there is one. The object must
+// not yet be referenced from the stack or globals when a collection may
+// run, so callers pop operands into Go values before allocating.
+func (machine *vm) alloc(obj *object) Value {
+	size := obj.size()
+	machine.maybeGC(size)
+	machine.reserve(size, "allocating")
+	machine.heapBytes += size
+
+	if n := len(machine.free); n > 0 {
+		slot := machine.free[n-1]
+		machine.free = machine.free[:n-1]
+		machine.heap[slot] = obj
+		return Value{obj.kind, uint64(slot)}
+	}
+
+	machine.heap = append(machine.heap, obj)
+	return Value{obj.kind, uint64(len(machine.heap) - 1)}
+}
+
+// NewString allocates a string on the heap
+func (machine *vm) NewString(s string) Value {
+	return machine.alloc(&object{kind: KindString, str: s})
+}
+
+// NewArray allocates an array of n zero (int 0) elements on the heap
+func (machine *vm) NewArray(n int) Value {
+	return machine.alloc(&object{kind: KindArray, array: make([]Value, n)})
+}
+
+// deref returns the heap object a reference points at, faulting unless the
+// value is a reference of the expected kind
+func (machine *vm) deref(value Value, kind Kind) *object {
+	if value.Kind != kind {
+		machine.fault(TypeError, "expected %s, got %s %v", kind, value.Kind, value)
+	}
+	if value.bits >= uint64(len(machine.heap)) || machine.heap[value.bits] == nil {
+		machine.fault(BadAddress, "dangling %s reference %d", kind, value.bits)
+	}
+	return machine.heap[value.bits]
+}
+
+// reserve faults when size more bytes would take the heap and the threads
+// past Options.MaxHeapBytes, collecting first so that only live objects
+// count
+func (machine *vm) reserve(size int, what string) {
+	if machine.maxHeapBytes > 0 && machine.heapBytes+machine.threadBytes+size > machine.maxHeapBytes {
+		machine.GC()
+		if live := machine.heapBytes + machine.threadBytes; live+size > machine.maxHeapBytes {
+			machine.fault(HeapLimit, "%s %d bytes with %d live, limit %d", what, size, live, machine.maxHeapBytes)
+		}
+	}
+}
+
+// index checks an array or string index against its length
+func (machine *vm) index(i int64, length int) int {
+	if i < 0 || i >= int64(length) {
+		machine.fault(IndexOutOfRange, "index %d, length %d", i, length)
+	}
+	return int(i)
+}
+
+// Str returns the contents of a string reference
+func (machine *vm) Str(value Value) (string, bool) {
+	if value.Kind != KindString || value.bits >= uint64(len(machine.heap)) || machine.heap[value.bits] == nil {
+		return "", false
+	}
+	return machine.heap[value.bits].str, true
+}
+
+// Format renders a value including the contents of heap objects, as PRINT
+// does
+func (machine *vm) Format(value Value) string {
+	var out bytes.Buffer
+	machine.format(&out, value, 0)
+	return out.String()
+}
+
+// maxFormatDepth stops formatting of arrays that contain themselves
+const maxFormatDepth = 8
+
+func (machine *vm) format(out *bytes.Buffer, value Value, depth int) {
+	if value.Kind != KindString && value.Kind != KindArray {
+		out.WriteString(value.String())
+		return
+	}
+
+	if value.bits >= uint64(len(machine.heap)) || machine.heap[value.bits] == nil {
+		fmt.Fprintf(out, "<dangling %s>", value)
+		return
+	}
+
+	obj := machine.heap[value.bits]
+	if obj.kind == KindString {
+		out.WriteString(obj.str)
+		return
+	}
+
+	if depth >= maxFormatDepth {
+		out.WriteString("[...]")
+		return
+	}
+
+	out.WriteByte('[')
+	for i, element := range obj.array {
+		if i > 0 {
+			out.WriteByte(' ')
+		}
+		if str, ok := machine.Str(element); ok {
+			fmt.Fprintf(out, "%q", str)
+		} else {
+			machine.format(out, element, depth+1)
+		}
+	}
+	out.WriteByte(']')
+}
@@ -0,0 +1,73 @@
+package vm
+
+import (
+	"bytes"
+	"testing"
+)
+
+// runModule executes code with a constant pool and returns its output
+func runModule(t *testing.T, code []int, consts ...string) string {
+	var out bytes.Buffer
+	m := &Module{Code: code, Consts: consts}
+	if err := NewFromModule(m, Options{Stdout: &out}).Run(); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestStrings(t *testing.T) {
+	code := []int{
+		CONST_STR, 0, CONST_STR, 1, CONCAT, // "hello, " + "world"
+		DUP, PRINT,
+		ALEN, PRINT,
+		HALT,
+	}
+
+	if out := runModule(t, code, "hello, ", "world"); out != "hello, world\n12\n" {
+		t.Errorf("Expected hello, world and 12, got %q", out)
+	}
+}
+
+func TestArrays(t *testing.T) {
+	code := []int{
+		CONST_I32, 3, NEW_ARRAY, GSTORE, 0, // a = [0 0 0]
+		CONST_I32, 0, GLOAD, CONST_I32, 1, CONST_I32, 42, ASTORE, // a[1] = 42
+		CONST_I32, 0, GLOAD, CONST_I32, 2, CONST_STR, 0, ASTORE, // a[2] = "x"
+		CONST_I32, 0, GLOAD, CONST_I32, 1, ALOAD, PRINT, // print a[1]
+		CONST_I32, 0, GLOAD, ALEN, PRINT, // print len(a)
+		CONST_I32, 0, GLOAD, PRINT, // print a
+		HALT,
+	}
+
+	var out bytes.Buffer
+	m := &Module{Code: code, DataSize: 1, Consts: []string{"x"}}
+	if err := NewFromModule(m, Options{Stdout: &out}).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "42\n3\n[0 42 \"x\"]\n" {
+		t.Errorf("Expected 42, 3 and [0 42 \"x\"], got %q", out.String())
+	}
+}
+
+func TestHeapFaults(t *testing.T) {
+	tests := []struct {
+		name string
+		code []int
+		kind FaultKind
+	}{
+		{"aload past end", []int{CONST_I32, 2, NEW_ARRAY, CONST_I32, 2, ALOAD}, IndexOutOfRange},
+		{"astore negative", []int{CONST_I32, 2, NEW_ARRAY, CONST_I32, -1, CONST_I32, 0, ASTORE}, IndexOutOfRange},
+		{"negative length", []int{CONST_I32, -1, NEW_ARRAY}, IndexOutOfRange},
+		{"aload of string", []int{CONST_STR, 0, CONST_I32, 0, ALOAD}, TypeError},
+		{"aload of int", []int{CONST_I32, 0, CONST_I32, 0, ALOAD}, TypeError},
+		{"concat of int", []int{CONST_STR, 0, CONST_I32, 0, CONCAT}, TypeError},
+		{"missing constant", []int{CONST_STR, 1}, BadAddress},
+	}
+
+	for _, test := range tests {
+		err := NewFromModule(&Module{Code: test.code, Consts: []string{"s"}}, Options{}).Run()
+		if fault, ok := err.(*Fault); !ok || fault.Kind != test.kind {
+			t.Errorf("%s: expected %s, got %v", test.name, test.kind, err)
+		}
+	}
+}
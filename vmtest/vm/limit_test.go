@@ -0,0 +1,105 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// spin never halts
+var spin = []int{JMP, 0}
+
+func TestLimits(t *testing.T) {
+	// every array stays reachable from the stack
+	hoard := []int{CONST_I32, 10, NEW_ARRAY, JMP, 0}
+
+	tests := []struct {
+		name string
+		code []int
+		opts Options
+		kind FaultKind
+	}{
+		{"instructions", spin, Options{MaxInstructions: 1000}, InstructionLimit},
+		{"stack", []int{CONST_I32, 1, JMP, 0}, Options{MaxStackDepth: 10}, StackLimit},
+		{"heap", hoard, Options{MaxHeapBytes: 1000}, HeapLimit},
+	}
+
+	for _, test := range tests {
+		err := New(test.code, 0, 0, test.opts).Run()
+		fault, ok := err.(*Fault)
+		if !ok {
+			t.Errorf("%s: expected *Fault, got %v", test.name, err)
+			continue
+		}
+		if fault.Kind != test.kind {
+			t.Errorf("%s: expected %s, got %v", test.name, test.kind, fault)
+		}
+	}
+}
+
+func TestInstructionLimitExact(t *testing.T) {
+	// CONST, CONST, ADD, PRINT, HALT
+	code := []int{CONST_I32, 1, CONST_I32, 2, ADD_I32, PRINT, HALT}
+
+	if err := New(code, 0, 0, Options{Stdout: ioutil.Discard, MaxInstructions: 5}).Run(); err != nil {
+		t.Errorf("Expected 5 instructions to be enough, got %v", err)
+	}
+
+	err := New(code, 0, 0, Options{Stdout: ioutil.Discard, MaxInstructions: 4}).Run()
+	if fault, ok := err.(*Fault); !ok || fault.Kind != InstructionLimit || fault.PC != 6 {
+		t.Errorf("Expected instruction limit at pc 6, got %v", err)
+	}
+}
+
+func TestStackLimitDepth(t *testing.T) {
+	machine := New([]int{CONST_I32, 1, JMP, 0}, 0, 0, Options{MaxStackDepth: 10})
+	err := machine.Run()
+	if fault, ok := err.(*Fault); !ok || len(fault.Stack) != 10 {
+		t.Errorf("Expected a full stack of 10, got %v", err)
+	}
+}
+
+func TestHeapLimitCollectsFirst(t *testing.T) {
+	// the garbage fits once collected, so the limit is never hit
+	m := &Module{Code: allocLoop(1000), DataSize: 2, Consts: []string{"garbage"}}
+	if err := NewFromModule(m, Options{Stdout: ioutil.Discard, MaxHeapBytes: 1000}).Run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := New(spin, 0, 0, Options{}).RunContext(ctx)
+	fault, ok := err.(*Fault)
+	if !ok || fault.Kind != Canceled {
+		t.Fatalf("Expected canceled fault, got %v", err)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected errors.Is context.Canceled, got %v", err)
+	}
+}
+
+func TestRunContextTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := New(spin, 0, 0, Options{}).RunContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected to stop soon after the deadline, took %v", elapsed)
+	}
+}
+
+func TestRunContextCompletes(t *testing.T) {
+	err := New(fibonacci, fibMain, 1, Options{Stdout: ioutil.Discard}).RunContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,315 @@
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// On-disk module format. All integers after the magic are varints
+// (encoding/binary), strings are a length followed by the bytes.
+//
+//	magic     "VMOD"
+//	version   uvarint, ModuleVersion
+//	entry     varint, initial program counter
+//	datasize  varint, number of global data slots
+//	sections  repeated: id byte, uvarint payload length, payload
+//	end       section id 0
+//
+// Sections:
+//
+//	1 code     uvarint count, varint per word
+//	2 consts   uvarint count, string per constant
+//	3 symbols  uvarint count, (string name, varint addr) per symbol
+//	4 lines    string source file, uvarint count, (varint addr, varint line) per entry
+//	5 natives  uvarint count, string per native function name
+//
+// Unknown sections are skipped so older readers can load newer modules as
+// long as the version is unchanged.
+
+const ModuleVersion = 1
+
+var moduleMagic = []byte("VMOD")
+
+const (
+	sectionEnd = iota
+	sectionCode
+	sectionConsts
+	sectionSymbols
+	sectionLines
+	sectionNatives
+)
+
+var ErrNotModule = errors.New("vm: not a module file")
+
+// Module is a program plus everything needed to run and debug it
+type Module struct {
+	Entry    int            // initial program counter
+	DataSize int            // number of global data slots
+	Code     []int          // bytecode
+	Consts   []string       // constant pool, string literals loaded by CONST_STR
+	Symbols  map[string]int // optional, label -> code address
+	Source   string         // optional, source file the module was built from
+	Lines    map[int]int    // optional, code address -> source line
+	Natives  []string       // native functions called by name, the start of the vm's native table
+}
+
+// NewFromModule creates a vm ready to run the module
+func NewFromModule(m *Module, opts Options) *vm {
+	machine := New(m.Code, m.Entry, m.DataSize, opts)
+	machine.consts = m.Consts
+	for _, name := range m.Natives {
+		machine.natives = append(machine.natives, native{name: name})
+	}
+	return machine
+}
+
+// Write encodes the module in the on-disk format
+func (m *Module) Write(w io.Writer) error {
+	var out bytes.Buffer
+	out.Write(moduleMagic)
+	putUvarint(&out, ModuleVersion)
+	putVarint(&out, int64(m.Entry))
+	putVarint(&out, int64(m.DataSize))
+
+	var section bytes.Buffer
+	writeSection := func(id byte) {
+		out.WriteByte(id)
+		putUvarint(&out, uint64(section.Len()))
+		section.WriteTo(&out)
+	}
+
+	putUvarint(&section, uint64(len(m.Code)))
+	for _, word := range m.Code {
+		putVarint(&section, int64(word))
+	}
+	writeSection(sectionCode)
+
+	if len(m.Consts) > 0 {
+		putUvarint(&section, uint64(len(m.Consts)))
+		for _, c := range m.Consts {
+			putString(&section, c)
+		}
+		writeSection(sectionConsts)
+	}
+
+	if len(m.Symbols) > 0 {
+		names := make([]string, 0, len(m.Symbols))
+		for name := range m.Symbols {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		putUvarint(&section, uint64(len(names)))
+		for _, name := range names {
+			putString(&section, name)
+			putVarint(&section, int64(m.Symbols[name]))
+		}
+		writeSection(sectionSymbols)
+	}
+
+	if len(m.Lines) > 0 {
+		addrs := make([]int, 0, len(m.Lines))
+		for addr := range m.Lines {
+			addrs = append(addrs, addr)
+		}
+		sort.Ints(addrs)
+
+		putString(&section, m.Source)
+		putUvarint(&section, uint64(len(addrs)))
+		for _, addr := range addrs {
+			putVarint(&section, int64(addr))
+			putVarint(&section, int64(m.Lines[addr]))
+		}
+		writeSection(sectionLines)
+	}
+
+	if len(m.Natives) > 0 {
+		putUvarint(&section, uint64(len(m.Natives)))
+		for _, name := range m.Natives {
+			putString(&section, name)
+		}
+		writeSection(sectionNatives)
+	}
+
+	out.WriteByte(sectionEnd)
+
+	_, err := out.WriteTo(w)
+	return err
+}
+
+// Load decodes a module written by Module.Write
+func Load(r io.Reader) (*Module, error) {
+	in := bufio.NewReader(r)
+
+	magic := make([]byte, len(moduleMagic))
+	if _, err := io.ReadFull(in, magic); err != nil || !bytes.Equal(magic, moduleMagic) {
+		return nil, ErrNotModule
+	}
+
+	d := &decoder{r: in}
+	version := d.uvarint()
+	if d.err == nil && version != ModuleVersion {
+		return nil, fmt.Errorf("vm: unsupported module version %d, expected %d", version, ModuleVersion)
+	}
+
+	m := &Module{
+		Entry:    d.int(),
+		DataSize: d.int(),
+	}
+
+	for d.err == nil {
+		id, err := in.ReadByte()
+		if err != nil {
+			d.err = err
+			break
+		}
+		if id == sectionEnd {
+			break
+		}
+
+		// the payload grows as it is read rather than trusting the length,
+		// so a corrupt length runs out of input instead of memory
+		n := d.uvarint()
+		if d.err != nil {
+			break
+		}
+		if n > math.MaxInt64 {
+			d.err = fmt.Errorf("section %d: length %d too large", id, n)
+			break
+		}
+		var payload bytes.Buffer
+		if _, err := io.CopyN(&payload, in, int64(n)); err != nil {
+			d.err = err
+			break
+		}
+
+		s := &decoder{r: &payload}
+		switch id {
+		case sectionCode:
+			m.Code = make([]int, s.count())
+			for i := range m.Code {
+				m.Code[i] = s.int()
+			}
+		case sectionConsts:
+			m.Consts = make([]string, s.count())
+			for i := range m.Consts {
+				m.Consts[i] = s.string()
+			}
+		case sectionSymbols:
+			n := s.count()
+			m.Symbols = make(map[string]int, n)
+			for i := 0; i < n; i++ {
+				name := s.string()
+				m.Symbols[name] = s.int()
+			}
+		case sectionLines:
+			m.Source = s.string()
+			n := s.count()
+			m.Lines = make(map[int]int, n)
+			for i := 0; i < n; i++ {
+				addr := s.int()
+				m.Lines[addr] = s.int()
+			}
+		case sectionNatives:
+			m.Natives = make([]string, s.count())
+			for i := range m.Natives {
+				m.Natives[i] = s.string()
+			}
+		}
+		if s.err != nil {
+			d.err = fmt.Errorf("section %d: %v", id, s.err)
+		}
+	}
+
+	if d.err != nil {
+		if d.err == io.EOF {
+			d.err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("vm: corrupt module: %v", d.err)
+	}
+
+	if m.DataSize < 0 || m.Entry < 0 || m.Entry > len(m.Code) {
+		return nil, fmt.Errorf("vm: corrupt module: entry %d, data size %d, code size %d", m.Entry, m.DataSize, len(m.Code))
+	}
+
+	return m, nil
+}
+
+// decoder reads varint encoded values, remembering the first error so a
+// whole section can be read before checking
+type decoder struct {
+	r   io.ByteReader
+	err error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	var v uint64
+	v, d.err = binary.ReadUvarint(d.r)
+	return v
+}
+
+func (d *decoder) int() int {
+	if d.err != nil {
+		return 0
+	}
+	var v int64
+	v, d.err = binary.ReadVarint(d.r)
+	return int(v)
+}
+
+// count reads a length, limited so corrupt input can not cause huge
+// allocations
+func (d *decoder) count() int {
+	return d.countOf(1)
+}
+
+// countOf reads the length of a list of elements taking at least size
+// bytes each. When the size of the input is known the elements must fit
+// in what is left of it.
+func (d *decoder) countOf(size int) int {
+	n := d.uvarint()
+	if n > 1<<24 {
+		d.err = fmt.Errorf("count %d too large", n)
+		return 0
+	}
+	if r, ok := d.r.(interface{ Len() int }); ok && d.err == nil && n*uint64(size) > uint64(r.Len()) {
+		d.err = fmt.Errorf("count %d exceeds the %d bytes left", n, r.Len())
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) string() string {
+	b := make([]byte, d.count())
+	for i := range b {
+		if d.err != nil {
+			return ""
+		}
+		b[i], d.err = d.r.ReadByte()
+	}
+	return string(b)
+}
+
+func putUvarint(buf *bytes.Buffer, v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	buf.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+}
+
+func putVarint(buf *bytes.Buffer, v int64) {
+	var tmp [binary.MaxVarintLen64]byte
+	buf.Write(tmp[:binary.PutVarint(tmp[:], v)])
+}
+
+func putString(buf *bytes.Buffer, s string) {
+	putUvarint(buf, uint64(len(s)))
+	buf.WriteString(s)
+}
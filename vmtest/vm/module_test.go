@@ -0,0 +1,99 @@
+package vm
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestModuleRoundTrip(t *testing.T) {
+	m := &Module{
+		Entry:    fibMain,
+		DataSize: 3,
+		Code:     fibonacci,
+		Consts:   []string{"hello", ""},
+		Symbols:  map[string]int{"fib": fib, "main": fibMain},
+		Source:   "fib.vasm",
+		Lines:    map[int]int{0: 5, 38: 30},
+	}
+
+	var buf bytes.Buffer
+	if err := m.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, loaded) {
+		t.Errorf("Expected\n%+v\ngot\n%+v", m, loaded)
+	}
+
+	var out bytes.Buffer
+	if err := NewFromModule(loaded, Options{Stdout: &out}).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "8\n" {
+		t.Errorf("Expected 8, got %q", out.String())
+	}
+}
+
+func TestModuleWithoutDebugInfo(t *testing.T) {
+	var buf bytes.Buffer
+	if err := (&Module{Code: []int{HALT}}).Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Code) != 1 || m.Symbols != nil || m.Lines != nil {
+		t.Errorf("Expected only code, got %+v", m)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	var valid bytes.Buffer
+	(&Module{Entry: 1, Code: []int{HALT, HALT}}).Write(&valid)
+	data := valid.Bytes()
+
+	badVersion := append([]byte("VMOD"), 99)
+	badEntry := append([]byte{}, data...)
+	badEntry[5] = 20 // varint 10, past the end of the code
+
+	// a code section claiming far more bytes than follow
+	var header bytes.Buffer
+	header.WriteString("VMOD")
+	putUvarint(&header, ModuleVersion)
+	putVarint(&header, 0)
+	putVarint(&header, 0)
+	header.WriteByte(sectionCode)
+	hugeSection := append([]byte{}, header.Bytes()...)
+	hugeSection = append(hugeSection, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f, 1, 2, 3)
+	overflowSection := append([]byte{}, header.Bytes()...)
+	overflowSection = append(overflowSection, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01)
+
+	tests := []struct {
+		name  string
+		input []byte
+		err   string
+	}{
+		{"empty", nil, "not a module"},
+		{"magic", []byte("MZ\x00\x00"), "not a module"},
+		{"version", badVersion, "unsupported module version 99"},
+		{"truncated", data[:len(data)-2], "unexpected EOF"},
+		{"entry", badEntry, "entry 10"},
+		{"section length", hugeSection, "corrupt module: unexpected EOF"},
+		{"section overflow", overflowSection, "length 18446744073709551615 too large"},
+	}
+
+	for _, test := range tests {
+		_, err := Load(bytes.NewReader(test.input))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected error containing %q, got %v", test.name, test.err, err)
+		}
+	}
+}
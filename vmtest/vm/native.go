@@ -0,0 +1,130 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+)
+
+// NativeFunc is a Go function called from bytecode by CALL_NATIVE. args are
+// the values the program pushed, first argument first. They stay on the
+// stack, and so reachable for the garbage collector, until it returns. A
+// returned error stops the program with a NativeError fault.
+type NativeFunc func(args []Value) (Value, error)
+
+// Variadic is the argument count of a native that takes any number
+const Variadic = -1
+
+// native is an entry in the vm's native table
+type native struct {
+	name string
+	argc int        // expected argument count, or Variadic
+	fn   NativeFunc // nil until registered
+}
+
+// RegisterNative makes fn callable from bytecode with CALL_NATIVE, returning
+// its index in the native table. The table starts with the names the
+// module imports (Module.Natives), registering one of those fills in its
+// entry, any other name is added at the end. argc is checked on every
+// call, pass Variadic to accept any number of arguments.
+func (machine *vm) RegisterNative(name string, argc int, fn NativeFunc) int {
+	index, ok := machine.NativeIndex(name)
+	if !ok {
+		index = len(machine.natives)
+		machine.natives = append(machine.natives, native{name: name})
+	}
+	machine.natives[index].argc = argc
+	machine.natives[index].fn = fn
+	return index
+}
+
+// NativeIndex returns the index of a native in the native table
+func (machine *vm) NativeIndex(name string) (int, bool) {
+	for i, n := range machine.natives {
+		if n.name == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// callNative executes CALL_NATIVE
+func (machine *vm) callNative(index, argc int) {
+	if index < 0 || index >= len(machine.natives) {
+		machine.fault(BadNative, "native %d, table has %d", index, len(machine.natives))
+	}
+	n := &machine.natives[index]
+	if n.fn == nil {
+		machine.fault(BadNative, "native %q is not registered", n.name)
+	}
+	if n.argc != Variadic && argc != n.argc {
+		machine.fault(BadNative, "%s expects %d argument(s), called with %d", n.name, n.argc, argc)
+	}
+
+	current := machine.frames[len(machine.frames)-1]
+	if argc < 0 || argc > machine.sp-(current.base+current.size-1) {
+		machine.fault(StackUnderflow, "CALL_NATIVE with %d argument(s)", argc)
+	}
+
+	// a copy, so the native can keep the slice without seeing later pushes
+	base := machine.sp - argc + 1
+	args := make([]Value, argc)
+	copy(args, machine.stack[base:])
+
+	result, err := n.fn(args)
+	if err != nil {
+		panic(machine.newFault(NativeError, err, "%s: %v", n.name, err))
+	}
+
+	for machine.sp >= base {
+		machine.StackPop()
+	}
+	machine.StackPush(result)
+}
+
+// RegisterBuiltins registers a few general purpose natives:
+//
+//	str(v)         string of any value, as PRINT shows it
+//	format(f, ...) fmt.Sprintf with the arguments as Go values
+//	sqrt(x)        square root of a float
+//
+// They allocate their results on the vm's heap.
+func (machine *vm) RegisterBuiltins() {
+	machine.RegisterNative("str", 1, func(args []Value) (Value, error) {
+		return machine.NewString(machine.Format(args[0])), nil
+	})
+
+	machine.RegisterNative("format", Variadic, func(args []Value) (Value, error) {
+		if len(args) == 0 || args[0].Kind != KindString {
+			return Value{}, fmt.Errorf("expected a format string")
+		}
+		values := make([]interface{}, len(args)-1)
+		for i, arg := range args[1:] {
+			values[i] = machine.goValue(arg)
+		}
+		format, _ := machine.Str(args[0])
+		return machine.NewString(fmt.Sprintf(format, values...)), nil
+	})
+
+	machine.RegisterNative("sqrt", 1, func(args []Value) (Value, error) {
+		if args[0].Kind != KindFloat {
+			return Value{}, fmt.Errorf("expected float, got %s", args[0].Kind)
+		}
+		return Float(math.Sqrt(args[0].AsFloat())), nil
+	})
+}
+
+// goValue converts a value for use with the fmt package
+func (machine *vm) goValue(value Value) interface{} {
+	switch value.Kind {
+	case KindInt:
+		return value.AsInt()
+	case KindFloat:
+		return value.AsFloat()
+	case KindBool:
+		return value.AsBool()
+	case KindString:
+		s, _ := machine.Str(value)
+		return s
+	}
+	return machine.Format(value)
+}
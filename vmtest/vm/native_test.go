@@ -0,0 +1,188 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestNativeCall(t *testing.T) {
+	var out bytes.Buffer
+	machine := New([]int{
+		CONST_I32, 7, CONST_I32, 5, CALL_NATIVE, 0, 2, PRINT, // 7 - 5
+		CALL_NATIVE, 1, 0, PRINT, // no arguments
+		HALT,
+	}, 0, 0, Options{Stdout: &out})
+
+	var got []Value
+	sub := machine.RegisterNative("sub", 2, func(args []Value) (Value, error) {
+		got = args
+		return Int(args[0].AsInt() - args[1].AsInt()), nil
+	})
+	answer := machine.RegisterNative("answer", 0, func(args []Value) (Value, error) {
+		return Int(42), nil
+	})
+	if sub != 0 || answer != 1 {
+		t.Fatalf("Expected indexes 0 and 1, got %d and %d", sub, answer)
+	}
+	if index, ok := machine.NativeIndex("answer"); !ok || index != 1 {
+		t.Errorf("Expected answer at index 1, got %d, %v", index, ok)
+	}
+
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "2\n42\n" {
+		t.Errorf("Expected 2 and 42, got %q", out.String())
+	}
+	if expected := []Value{Int(7), Int(5)}; !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected arguments %v, got %v", expected, got)
+	}
+	if machine.sp != -1 {
+		t.Errorf("Expected arguments to be popped, sp is %d", machine.sp)
+	}
+}
+
+func TestNativeImports(t *testing.T) {
+	// the module imports by name, the embedder registers in any order
+	m := &Module{
+		Code:    []int{CONST_I32, 3, CALL_NATIVE, 1, 1, CALL_NATIVE, 0, 1, PRINT, HALT},
+		Natives: []string{"double", "inc"},
+	}
+
+	var out bytes.Buffer
+	machine := NewFromModule(m, Options{Stdout: &out})
+	machine.RegisterNative("inc", 1, func(args []Value) (Value, error) {
+		return Int(args[0].AsInt() + 1), nil
+	})
+	machine.RegisterNative("double", 1, func(args []Value) (Value, error) {
+		return Int(args[0].AsInt() * 2), nil
+	})
+
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "8\n" {
+		t.Errorf("Expected 8, got %q", out.String())
+	}
+
+	var buf bytes.Buffer
+	if err := m.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m.Natives, loaded.Natives) {
+		t.Errorf("Expected natives %q, got %q", m.Natives, loaded.Natives)
+	}
+}
+
+func TestNativeFaults(t *testing.T) {
+	failure := errors.New("out of cheese")
+	register := func(machine *vm) {
+		machine.RegisterNative("one", 1, func(args []Value) (Value, error) {
+			return args[0], nil
+		})
+		machine.RegisterNative("fail", Variadic, func(args []Value) (Value, error) {
+			return Value{}, failure
+		})
+	}
+
+	tests := []struct {
+		name    string
+		code    []int
+		natives []string
+		kind    FaultKind
+	}{
+		{"unknown index", []int{CALL_NATIVE, 9, 0, HALT}, nil, BadNative},
+		{"not registered", []int{CALL_NATIVE, 0, 0, HALT}, []string{"missing"}, BadNative},
+		{"argument count", []int{CONST_I32, 1, CONST_I32, 2, CALL_NATIVE, 0, 2, HALT}, nil, BadNative},
+		{"too few values", []int{CALL_NATIVE, 1, 3, HALT}, nil, StackUnderflow},
+		{"error", []int{CONST_I32, 1, CALL_NATIVE, 1, 1, HALT}, nil, NativeError},
+	}
+
+	for _, test := range tests {
+		machine := NewFromModule(&Module{Code: test.code, Natives: test.natives}, Options{})
+		register(machine)
+
+		err := machine.Run()
+		fault, ok := err.(*Fault)
+		if !ok || fault.Kind != test.kind {
+			t.Errorf("%s: expected %s, got %v", test.name, test.kind, err)
+			continue
+		}
+		if test.kind == NativeError && !errors.Is(err, failure) {
+			t.Errorf("%s: expected the native's error to be wrapped, got %v", test.name, err)
+		}
+	}
+}
+
+func TestNativeArgumentsSurviveGC(t *testing.T) {
+	m := &Module{
+		Code:   []int{CONST_STR, 0, CALL_NATIVE, 0, 1, PRINT, HALT},
+		Consts: []string{"kept"},
+	}
+
+	var out bytes.Buffer
+	machine := NewFromModule(m, Options{Stdout: &out, GCThreshold: 64})
+	machine.RegisterNative("churn", 1, func(args []Value) (Value, error) {
+		for i := 0; i < 100; i++ {
+			machine.NewString(fmt.Sprint("garbage ", i))
+		}
+		s, ok := machine.Str(args[0])
+		if !ok {
+			return Value{}, errors.New("argument was collected")
+		}
+		return machine.NewString(s + "!"), nil
+	})
+
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if machine.Stats().Collections == 0 {
+		t.Error("Expected the native to trigger a collection")
+	}
+	if out.String() != "kept!\n" {
+		t.Errorf("Expected kept!, got %q", out.String())
+	}
+}
+
+func TestNativeBuiltins(t *testing.T) {
+	m := &Module{
+		Code: []int{
+			CONST_F64, f64(2.25), CALL_NATIVE, 2, 1, PRINT, // sqrt(2.25)
+			CONST_I32, 3, NEW_ARRAY, CALL_NATIVE, 0, 1, PRINT, // str([0 0 0])
+			CONST_STR, 0, CONST_I32, 7, CONST_STR, 1, CONST_BOOL, 1, CALL_NATIVE, 1, 4, PRINT, // format
+			HALT,
+		},
+		Consts:  []string{"%d %s %v", "x"},
+		Natives: []string{"str", "format", "sqrt"},
+	}
+
+	var out bytes.Buffer
+	machine := NewFromModule(m, Options{Stdout: &out})
+	machine.RegisterBuiltins()
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	var expected bytes.Buffer
+	arrays := New([]int{CONST_I32, 3, NEW_ARRAY, PRINT, HALT}, 0, 0, Options{Stdout: &expected})
+	if err := arrays.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "1.5\n" + expected.String() + "7 x true\n"; out.String() != want {
+		t.Errorf("Expected %q, got %q", want, out.String())
+	}
+
+	machine = NewFromModule(&Module{Code: []int{CONST_I32, 4, CALL_NATIVE, 2, 1, HALT}, Natives: m.Natives}, Options{Stdout: ioutil.Discard})
+	machine.RegisterBuiltins()
+	if err := machine.Run(); err == nil || err.(*Fault).Kind != NativeError {
+		t.Errorf("Expected sqrt of an int to fail, got %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+)
+
+// Operations on values shared by the interpreter, the compiled closures
+// and the register machine, so every backend computes the same results and
+// raises the same faults. An operation that fails returns an opFault, which
+// the backend raises at the instruction it is running. Instructions that
+// are a single Go operator, such as ADD_I32 or LT_F64, stay inline in each
+// backend: they can not fault and a call per add costs the register machine
+// more than half its speed.
+
+// opFault is a fault raised by an operation, without the address
+type opFault struct {
+	kind   FaultKind
+	detail string
+}
+
+// raise faults with the fault of an operation at the current instruction
+func (machine *vm) raise(f *opFault) {
+	machine.fault(f.kind, "%s", f.detail)
+}
+
+// divInt computes DIV_I32
+func divInt(a, b int64) (int64, *opFault) {
+	if b == 0 {
+		return 0, &opFault{DivisionByZero, fmt.Sprintf("%d / 0", a)}
+	}
+	return a / b, nil
+}
+
+// modInt computes MOD_I32
+func modInt(a, b int64) (int64, *opFault) {
+	if b == 0 {
+		return 0, &opFault{DivisionByZero, fmt.Sprintf("%d %% 0", a)}
+	}
+	return a % b, nil
+}
+
+// shiftLeft and shiftRight compute SHL_I32 and SHR_I32, the count is
+// taken modulo 64
+
+func shiftLeft(a, b int64) int64 {
+	return a << (uint64(b) & 63)
+}
+
+func shiftRight(a, b int64) int64 {
+	return a >> (uint64(b) & 63)
+}
+
+func compareFloat(code int, a, b float64) bool {
+	switch code {
+	case LT_F64:
+		return a < b
+	case GT_F64:
+		return a > b
+	case LE_F64:
+		return a <= b
+	case GE_F64:
+		return a >= b
+	case EQ_F64:
+		return a == b
+	}
+	return a != b
+}
+
+// logical computes AND, OR and XOR, bitwise on two ints and logical on
+// two bools
+func logical(code int, a, b Value) (Value, *opFault) {
+	if a.Kind != b.Kind || (a.Kind != KindInt && a.Kind != KindBool) {
+		return Value{}, &opFault{TypeError, fmt.Sprintf("expected two ints or two bools, got %s and %s", a.Kind, b.Kind)}
+	}
+	switch code {
+	case AND_I32:
+		return Value{a.Kind, a.bits & b.bits}, nil
+	case OR_I32:
+		return Value{a.Kind, a.bits | b.bits}, nil
+	}
+	return Value{a.Kind, a.bits ^ b.bits}, nil
+}
+
+// not computes NOT_I32, bitwise on an int and logical on a bool
+func not(value Value) (Value, *opFault) {
+	switch value.Kind {
+	case KindInt:
+		return Int(^value.AsInt()), nil
+	case KindBool:
+		return Bool(!value.AsBool()), nil
+	}
+	return Value{}, &opFault{TypeError, fmt.Sprintf("expected int or bool, got %s", value.Kind)}
+}
+
+// f2i converts a float to an int, truncating towards zero
+func f2i(value float64) (int64, *opFault) {
+	if math.IsNaN(value) || value >= math.MaxInt64 || value < math.MinInt64 {
+		return 0, &opFault{BadConversion, fmt.Sprintf("%v does not fit in an int", value)}
+	}
+	return int64(value), nil
+}
@@ -0,0 +1,356 @@
+package vm
+
+import (
+	"fmt"
+)
+
+// Peephole optimizer. Optimize works on a decoded copy of the code, each
+// instruction keeping its original address so that branch operands can go
+// on referring to original addresses while instructions are rewritten or
+// removed. The passes repeat until none of them changes anything:
+//
+//   - branch targets skip removed instructions, and JMP, JMPT and JMPF to
+//     a JMP go straight to its target
+//   - constants followed by a pure instruction, e.g. CONST_I32 2,
+//     CONST_I32 3, ADD_I32, are replaced by the result
+//   - JMPT and JMPF after a CONST_BOOL become a JMP or nothing
+//   - a JMP to the next instruction is removed
+//   - instructions that can not be reached from the entry point are removed
+//
+// Only then are the instructions given new addresses and the branch
+// operands, entry point, symbols and line numbers relocated.
+
+// Optimize returns an optimized copy of the module, which must verify
+// without diagnostics. Programs produce the same output and faults,
+// although a fault may be reported at a different address.
+func Optimize(m *Module) (*Module, error) {
+	if diagnostics := Verify(m); len(diagnostics) > 0 {
+		return nil, fmt.Errorf("optimize: module does not verify, address %s", diagnostics[0])
+	}
+
+	o := &optimizer{module: m, index: map[int]int{}}
+	for pc := 0; pc < len(m.Code); {
+		op := Opcodes[m.Code[pc]]
+		next := pc + 1 + op.Operands
+		o.index[pc] = len(o.code)
+		o.code = append(o.code, optInstruction{
+			addr:     pc,
+			code:     m.Code[pc],
+			operands: append([]int(nil), m.Code[pc+1:next]...),
+		})
+		pc = next
+	}
+
+	for changed := true; changed; {
+		changed = o.threadBranches()
+		changed = o.fold() || changed
+		changed = o.removeJumpsToNext() || changed
+		changed = o.removeUnreachable() || changed
+	}
+
+	return o.relocate(), nil
+}
+
+type optInstruction struct {
+	addr     int // address in the original module
+	code     int
+	operands []int // branch targets are original addresses
+	dead     bool
+}
+
+func (ins *optInstruction) branch() bool {
+	return Opcodes[ins.code].Branch
+}
+
+type optimizer struct {
+	module *Module
+	code   []optInstruction
+	index  map[int]int // original address -> position in code
+}
+
+// live returns the position of the first live instruction at or after
+// position i, len(o.code) for the end of the code
+func (o *optimizer) live(i int) int {
+	for i < len(o.code) && o.code[i].dead {
+		i++
+	}
+	return i
+}
+
+// resolve returns the original address of the first live instruction at
+// or after addr, the original code length for the end of the code
+func (o *optimizer) resolve(addr int) int {
+	i, ok := o.index[addr]
+	if !ok {
+		return len(o.module.Code)
+	}
+	if i = o.live(i); i == len(o.code) {
+		return len(o.module.Code)
+	}
+	return o.code[i].addr
+}
+
+// at returns the live instruction at an original address, nil at the end
+// of the code
+func (o *optimizer) at(addr int) *optInstruction {
+	if i, ok := o.index[addr]; ok && !o.code[i].dead {
+		return &o.code[i]
+	}
+	return nil
+}
+
+// next returns the position of the live instruction after position i
+func (o *optimizer) next(i int) int {
+	return o.live(i + 1)
+}
+
+// threadBranches points branches at live instructions, following chains
+// of JMPs. CALL and SPAWN targets are not threaded, the target identifies
+// the function.
+func (o *optimizer) threadBranches() bool {
+	changed := false
+	for i := range o.code {
+		ins := &o.code[i]
+		if ins.dead || !ins.branch() {
+			continue
+		}
+
+		target := o.resolve(ins.operands[0])
+		if ins.code != CALL && ins.code != SPAWN {
+			seen := map[int]bool{}
+			for jmp := o.at(target); jmp != nil && jmp.code == JMP && !seen[target]; jmp = o.at(target) {
+				seen[target] = true
+				target = o.resolve(jmp.operands[0])
+			}
+		}
+
+		if target != ins.operands[0] {
+			ins.operands[0] = target
+			changed = true
+		}
+	}
+	return changed
+}
+
+// targets returns the original addresses that are branched to, plus the
+// entry point
+func (o *optimizer) targets() map[int]bool {
+	targets := map[int]bool{o.module.Entry: true}
+	for i := range o.code {
+		if ins := &o.code[i]; !ins.dead && ins.branch() {
+			targets[ins.operands[0]] = true
+		}
+	}
+	return targets
+}
+
+// pure instructions only depend on their operands on the stack and can be
+// computed ahead of time when those are constants
+var pure = map[int]bool{
+	ADD_I32: true, SUB_I32: true, MUL_I32: true, DIV_I32: true, MOD_I32: true,
+	NEG_I32: true, AND_I32: true, OR_I32: true, XOR_I32: true, NOT_I32: true,
+	SHL_I32: true, SHR_I32: true,
+	LT_I32: true, GT_I32: true, LE_I32: true, GE_I32: true, EQ_I32: true, NE_I32: true,
+	ADD_F64: true, SUB_F64: true, MUL_F64: true, DIV_F64: true, NEG_F64: true,
+	LT_F64: true, GT_F64: true, LE_F64: true, GE_F64: true, EQ_F64: true, NE_F64: true,
+	I2F: true, F2I: true,
+}
+
+func constant(code int) bool {
+	return code == CONST_I32 || code == CONST_F64 || code == CONST_BOOL
+}
+
+// fold replaces constants and the pure instruction using them with the
+// result, and constant conditional branches with a JMP or nothing. Only
+// the first instruction of a sequence may be a branch target.
+func (o *optimizer) fold() bool {
+	targets := o.targets()
+	changed := false
+
+	for i := o.live(0); i < len(o.code); i = o.next(i) {
+		if !constant(o.code[i].code) {
+			continue
+		}
+
+		// the constants leading up to a pure instruction
+		seq := []int{i}
+		j := o.next(i)
+		for ; j < len(o.code) && constant(o.code[j].code) && !targets[o.code[j].addr]; j = o.next(j) {
+			seq = append(seq, j)
+		}
+		if j == len(o.code) || targets[o.code[j].addr] {
+			continue
+		}
+		last := &o.code[j]
+
+		cond := &o.code[seq[len(seq)-1]]
+		switch {
+		case cond.code == CONST_BOOL && (last.code == JMPT || last.code == JMPF):
+			if (cond.operands[0] != 0) == (last.code == JMPT) {
+				*cond = optInstruction{addr: cond.addr, code: JMP, operands: last.operands}
+			} else {
+				cond.dead = true
+			}
+			last.dead = true
+			changed = true
+
+		case pure[last.code] && len(seq) >= Opcodes[last.code].Pops:
+			// only the constants the instruction pops are replaced
+			seq = seq[len(seq)-Opcodes[last.code].Pops:]
+			result, ok := evaluate(o.code, seq, last.code)
+			if !ok {
+				continue // faults at run time, which must still happen
+			}
+			head := &o.code[seq[0]]
+			*head = optInstruction{addr: head.addr, code: result.code, operands: result.operands}
+			for _, k := range seq[1:] {
+				o.code[k].dead = true
+			}
+			last.dead = true
+			changed = true
+		}
+	}
+	return changed
+}
+
+// evaluate runs the constants at positions seq and the instruction code
+// on a scratch vm, returning the result as a constant instruction
+func evaluate(instructions []optInstruction, seq []int, code int) (optInstruction, bool) {
+	var program []int
+	for _, k := range seq {
+		program = append(program, instructions[k].code)
+		program = append(program, instructions[k].operands...)
+	}
+	program = append(program, code, HALT)
+
+	machine := New(program, 0, 0, Options{})
+	if err := machine.Run(); err != nil || machine.sp != 0 {
+		return optInstruction{}, false
+	}
+
+	value := machine.stack[0]
+	switch value.Kind {
+	case KindInt:
+		return optInstruction{code: CONST_I32, operands: []int{int(value.bits)}}, true
+	case KindFloat:
+		return optInstruction{code: CONST_F64, operands: []int{int(value.bits)}}, true
+	case KindBool:
+		return optInstruction{code: CONST_BOOL, operands: []int{int(value.bits)}}, true
+	}
+	return optInstruction{}, false
+}
+
+// removeJumpsToNext removes JMPs to the instruction that follows them
+func (o *optimizer) removeJumpsToNext() bool {
+	changed := false
+	for i := o.live(0); i < len(o.code); i = o.next(i) {
+		ins := &o.code[i]
+		if ins.code != JMP {
+			continue
+		}
+
+		next := len(o.module.Code)
+		if n := o.next(i); n < len(o.code) {
+			next = o.code[n].addr
+		}
+		if o.resolve(ins.operands[0]) == next {
+			ins.dead = true
+			changed = true
+		}
+	}
+	return changed
+}
+
+// removeUnreachable removes the instructions no path from the entry point
+// reaches
+func (o *optimizer) removeUnreachable() bool {
+	reached := map[int]bool{}
+	pending := []int{o.resolve(o.module.Entry)}
+
+	for len(pending) > 0 {
+		addr := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		ins := o.at(addr)
+		if ins == nil || reached[addr] {
+			continue
+		}
+		reached[addr] = true
+
+		if ins.branch() {
+			pending = append(pending, o.resolve(ins.operands[0]))
+		}
+		if ins.code != JMP && ins.code != RET && ins.code != HALT && ins.code != THROW {
+			if n := o.next(o.index[addr]); n < len(o.code) {
+				pending = append(pending, o.code[n].addr)
+			}
+		}
+	}
+
+	changed := false
+	for i := range o.code {
+		if ins := &o.code[i]; !ins.dead && !reached[ins.addr] {
+			ins.dead = true
+			changed = true
+		}
+	}
+	return changed
+}
+
+// relocate lays out the live instructions and builds the new module
+func (o *optimizer) relocate() *Module {
+	m := o.module
+	addrs := map[int]int{} // original -> new address
+
+	size := 0
+	for i := range o.code {
+		if ins := &o.code[i]; !ins.dead {
+			addrs[ins.addr] = size
+			size += 1 + len(ins.operands)
+		}
+	}
+	addrs[len(m.Code)] = size
+	relocate := func(addr int) int {
+		return addrs[o.resolve(addr)]
+	}
+
+	out := &Module{
+		Entry:    relocate(m.Entry),
+		DataSize: m.DataSize,
+		Code:     make([]int, 0, size),
+		Consts:   m.Consts,
+		Source:   m.Source,
+		Natives:  m.Natives,
+	}
+
+	for i := range o.code {
+		ins := &o.code[i]
+		if ins.dead {
+			continue
+		}
+		if line, ok := m.Lines[ins.addr]; ok {
+			if out.Lines == nil {
+				out.Lines = map[int]int{}
+			}
+			out.Lines[len(out.Code)] = line
+		}
+
+		out.Code = append(out.Code, ins.code)
+		out.Code = append(out.Code, ins.operands...)
+		if ins.branch() {
+			out.Code[len(out.Code)-len(ins.operands)] = relocate(ins.operands[0])
+		}
+	}
+
+	if m.Symbols != nil {
+		out.Symbols = map[string]int{}
+		for name, addr := range m.Symbols {
+			// labels of removed instructions are dropped
+			if ins := o.at(addr); ins != nil || addr == len(m.Code) {
+				out.Symbols[name] = relocate(addr)
+			}
+		}
+	}
+
+	return out
+}
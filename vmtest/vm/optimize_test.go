@@ -0,0 +1,156 @@
+package vm
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// optimize returns the optimized module after checking it verifies and
+// behaves the same as the original: same output and same kind of fault
+func optimize(t *testing.T, m *Module) *Module {
+	t.Helper()
+
+	optimized, err := Optimize(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diagnostics := Verify(optimized); len(diagnostics) > 0 {
+		t.Fatalf("optimized module does not verify: %v\n%v", diagnostics, optimized.Code)
+	}
+
+	outcome := func(m *Module) (string, FaultKind) {
+		var out bytes.Buffer
+		err := NewFromModule(m, Options{Stdout: &out, MaxInstructions: 1000000}).Run()
+		if fault, ok := err.(*Fault); ok {
+			return out.String(), fault.Kind
+		}
+		return out.String(), 0
+	}
+
+	out, kind := outcome(m)
+	optOut, optKind := outcome(optimized)
+	if out != optOut || kind != optKind {
+		t.Errorf("Expected output %q and fault %v, optimized program gave %q and %v", out, kind, optOut, optKind)
+	}
+	return optimized
+}
+
+func TestOptimizeFolding(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     []int
+		expected []int
+	}{
+		{"int", []int{CONST_I32, 2, CONST_I32, 3, ADD_I32, CONST_I32, 4, MUL_I32, PRINT, HALT},
+			[]int{CONST_I32, 20, PRINT, HALT}},
+		{"unary", []int{CONST_I32, 5, NEG_I32, PRINT, HALT},
+			[]int{CONST_I32, -5, PRINT, HALT}},
+		{"comparison", []int{CONST_I32, 1, CONST_I32, 2, LT_I32, PRINT, HALT},
+			[]int{CONST_BOOL, 1, PRINT, HALT}},
+		{"float", []int{CONST_F64, f64(1.5), CONST_I32, 2, I2F, MUL_F64, PRINT, HALT},
+			[]int{CONST_F64, f64(3), PRINT, HALT}},
+		{"only the popped constants", []int{CONST_I32, 1, CONST_I32, 2, CONST_I32, 3, SUB_I32, ADD_I32, PRINT, HALT},
+			[]int{CONST_I32, 0, PRINT, HALT}},
+		{"division by zero is kept", []int{CONST_I32, 1, CONST_I32, 0, DIV_I32, PRINT, HALT},
+			[]int{CONST_I32, 1, CONST_I32, 0, DIV_I32, PRINT, HALT}},
+		{"type error is kept", []int{CONST_I32, 1, CONST_BOOL, 1, ADD_I32, PRINT, HALT},
+			[]int{CONST_I32, 1, CONST_BOOL, 1, ADD_I32, PRINT, HALT}},
+		{"constant branch taken", []int{CONST_BOOL, 1, JMPT, 7, CONST_I32, 1, PRINT, CONST_I32, 2, PRINT, HALT},
+			[]int{CONST_I32, 2, PRINT, HALT}},
+		{"constant branch not taken", []int{CONST_BOOL, 0, JMPT, 7, CONST_I32, 1, PRINT, CONST_I32, 2, PRINT, HALT},
+			[]int{CONST_I32, 1, PRINT, CONST_I32, 2, PRINT, HALT}},
+	}
+
+	for _, test := range tests {
+		optimized := optimize(t, &Module{Code: test.code})
+		if !reflect.DeepEqual(test.expected, optimized.Code) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, optimized.Code)
+		}
+	}
+}
+
+func TestOptimizeTargetNotFolded(t *testing.T) {
+	// the loop jumps to the second constant, folding it away would change
+	// what the loop computes
+	code := []int{
+		CONST_I32, 0, GSTORE, 0, // 0
+		CONST_I32, 0, GLOAD, // 4 - loop
+		CONST_I32, 1, ADD_I32, // 7
+		DUP, GSTORE, 0, // 10
+		CONST_I32, 3, LT_I32, JMPT, 4, // 13
+		CONST_I32, 0, GLOAD, PRINT, HALT, // 18
+	}
+	optimize(t, &Module{Code: code, DataSize: 1})
+}
+
+func TestOptimizeJumps(t *testing.T) {
+	code := []int{
+		JMP, 2, // 0 - to the next instruction
+		CONST_BOOL, 0, GSTORE, 0, // 2
+		CONST_I32, 0, GLOAD, JMPF, 16, // 6 - JMPF to a chain of JMPs
+		HALT,    // 11
+		JMP, 22, // 12 - unreachable
+		JMP, 12, // 14 - unreachable
+		JMP, 18, // 16 - unreachable
+		JMP, 20, // 18
+		JMP, 22, // 20
+		CONST_I32, 7, PRINT, HALT, // 22
+	}
+	optimized := optimize(t, &Module{Code: code, DataSize: 1})
+	expected := []int{
+		CONST_BOOL, 0, GSTORE, 0, // 0
+		CONST_I32, 0, GLOAD, JMPF, 10, // 4
+		HALT,                      // 9
+		CONST_I32, 7, PRINT, HALT, // 10
+	}
+	if !reflect.DeepEqual(expected, optimized.Code) {
+		t.Errorf("Expected\n%v\ngot\n%v", expected, optimized.Code)
+	}
+}
+
+func TestOptimizeUnreachable(t *testing.T) {
+	code := []int{
+		CONST_I32, 1, RET, // 0 - never called
+		CONST_I32, 2, RET, // 3 - called
+		CALL, 3, 0, PRINT, HALT, // 6 - main
+		CONST_I32, 9, PRINT, // 11 - after HALT
+	}
+	m := &Module{
+		Entry:   6,
+		Code:    code,
+		Symbols: map[string]int{"unused": 0, "used": 3, "main": 6},
+		Lines:   map[int]int{0: 1, 3: 2, 6: 3, 9: 4, 10: 5, 11: 6},
+		Source:  "test.vasm",
+	}
+
+	optimized := optimize(t, m)
+	expected := []int{CONST_I32, 2, RET, CALL, 0, 0, PRINT, HALT}
+	if !reflect.DeepEqual(expected, optimized.Code) {
+		t.Errorf("Expected %v, got %v", expected, optimized.Code)
+	}
+	if optimized.Entry != 3 {
+		t.Errorf("Expected entry 3, got %d", optimized.Entry)
+	}
+	if symbols := map[string]int{"used": 0, "main": 3}; !reflect.DeepEqual(symbols, optimized.Symbols) {
+		t.Errorf("Expected symbols %v, got %v", symbols, optimized.Symbols)
+	}
+	if lines := map[int]int{0: 2, 3: 3, 6: 4, 7: 5}; !reflect.DeepEqual(lines, optimized.Lines) {
+		t.Errorf("Expected lines %v, got %v", lines, optimized.Lines)
+	}
+}
+
+func TestOptimizeFibonacci(t *testing.T) {
+	optimized := optimize(t, &Module{Entry: fibMain, Code: fibonacci})
+	if len(optimized.Code) > len(fibonacci) {
+		t.Errorf("Expected no growth, got %d words from %d", len(optimized.Code), len(fibonacci))
+	}
+}
+
+func TestOptimizeUnverified(t *testing.T) {
+	_, err := Optimize(&Module{Code: []int{JMP, 1, HALT}})
+	if err == nil || !strings.Contains(err.Error(), "does not verify") {
+		t.Errorf("Expected a verify error, got %v", err)
+	}
+}
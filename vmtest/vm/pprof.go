@@ -0,0 +1,168 @@
+package vm
+
+import (
+	"compress/gzip"
+	"io"
+	"sort"
+)
+
+// WritePprof writes the profile in the gzipped protocol buffer format read
+// by `go tool pprof`, with one sample per distinct call stack valued in
+// instructions. Locations are code addresses, the module, which may be
+// nil, provides function names and source lines.
+//
+// The encoding is done by hand to avoid depending on a protobuf library,
+// see github.com/google/pprof/proto/profile.proto for the message
+// definitions and field numbers used below.
+func (p *Profile) WritePprof(w io.Writer, m *Module) error {
+	syms := newSymbols(m)
+	table := stringTable{index: map[string]int{}}
+	table.add("")
+
+	var out protobuf
+	valueType := func(field int, typ, unit string) {
+		var vt protobuf
+		vt.varint(1, uint64(table.add(typ)))
+		vt.varint(2, uint64(table.add(unit)))
+		out.message(field, &vt)
+	}
+	valueType(1, "instructions", "count") // sample_type
+
+	stacks := p.stackCounts()
+	keys := make([]string, 0, len(stacks))
+	for key := range stacks {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// ids are 1 based, 0 means unset
+	locations := map[int]uint64{}
+	var addrs []int
+	for _, key := range keys {
+		var sample protobuf
+		var ids []uint64
+		for _, addr := range decodeStack(key) {
+			id, ok := locations[addr]
+			if !ok {
+				id = uint64(len(locations) + 1)
+				locations[addr] = id
+				addrs = append(addrs, addr)
+			}
+			ids = append(ids, id)
+		}
+		sample.packed(1, ids)                           // location_id
+		sample.packed(2, []uint64{uint64(stacks[key])}) // value
+		out.message(2, &sample)
+	}
+
+	functions := map[int]uint64{}
+	var fns []int
+	for _, addr := range addrs {
+		fn := p.owners[addr]
+		id, ok := functions[fn]
+		if !ok {
+			id = uint64(len(functions) + 1)
+			functions[fn] = id
+			fns = append(fns, fn)
+		}
+
+		var loc, line protobuf
+		loc.varint(1, locations[addr]) // id
+		loc.varint(3, uint64(addr))    // address
+		line.varint(1, id)             // function_id
+		if n, ok := m.line(addr); ok {
+			line.varint(2, uint64(n))
+		}
+		loc.message(4, &line)
+		out.message(4, &loc)
+	}
+
+	for _, addr := range fns {
+		var fn protobuf
+		name := uint64(table.add(syms.name(addr)))
+		fn.varint(1, functions[addr]) // id
+		fn.varint(2, name)            // name
+		fn.varint(3, name)            // system_name
+		if m != nil && m.Source != "" {
+			fn.varint(4, uint64(table.add(m.Source))) // filename
+		}
+		if n, ok := m.line(addr); ok {
+			fn.varint(5, uint64(n)) // start_line
+		}
+		out.message(5, &fn)
+	}
+
+	valueType(11, "instructions", "count") // period_type
+	out.varint(12, 1)                      // period
+
+	// the string table is written last, once every string is known
+	for _, s := range table.values {
+		out.bytes(6, []byte(s))
+	}
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(out.buf); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// stringTable interns the strings of a pprof profile
+type stringTable struct {
+	values []string
+	index  map[string]int
+}
+
+func (t *stringTable) add(s string) int {
+	if i, ok := t.index[s]; ok {
+		return i
+	}
+	t.values = append(t.values, s)
+	t.index[s] = len(t.values) - 1
+	return len(t.values) - 1
+}
+
+// protobuf encodes protocol buffer fields
+type protobuf struct {
+	buf []byte
+}
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+func (pb *protobuf) uvarint(v uint64) {
+	for v >= 0x80 {
+		pb.buf = append(pb.buf, byte(v)|0x80)
+		v >>= 7
+	}
+	pb.buf = append(pb.buf, byte(v))
+}
+
+func (pb *protobuf) key(field int, wire int) {
+	pb.uvarint(uint64(field)<<3 | uint64(wire))
+}
+
+func (pb *protobuf) varint(field int, v uint64) {
+	pb.key(field, wireVarint)
+	pb.uvarint(v)
+}
+
+func (pb *protobuf) bytes(field int, b []byte) {
+	pb.key(field, wireBytes)
+	pb.uvarint(uint64(len(b)))
+	pb.buf = append(pb.buf, b...)
+}
+
+func (pb *protobuf) packed(field int, values []uint64) {
+	var payload protobuf
+	for _, v := range values {
+		payload.uvarint(v)
+	}
+	pb.bytes(field, payload.buf)
+}
+
+func (pb *protobuf) message(field int, msg *protobuf) {
+	pb.bytes(field, msg.buf)
+}
@@ -0,0 +1,283 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+// Profile counts the instructions executed by a vm, pass it in
+// Options.Profile. Every instruction is counted against its opcode, its
+// address and the function executing it. Functions are identified by
+// their address, the entry point standing in for the top level program.
+type Profile struct {
+	Instructions int64                   // total executed
+	Opcodes      map[int]int64           // opcode -> instructions
+	PCs          map[int]int64           // code address -> instructions
+	Calls        map[int]int64           // CALL target -> calls
+	Functions    map[int]*FunctionCounts // function address -> counts
+
+	owners  map[int]int      // code address -> function first seen executing it
+	stacks  []callStack      // call stacks seen, 0 is unset
+	ids     map[callSite]int // call stack index by caller and call site
+	samples map[sample]int64 // call stack and address -> instructions
+}
+
+// FunctionCounts are the instructions executed by a function itself
+// (exclusive) and including the functions it calls (inclusive). A
+// recursive function counts each instruction once.
+type FunctionCounts struct {
+	Exclusive int64
+	Inclusive int64
+}
+
+// callStack is a distinct stack of calls. Each frame keeps the index of
+// its stack, set by CALL, so record counts an instruction without walking
+// the frames.
+type callStack struct {
+	callSite
+	fn  *FunctionCounts   // the function called
+	fns []*FunctionCounts // every function on the stack, once
+}
+
+// callSite identifies a call stack by its caller's stack and the address
+// of the CALL, the bottom frame of a thread has no caller or call site
+type callSite struct {
+	parent, addr, fn int
+}
+
+type sample struct {
+	stack, pc int
+}
+
+// NewProfile returns an empty profile
+func NewProfile() *Profile {
+	return &Profile{
+		Opcodes:   map[int]int64{},
+		PCs:       map[int]int64{},
+		Calls:     map[int]int64{},
+		Functions: map[int]*FunctionCounts{},
+		owners:    map[int]int{},
+		stacks:    []callStack{{}},
+		ids:       map[callSite]int{},
+		samples:   map[sample]int64{},
+	}
+}
+
+// record counts the instruction at machine.ip
+func (p *Profile) record(machine *vm, code int) {
+	p.Instructions++
+	p.Opcodes[code]++
+	p.PCs[machine.ip]++
+
+	if code == CALL && machine.ip+1 < len(machine.code) {
+		p.Calls[machine.code[machine.ip+1]]++
+	}
+
+	top := &machine.frames[len(machine.frames)-1]
+	if top.stack == 0 {
+		// a bottom frame, the frames above it are pushed by CALL
+		top.stack = p.push(0, -1, top.fn)
+	}
+	if _, ok := p.owners[machine.ip]; !ok {
+		p.owners[machine.ip] = top.fn
+	}
+	stack := &p.stacks[top.stack]
+	stack.fn.Exclusive++
+	for _, fn := range stack.fns {
+		fn.Inclusive++
+	}
+	p.samples[sample{top.stack, machine.ip}]++
+}
+
+// push returns the call stack of a call to fn from addr in the caller's
+// stack, adding it when it is first seen
+func (p *Profile) push(caller, addr, fn int) int {
+	site := callSite{caller, addr, fn}
+	if id, ok := p.ids[site]; ok {
+		return id
+	}
+
+	callee := p.function(fn)
+	fns := p.stacks[caller].fns
+	if !containsFunction(fns, callee) {
+		fns = append(fns[:len(fns):len(fns)], callee)
+	}
+	id := len(p.stacks)
+	p.stacks = append(p.stacks, callStack{site, callee, fns})
+	p.ids[site] = id
+	return id
+}
+
+func containsFunction(fns []*FunctionCounts, fn *FunctionCounts) bool {
+	for _, f := range fns {
+		if f == fn {
+			return true
+		}
+	}
+	return false
+}
+
+// stackCounts returns the instructions per call stack, keyed by the stack
+// innermost first: the instruction then each call site
+func (p *Profile) stackCounts() map[string]int64 {
+	counts := map[string]int64{}
+	var key []byte
+	for s, n := range p.samples {
+		key = appendAddr(key[:0], s.pc)
+		for id := s.stack; p.stacks[id].parent != 0; id = p.stacks[id].parent {
+			key = appendAddr(key, p.stacks[id].addr)
+		}
+		counts[string(key)] += n
+	}
+	return counts
+}
+
+func (p *Profile) function(addr int) *FunctionCounts {
+	fn, ok := p.Functions[addr]
+	if !ok {
+		fn = &FunctionCounts{}
+		p.Functions[addr] = fn
+	}
+	return fn
+}
+
+func appendAddr(key []byte, addr int) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(key, buf[:binary.PutVarint(buf[:], int64(addr))]...)
+}
+
+// decodeStack is the inverse of the keys built by stackCounts
+func decodeStack(key string) []int {
+	var addrs []int
+	b := []byte(key)
+	for len(b) > 0 {
+		addr, n := binary.Varint(b)
+		addrs = append(addrs, int(addr))
+		b = b[n:]
+	}
+	return addrs
+}
+
+// symbols names the functions of a profiled module
+type symbols struct {
+	names map[int]string
+	entry int
+}
+
+func newSymbols(m *Module) symbols {
+	s := symbols{names: map[int]string{}, entry: -1}
+	if m == nil {
+		return s
+	}
+	s.entry = m.Entry
+
+	// the first name in sort order for addresses with several labels
+	names := make([]string, 0, len(m.Symbols))
+	for name := range m.Symbols {
+		names = append(names, name)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	for _, name := range names {
+		s.names[m.Symbols[name]] = name
+	}
+	return s
+}
+
+func (s symbols) name(addr int) string {
+	if name, ok := s.names[addr]; ok {
+		return name
+	}
+	if addr == s.entry {
+		return "main"
+	}
+	return fmt.Sprintf("func@%d", addr)
+}
+
+// hotSpots is the number of addresses listed by WriteReport
+const hotSpots = 10
+
+// WriteReport writes a text summary: instructions per function, per opcode
+// and the busiest addresses. The module, which may be nil, provides
+// function names and source lines.
+func (p *Profile) WriteReport(w io.Writer, m *Module) error {
+	syms := newSymbols(m)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+
+	fmt.Fprintf(tw, "%d instructions\n\n", p.Instructions)
+
+	fmt.Fprintf(tw, "inclusive\t%%\texclusive\t%%\tcalls\t function\n")
+	fns := make([]int, 0, len(p.Functions))
+	for addr := range p.Functions {
+		fns = append(fns, addr)
+	}
+	sort.Slice(fns, func(i, j int) bool {
+		a, b := p.Functions[fns[i]], p.Functions[fns[j]]
+		if a.Inclusive != b.Inclusive {
+			return a.Inclusive > b.Inclusive
+		}
+		return fns[i] < fns[j]
+	})
+	for _, addr := range fns {
+		fn := p.Functions[addr]
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%s\t%d\t %s\n", fn.Inclusive, p.percent(fn.Inclusive),
+			fn.Exclusive, p.percent(fn.Exclusive), p.Calls[addr], syms.name(addr))
+	}
+
+	fmt.Fprintf(tw, "\ncount\t%%\t opcode\n")
+	for _, code := range sortedByCount(p.Opcodes) {
+		name := fmt.Sprintf("opcode(%d)", code)
+		if op, ok := LookupOpcode(code); ok {
+			name = op.Name
+		}
+		fmt.Fprintf(tw, "%d\t%s\t %s\n", p.Opcodes[code], p.percent(p.Opcodes[code]), name)
+	}
+
+	fmt.Fprintf(tw, "\ncount\t%%\taddress\t function\n")
+	pcs := sortedByCount(p.PCs)
+	if len(pcs) > hotSpots {
+		pcs = pcs[:hotSpots]
+	}
+	for _, pc := range pcs {
+		where := syms.name(p.owners[pc])
+		if line, ok := m.line(pc); ok {
+			where = fmt.Sprintf("%s %s:%d", where, m.Source, line)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%04d\t %s\n", p.PCs[pc], p.percent(p.PCs[pc]), pc, where)
+	}
+
+	return tw.Flush()
+}
+
+func (p *Profile) percent(n int64) string {
+	if p.Instructions == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(p.Instructions))
+}
+
+// line is the source line of an address, if the module has one
+func (m *Module) line(addr int) (int, bool) {
+	if m == nil {
+		return 0, false
+	}
+	line, ok := m.Lines[addr]
+	return line, ok
+}
+
+// sortedByCount returns the keys of counts, highest count first
+func sortedByCount(counts map[int]int64) []int {
+	keys := make([]int, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
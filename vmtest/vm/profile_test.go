@@ -0,0 +1,152 @@
+package vm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// profileFibonacci runs fib(10) with profiling
+func profileFibonacci(t *testing.T) (*Profile, *Module) {
+	code := append([]int(nil), fibonacci...)
+	code[fibMain+1] = 10
+
+	m := &Module{Entry: fibMain, Code: code, Symbols: map[string]int{"fib": fib}}
+	profile := NewProfile()
+	if err := NewFromModule(m, Options{Stdout: ioutil.Discard, Profile: profile}).Run(); err != nil {
+		t.Fatal(err)
+	}
+	return profile, m
+}
+
+func TestProfileCounts(t *testing.T) {
+	profile, _ := profileFibonacci(t)
+
+	// fib(10) calls itself 2*fib(10)-1 times in total
+	if calls := profile.Calls[fib]; calls != 109 {
+		t.Errorf("Expected 109 calls to fib, got %d", calls)
+	}
+
+	var opcodes, pcs, exclusive int64
+	for _, n := range profile.Opcodes {
+		opcodes += n
+	}
+	for _, n := range profile.PCs {
+		pcs += n
+	}
+	for _, fn := range profile.Functions {
+		exclusive += fn.Exclusive
+	}
+	if opcodes != profile.Instructions || pcs != profile.Instructions || exclusive != profile.Instructions {
+		t.Errorf("Expected opcodes %d, pcs %d and exclusive %d to add up to %d instructions", opcodes, pcs, exclusive, profile.Instructions)
+	}
+
+	// recursion is counted once and main only calls fib
+	main, fn := profile.Functions[fibMain], profile.Functions[fib]
+	if fn.Inclusive != fn.Exclusive {
+		t.Errorf("Expected fib inclusive %d to equal exclusive %d", fn.Inclusive, fn.Exclusive)
+	}
+	if main.Inclusive != profile.Instructions || main.Exclusive != 4 {
+		t.Errorf("Expected main inclusive %d and exclusive 4, got %+v", profile.Instructions, *main)
+	}
+
+	if profile.Opcodes[CALL] != 109 || profile.Opcodes[RET] != 109 || profile.Opcodes[HALT] != 1 {
+		t.Errorf("Unexpected opcode counts %v", profile.Opcodes)
+	}
+}
+
+func TestProfileReport(t *testing.T) {
+	profile, m := profileFibonacci(t)
+
+	var out bytes.Buffer
+	if err := profile.WriteReport(&out, m); err != nil {
+		t.Fatal(err)
+	}
+
+	report := out.String()
+	for _, expected := range []string{"instructions", " main", " fib", " CALL", "0000"} {
+		if !strings.Contains(report, expected) {
+			t.Errorf("Expected %q in report:\n%s", expected, report)
+		}
+	}
+}
+
+// field is a decoded protocol buffer field, value for varints and data
+// for length delimited fields
+type field struct {
+	num   int
+	value uint64
+	data  []byte
+}
+
+func decodeFields(t *testing.T, b []byte) []field {
+	var fields []field
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		b = b[n:]
+		f := field{num: int(key >> 3)}
+		switch key & 7 {
+		case wireVarint:
+			f.value, n = binary.Uvarint(b)
+			b = b[n:]
+		case wireBytes:
+			length, n := binary.Uvarint(b)
+			f.data = b[n : n+int(length)]
+			b = b[n+int(length):]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func TestProfilePprof(t *testing.T) {
+	profile, m := profileFibonacci(t)
+
+	var out bytes.Buffer
+	if err := profile.WritePprof(&out, m); err != nil {
+		t.Fatal(err)
+	}
+
+	gz, err := gzip.NewReader(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var total uint64
+	var table []string
+	functions := 0
+	for _, f := range decodeFields(t, data) {
+		switch f.num {
+		case 2: // sample
+			for _, sf := range decodeFields(t, f.data) {
+				if sf.num == 2 {
+					value, _ := binary.Uvarint(sf.data)
+					total += value
+				}
+			}
+		case 5: // function
+			functions++
+		case 6: // string table
+			table = append(table, string(f.data))
+		}
+	}
+
+	if total != uint64(profile.Instructions) {
+		t.Errorf("Expected samples to add up to %d instructions, got %d", profile.Instructions, total)
+	}
+	if functions != 2 {
+		t.Errorf("Expected 2 functions, got %d", functions)
+	}
+	if len(table) == 0 || table[0] != "" || !strings.Contains(strings.Join(table, " "), "fib") {
+		t.Errorf("Unexpected string table %q", table)
+	}
+}
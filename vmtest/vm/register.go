@@ -0,0 +1,403 @@
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A register machine running the same programs as the stack machine, to
+// compare the two designs. Translate turns verified stack bytecode into
+// three-address instructions over a fixed register file.
+//
+// Each function gets a window of registers starting at its base: first the
+// local slots, then one register per stack position, then a scratch
+// register. A CALL passes the arguments where the caller computed them,
+// the callee's window starts at the first argument, and RET leaves the
+// result in the callee's register 0, which is where the caller expects it.
+
+// Register instructions. Those with a stack counterpart keep its opcode:
+// a = b op c for binary instructions and a = op b for unary ones, faulting
+// as the stack machine does. The others have their own opcodes.
+const (
+	rMove   = 100 + iota // a = b
+	rConst               // a = constant b
+	rGLoad               // a = global b
+	rGLoadR              // a = global at the address in register b
+	rGStore              // global a = b
+	rJmp                 // jump to a
+	rJmpT                // jump to a if b is true
+	rJmpF                // jump to a if b is false
+	rCall                // call a, the callee's window starts at b and has c registers
+	rRet                 // return a
+	rEnter               // zero b registers from a
+	rPrint               // print a
+	rRead                // a = integer read from input
+	rHalt                // stop
+)
+
+var registerNames = map[int]string{
+	rMove:   "MOVE",
+	rConst:  "CONST",
+	rGLoad:  "GLOAD",
+	rGLoadR: "GLOAD_R",
+	rGStore: "GSTORE",
+	rJmp:    "JMP",
+	rJmpT:   "JMPT",
+	rJmpF:   "JMPF",
+	rCall:   "CALL",
+	rRet:    "RET",
+	rEnter:  "ENTER",
+	rPrint:  "PRINT",
+	rRead:   "READ",
+	rHalt:   "HALT",
+}
+
+// rinstr is a register instruction, registers are relative to the base of
+// the current window
+type rinstr struct {
+	op      int
+	a, b, c int
+}
+
+// RegisterProgram is stack bytecode translated for the register machine
+type RegisterProgram struct {
+	code     []rinstr
+	addrs    []int   // stack bytecode address of each instruction, for faults
+	consts   []Value // constants loaded by rConst
+	entry    int     // first instruction of the entry point
+	frame    int     // registers of the entry point's window
+	dataSize int
+}
+
+// Len returns the number of instructions
+func (p *RegisterProgram) Len() int {
+	return len(p.code)
+}
+
+// String lists the instructions, one per line, with the stack bytecode
+// address they were translated from
+func (p *RegisterProgram) String() string {
+	var out bytes.Buffer
+	for pc, in := range p.code {
+		name, ok := registerNames[in.op]
+		if !ok {
+			name = Opcodes[in.op].Name
+		}
+		fmt.Fprintf(&out, "%4d  %-8s %d %d %d\t; %d\n", pc, name, in.a, in.b, in.c, p.addrs[pc])
+	}
+	return out.String()
+}
+
+type rframe struct {
+	ret  int // return address
+	base int // caller's base
+}
+
+type registerMachine struct {
+	prog       *RegisterProgram
+	regs       []Value
+	globals    []Value
+	frames     []rframe // active calls, the entry point has none
+	stackFault FaultKind
+
+	stdout io.Writer
+	stdin  *bufio.Reader
+}
+
+// NewRegisterMachine prepares a translated program to run. Of the options
+// only Stdout, Stdin and MaxStackDepth, which sizes the register file, are
+// used. A function needs its whole window of registers from the start, so
+// a deep recursion can run out of registers slightly earlier than it runs
+// out of stack on the stack machine.
+func NewRegisterMachine(p *RegisterProgram, opts Options) *registerMachine {
+	if opts.Stdout == nil {
+		opts.Stdout = os.Stdout
+	}
+	if opts.Stdin == nil {
+		opts.Stdin = os.Stdin
+	}
+
+	size, stackFault := STACK_SIZE, StackOverflow
+	if opts.MaxStackDepth > 0 {
+		size, stackFault = opts.MaxStackDepth, StackLimit
+	}
+
+	return &registerMachine{
+		prog:       p,
+		regs:       make([]Value, size),
+		globals:    make([]Value, p.dataSize),
+		stackFault: stackFault,
+		stdout:     opts.Stdout,
+		stdin:      bufio.NewReader(opts.Stdin),
+	}
+}
+
+// Globals returns a copy of global memory
+func (machine *registerMachine) Globals() []Value {
+	globals := make([]Value, len(machine.globals))
+	copy(globals, machine.globals)
+	return globals
+}
+
+// fault aborts the instruction at pc, see vm.fault
+func (machine *registerMachine) fault(pc int, kind FaultKind, format string, args ...interface{}) {
+	panic(&Fault{Kind: kind, PC: machine.prog.addrs[pc], Detail: fmt.Sprintf(format, args...)})
+}
+
+// raise faults with the fault of an operation, see vm.raise
+func (machine *registerMachine) raise(pc int, f *opFault) {
+	machine.fault(pc, f.kind, "%s", f.detail)
+}
+
+// typeError faults on the first of the operands that is not of kind,
+// checking the right hand side first as the stack machine pops it first
+func (machine *registerMachine) typeError(pc int, kind Kind, x, y Value) {
+	value := y
+	if y.Kind == kind {
+		value = x
+	}
+	machine.fault(pc, TypeError, "expected %s, got %s %v", kind, value.Kind, value)
+}
+
+// Run executes the program until HALT. Runtime errors stop execution and
+// are returned as a *Fault with the address of the stack instruction the
+// faulting one was translated from. Faults carry no stack.
+func (machine *registerMachine) Run() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fault, ok := r.(*Fault)
+			if !ok {
+				panic(r)
+			}
+			err = fault
+		}
+	}()
+
+	p := machine.prog
+	code, consts, regs, globals := p.code, p.consts, machine.regs, machine.globals
+	pc, base := p.entry, 0
+	if p.frame > len(regs) {
+		machine.fault(pc, machine.stackFault, "stack size %d", len(regs))
+	}
+
+	for {
+		in := &code[pc]
+		pc++
+
+		switch in.op {
+		case rMove:
+			regs[base+in.a] = regs[base+in.b]
+		case rConst:
+			regs[base+in.a] = consts[in.b]
+		case ADD_I32:
+			x, y := regs[base+in.b], regs[base+in.c]
+			if x.Kind|y.Kind != KindInt {
+				machine.typeError(pc-1, KindInt, x, y)
+			}
+			regs[base+in.a] = Value{KindInt, x.bits + y.bits}
+		case SUB_I32:
+			x, y := regs[base+in.b], regs[base+in.c]
+			if x.Kind|y.Kind != KindInt {
+				machine.typeError(pc-1, KindInt, x, y)
+			}
+			regs[base+in.a] = Value{KindInt, x.bits - y.bits}
+		case MUL_I32:
+			x, y := regs[base+in.b], regs[base+in.c]
+			if x.Kind|y.Kind != KindInt {
+				machine.typeError(pc-1, KindInt, x, y)
+			}
+			regs[base+in.a] = Int(x.AsInt() * y.AsInt())
+		case DIV_I32:
+			x, y := regs[base+in.b], regs[base+in.c]
+			if x.Kind|y.Kind != KindInt {
+				machine.typeError(pc-1, KindInt, x, y)
+			}
+			value, f := divInt(x.AsInt(), y.AsInt())
+			if f != nil {
+				machine.raise(pc-1, f)
+			}
+			regs[base+in.a] = Int(value)
+		case MOD_I32:
+			x, y := regs[base+in.b], regs[base+in.c]
+			if x.Kind|y.Kind != KindInt {
+				machine.typeError(pc-1, KindInt, x, y)
+			}
+			value, f := modInt(x.AsInt(), y.AsInt())
+			if f != nil {
+				machine.raise(pc-1, f)
+			}
+			regs[base+in.a] = Int(value)
+		case SHL_I32:
+			x, y := regs[base+in.b], regs[base+in.c]
+			if x.Kind|y.Kind != KindInt {
+				machine.typeError(pc-1, KindInt, x, y)
+			}
+			regs[base+in.a] = Int(shiftLeft(x.AsInt(), y.AsInt()))
+		case SHR_I32:
+			x, y := regs[base+in.b], regs[base+in.c]
+			if x.Kind|y.Kind != KindInt {
+				machine.typeError(pc-1, KindInt, x, y)
+			}
+			regs[base+in.a] = Int(shiftRight(x.AsInt(), y.AsInt()))
+		case LT_I32:
+			x, y := regs[base+in.b], regs[base+in.c]
+			if x.Kind|y.Kind != KindInt {
+				machine.typeError(pc-1, KindInt, x, y)
+			}
+			regs[base+in.a] = Bool(x.AsInt() < y.AsInt())
+		case GT_I32:
+			x, y := regs[base+in.b], regs[base+in.c]
+			if x.Kind|y.Kind != KindInt {
+				machine.typeError(pc-1, KindInt, x, y)
+			}
+			regs[base+in.a] = Bool(x.AsInt() > y.AsInt())
+		case LE_I32:
+			x, y := regs[base+in.b], regs[base+in.c]
+			if x.Kind|y.Kind != KindInt {
+				machine.typeError(pc-1, KindInt, x, y)
+			}
+			regs[base+in.a] = Bool(x.AsInt() <= y.AsInt())
+		case GE_I32:
+			x, y := regs[base+in.b], regs[base+in.c]
+			if x.Kind|y.Kind != KindInt {
+				machine.typeError(pc-1, KindInt, x, y)
+			}
+			regs[base+in.a] = Bool(x.AsInt() >= y.AsInt())
+		case EQ_I32:
+			x, y := regs[base+in.b], regs[base+in.c]
+			if x.Kind|y.Kind != KindInt {
+				machine.typeError(pc-1, KindInt, x, y)
+			}
+			regs[base+in.a] = Bool(x.bits == y.bits)
+		case NE_I32:
+			x, y := regs[base+in.b], regs[base+in.c]
+			if x.Kind|y.Kind != KindInt {
+				machine.typeError(pc-1, KindInt, x, y)
+			}
+			regs[base+in.a] = Bool(x.bits != y.bits)
+		case NEG_I32:
+			x := regs[base+in.b]
+			if x.Kind != KindInt {
+				machine.typeError(pc-1, KindInt, x, x)
+			}
+			regs[base+in.a] = Int(-x.AsInt())
+		case AND_I32, OR_I32, XOR_I32:
+			value, f := logical(in.op, regs[base+in.b], regs[base+in.c])
+			if f != nil {
+				machine.raise(pc-1, f)
+			}
+			regs[base+in.a] = value
+		case NOT_I32:
+			value, f := not(regs[base+in.b])
+			if f != nil {
+				machine.raise(pc-1, f)
+			}
+			regs[base+in.a] = value
+		case ADD_F64, SUB_F64, MUL_F64, DIV_F64:
+			x, y := regs[base+in.b], regs[base+in.c]
+			if x.Kind != KindFloat || y.Kind != KindFloat {
+				machine.typeError(pc-1, KindFloat, x, y)
+			}
+			a, b := x.AsFloat(), y.AsFloat()
+			switch in.op {
+			case ADD_F64:
+				a += b
+			case SUB_F64:
+				a -= b
+			case MUL_F64:
+				a *= b
+			default:
+				a /= b
+			}
+			regs[base+in.a] = Float(a)
+		case LT_F64, GT_F64, LE_F64, GE_F64, EQ_F64, NE_F64:
+			x, y := regs[base+in.b], regs[base+in.c]
+			if x.Kind != KindFloat || y.Kind != KindFloat {
+				machine.typeError(pc-1, KindFloat, x, y)
+			}
+			regs[base+in.a] = Bool(compareFloat(in.op, x.AsFloat(), y.AsFloat()))
+		case NEG_F64:
+			x := regs[base+in.b]
+			if x.Kind != KindFloat {
+				machine.typeError(pc-1, KindFloat, x, x)
+			}
+			regs[base+in.a] = Float(-x.AsFloat())
+		case I2F:
+			x := regs[base+in.b]
+			if x.Kind != KindInt {
+				machine.typeError(pc-1, KindInt, x, x)
+			}
+			regs[base+in.a] = Float(float64(x.AsInt()))
+		case F2I:
+			x := regs[base+in.b]
+			if x.Kind != KindFloat {
+				machine.typeError(pc-1, KindFloat, x, x)
+			}
+			value, f := f2i(x.AsFloat())
+			if f != nil {
+				machine.raise(pc-1, f)
+			}
+			regs[base+in.a] = Int(value)
+		case rGLoad:
+			if uint(in.b) >= uint(len(globals)) {
+				machine.fault(pc-1, BadAddress, "global address %d, data size %d", in.b, len(globals))
+			}
+			regs[base+in.a] = globals[in.b]
+		case rGLoadR:
+			x := regs[base+in.b]
+			if x.Kind != KindInt {
+				machine.typeError(pc-1, KindInt, x, x)
+			}
+			if x.bits >= uint64(len(globals)) {
+				machine.fault(pc-1, BadAddress, "global address %d, data size %d", x.AsInt(), len(globals))
+			}
+			regs[base+in.a] = globals[x.bits]
+		case rGStore:
+			globals[in.a] = regs[base+in.b] // checked by the verifier
+		case rJmp:
+			pc = in.a
+		case rJmpT, rJmpF:
+			x := regs[base+in.b]
+			if x.Kind != KindBool {
+				machine.typeError(pc-1, KindBool, x, x)
+			}
+			if (x.bits != 0) == (in.op == rJmpT) {
+				pc = in.a
+			}
+		case rCall:
+			if len(machine.frames)+1 >= MAX_CALL_DEPTH {
+				machine.fault(pc-1, StackOverflow, "call depth %d", len(machine.frames)+1)
+			}
+			callee := base + in.b
+			if callee+in.c > len(regs) {
+				machine.fault(pc-1, machine.stackFault, "stack size %d", len(regs))
+			}
+			machine.frames = append(machine.frames, rframe{ret: pc, base: base})
+			pc, base = in.a, callee
+		case rRet:
+			f := machine.frames[len(machine.frames)-1]
+			machine.frames = machine.frames[:len(machine.frames)-1]
+			regs[base] = regs[base+in.a]
+			pc, base = f.ret, f.base
+		case rEnter:
+			for i := base + in.a; i < base+in.a+in.b; i++ {
+				regs[i] = Value{}
+			}
+		case rPrint:
+			fmt.Fprintln(machine.stdout, regs[base+in.a].String())
+		case rRead:
+			var value int64
+			if _, err := fmt.Fscan(machine.stdin, &value); err != nil {
+				machine.fault(pc-1, InputError, "%v", err)
+			}
+			regs[base+in.a] = Int(value)
+		case rHalt:
+			return nil
+		default:
+			machine.fault(pc-1, BadOpcode, "register opcode %d", in.op)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegisterStackOverflow(t *testing.T) {
+	// the register machine runs out of registers at a CALL rather than at
+	// a push, so only the kind of fault is the same
+	p, err := Translate(&Module{Code: []int{
+		LOAD, 0, CONST_I32, 1, ADD_I32, CALL, 0, 1, RET, // 0 - never returns
+		CONST_I32, 0, CALL, 0, 1, HALT, // 9
+	}, Entry: 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fault, ok := NewRegisterMachine(p, Options{}).Run().(*Fault); !ok || fault.Kind != StackOverflow {
+		t.Errorf("Expected a stack overflow, got %v", fault)
+	}
+	if fault, ok := NewRegisterMachine(p, Options{MaxStackDepth: 10}).Run().(*Fault); !ok || fault.Kind != StackLimit {
+		t.Errorf("Expected the stack limit, got %v", fault)
+	}
+}
+
+func TestRegisterFusesOperands(t *testing.T) {
+	// sum += i, i++ is two instructions, the loads and constants are read
+	// in place
+	p, err := Translate(&Module{Code: []int{
+		ENTER, 2,
+		LOAD, 1, LOAD, 0, ADD_I32, STORE, 1,
+		LOAD, 0, CONST_I32, 1, ADD_I32, STORE, 0,
+		HALT,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// halt at the end of the code, ENTER, 2 adds, 1 constant, 2 moves, HALT
+	if p.Len() != 8 {
+		t.Errorf("Expected 8 instructions, got\n%s", p)
+	}
+}
+
+func TestTranslateUnsupported(t *testing.T) {
+	tests := []struct {
+		name     string
+		m        *Module
+		expected string
+	}{
+		{"strings", &Module{Code: []int{CONST_STR, 0, PRINT, HALT}, Consts: []string{"s"}}, "CONST_STR at 0 is not supported"},
+		{"exceptions", &Module{Code: []int{TRY, 4, END_TRY, HALT, PRINT, HALT}}, "TRY at 0 is not supported"},
+		{"unverified", &Module{Code: []int{ADD_I32, HALT}}, "does not verify"},
+		{"called entry", &Module{Code: []int{CONST_I32, 1, CALL, 0, 1, HALT}}, "CALL at 2 of the entry point"},
+	}
+
+	for _, test := range tests {
+		if _, err := Translate(test.m); err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected %q, got %v", test.name, test.expected, err)
+		}
+	}
+}
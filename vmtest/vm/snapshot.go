@@ -0,0 +1,292 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Snapshot format. Like modules, all integers after the magic are varints
+// and strings are a length followed by the bytes. The fields follow each
+// other without sections, a change to the layout bumps SnapshotVersion.
+//
+//	magic     "VSNP"
+//	version   uvarint, SnapshotVersion
+//	code      uvarint count, varint per word
+//	consts    uvarint count, string per constant
+//	natives   uvarint count, string per native function name
+//	registers varint pc, ip, sp, fp, uvarint halted, varint executed
+//	globals   uvarint count, value per global
+//	stack     uvarint count, value per stack slot from the bottom
+//	frames    uvarint count, (varint ret, base, size, fn) per frame
+//	handlers  uvarint count, (varint catch, frames, sp) per TRY handler
+//	heap      uvarint count, per slot: uvarint kind, then a string for
+//	          strings, uvarint count and values for arrays, nothing for
+//	          a free slot (kind 255)
+//
+// A value is a uvarint kind followed by its payload bits as a uvarint.
+
+const SnapshotVersion = 1
+
+var snapshotMagic = []byte("VSNP")
+
+// freeSlot marks an unused heap slot in a snapshot
+const freeSlot = 255
+
+var ErrNotSnapshot = errors.New("vm: not a snapshot")
+
+// Snapshot serializes the machine state: the program, registers, globals,
+// stack, call frames, exception handlers and heap. Take it between
+// instructions, e.g. after Step or after RunContext was canceled, and
+// continue with Restore and Run in this or another process. Native
+// functions are recorded by name only and have to be registered again.
+// Options, the garbage collector statistics and the profile are not part
+// of the snapshot. Programs that have used threads or channels can not be
+// snapshotted.
+func (machine *vm) Snapshot() ([]byte, error) {
+	if machine.current != nil {
+		return nil, errors.New("vm: snapshot of a program using threads or channels is not supported")
+	}
+
+	var out bytes.Buffer
+	out.Write(snapshotMagic)
+	putUvarint(&out, SnapshotVersion)
+
+	putUvarint(&out, uint64(len(machine.code)))
+	for _, word := range machine.code {
+		putVarint(&out, int64(word))
+	}
+	putUvarint(&out, uint64(len(machine.consts)))
+	for _, c := range machine.consts {
+		putString(&out, c)
+	}
+	putUvarint(&out, uint64(len(machine.natives)))
+	for _, n := range machine.natives {
+		putString(&out, n.name)
+	}
+
+	putVarint(&out, int64(machine.pc))
+	putVarint(&out, int64(machine.ip))
+	putVarint(&out, int64(machine.sp))
+	putVarint(&out, int64(machine.fp))
+	if machine.halted {
+		putUvarint(&out, 1)
+	} else {
+		putUvarint(&out, 0)
+	}
+	putVarint(&out, machine.executed)
+
+	putValues(&out, machine.locals)
+	putValues(&out, machine.stack[:machine.sp+1])
+
+	putUvarint(&out, uint64(len(machine.frames)))
+	for _, f := range machine.frames {
+		putVarint(&out, int64(f.ret))
+		putVarint(&out, int64(f.base))
+		putVarint(&out, int64(f.size))
+		putVarint(&out, int64(f.fn))
+	}
+
+	putUvarint(&out, uint64(len(machine.handlers)))
+	for _, h := range machine.handlers {
+		putVarint(&out, int64(h.catch))
+		putVarint(&out, int64(h.frames))
+		putVarint(&out, int64(h.sp))
+	}
+
+	putUvarint(&out, uint64(len(machine.heap)))
+	for _, obj := range machine.heap {
+		switch {
+		case obj == nil:
+			putUvarint(&out, freeSlot)
+		case obj.kind == KindString:
+			putUvarint(&out, uint64(KindString))
+			putString(&out, obj.str)
+		default:
+			putUvarint(&out, uint64(KindArray))
+			putValues(&out, obj.array)
+		}
+	}
+
+	return out.Bytes(), nil
+}
+
+// Restore replaces the machine state with a snapshot taken by Snapshot,
+// keeping the options the machine was created with. Natives registered
+// under a name the snapshot records stay registered. The snapshot is
+// checked before anything is changed, on error the machine is untouched.
+// A compiled program is discarded, call Compile again to compile the
+// restored one.
+func (machine *vm) Restore(snapshot []byte) error {
+	if !bytes.HasPrefix(snapshot, snapshotMagic) {
+		return ErrNotSnapshot
+	}
+	r := bytes.NewReader(snapshot[len(snapshotMagic):])
+	d := &decoder{r: r}
+	if version := d.uvarint(); d.err == nil && version != SnapshotVersion {
+		return fmt.Errorf("vm: unsupported snapshot version %d, expected %d", version, SnapshotVersion)
+	}
+
+	code := make([]int, d.count())
+	for i := range code {
+		code[i] = d.int()
+	}
+	consts := make([]string, d.count())
+	for i := range consts {
+		consts[i] = d.string()
+	}
+	natives := make([]native, d.count())
+	for i := range natives {
+		natives[i].name = d.string()
+		if index, ok := machine.NativeIndex(natives[i].name); ok {
+			natives[i].argc = machine.natives[index].argc
+			natives[i].fn = machine.natives[index].fn
+		}
+	}
+
+	pc, ip, sp, fp := d.int(), d.int(), d.int(), d.int()
+	halted := d.uvarint() != 0
+	executed := int64(d.int())
+
+	globals := d.values()
+	stack := d.values()
+
+	frames := make([]frame, d.countOf(4))
+	for i := range frames {
+		frames[i] = frame{ret: d.int(), base: d.int(), size: d.int(), fn: d.int()}
+	}
+
+	handlers := make([]handler, d.countOf(3))
+	for i := range handlers {
+		handlers[i] = handler{catch: d.int(), frames: d.int(), sp: d.int()}
+	}
+
+	heap := make([]*object, d.count())
+	for i := range heap {
+		switch kind := d.uvarint(); kind {
+		case freeSlot:
+		case uint64(KindString):
+			heap[i] = &object{kind: KindString, str: d.string()}
+		case uint64(KindArray):
+			heap[i] = &object{kind: KindArray, array: d.values()}
+		default:
+			if d.err == nil {
+				d.err = fmt.Errorf("heap slot %d has kind %d", i, kind)
+			}
+		}
+	}
+
+	if d.err == nil && r.Len() > 0 {
+		d.err = fmt.Errorf("%d trailing bytes", r.Len())
+	}
+	if d.err != nil {
+		if d.err == io.EOF {
+			d.err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("vm: corrupt snapshot: %v", d.err)
+	}
+
+	// the registers and frames must fit this machine's stack and every
+	// reference must point at a live object of its kind
+	switch {
+	case pc < 0 || pc > len(code) || ip < 0 || ip > len(code):
+		return fmt.Errorf("vm: corrupt snapshot: pc %d, ip %d, code size %d", pc, ip, len(code))
+	case len(stack) > len(machine.stack):
+		return fmt.Errorf("vm: snapshot stack of %d values does not fit a stack of %d", len(stack), len(machine.stack))
+	case sp != len(stack)-1:
+		return fmt.Errorf("vm: corrupt snapshot: sp %d with %d stack values", sp, len(stack))
+	case len(frames) == 0 || fp != frames[len(frames)-1].base:
+		return fmt.Errorf("vm: corrupt snapshot: fp %d does not match the frames", fp)
+	}
+	for _, f := range frames {
+		if f.base < 0 || f.size < 0 || f.base+f.size > len(machine.stack) {
+			return fmt.Errorf("vm: corrupt snapshot: frame base %d, size %d", f.base, f.size)
+		}
+	}
+	for _, h := range handlers {
+		if h.catch < 0 || h.catch > len(code) || h.frames < 1 || h.frames > len(frames) || h.sp < -1 || h.sp >= len(machine.stack) {
+			return fmt.Errorf("vm: corrupt snapshot: handler at %d for %d frames, sp %d", h.catch, h.frames, h.sp)
+		}
+	}
+	check := func(values []Value) error {
+		for _, value := range values {
+			switch value.Kind {
+			case KindInt, KindFloat, KindBool:
+			case KindString, KindArray:
+				if value.bits >= uint64(len(heap)) || heap[value.bits] == nil || heap[value.bits].kind != value.Kind {
+					return fmt.Errorf("vm: corrupt snapshot: dangling %s reference %d", value.Kind, value.bits)
+				}
+			default:
+				return fmt.Errorf("vm: corrupt snapshot: value of %s", value.Kind)
+			}
+		}
+		return nil
+	}
+	if err := check(globals); err != nil {
+		return err
+	}
+	if err := check(stack); err != nil {
+		return err
+	}
+	for _, obj := range heap {
+		if obj != nil {
+			if err := check(obj.array); err != nil {
+				return err
+			}
+		}
+	}
+
+	machine.code = code
+	machine.consts = consts
+	machine.natives = natives
+	machine.pc, machine.ip, machine.sp, machine.fp = pc, ip, sp, fp
+	machine.halted = halted
+	machine.executed = executed
+	machine.locals = globals
+	for i := range machine.stack {
+		machine.stack[i] = Value{}
+	}
+	copy(machine.stack, stack)
+	machine.frames = frames
+	machine.handlers = handlers
+	machine.threads, machine.current, machine.runnable = nil, nil, nil
+	machine.threadBytes = 0
+	machine.ops = nil
+
+	machine.heap = heap
+	machine.free = nil
+	machine.heapBytes = 0
+	for i, obj := range heap {
+		if obj == nil {
+			machine.free = append(machine.free, i)
+			continue
+		}
+		machine.heapBytes += obj.size()
+	}
+	machine.nextGC = 2 * machine.heapBytes
+	if machine.nextGC < machine.gcThreshold {
+		machine.nextGC = machine.gcThreshold
+	}
+	return nil
+}
+
+func putValues(buf *bytes.Buffer, values []Value) {
+	putUvarint(buf, uint64(len(values)))
+	for _, value := range values {
+		putUvarint(buf, uint64(value.Kind))
+		putUvarint(buf, value.bits)
+	}
+}
+
+func (d *decoder) values() []Value {
+	values := make([]Value, d.countOf(2))
+	for i := range values {
+		kind := d.uvarint()
+		if kind > 255 && d.err == nil {
+			d.err = fmt.Errorf("value kind %d", kind)
+		}
+		values[i] = Value{Kind: Kind(kind), bits: d.uvarint()}
+	}
+	return values
+}
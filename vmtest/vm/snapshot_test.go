@@ -0,0 +1,201 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotFibonacci(t *testing.T) {
+	code := append([]int(nil), fibonacci...)
+	code[fibMain+1] = 15
+
+	var expected bytes.Buffer
+	full := New(code, fibMain, 0, Options{Stdout: &expected})
+	if err := full.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// halt halfway through, deep in the recursion
+	var out bytes.Buffer
+	machine := New(code, fibMain, 0, Options{Stdout: &out})
+	for machine.executed < full.executed/2 {
+		if err := machine.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if machine.CallDepth() == 0 {
+		t.Fatal("Expected to stop inside fib")
+	}
+
+	snapshot, err := machine.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var restoredOut bytes.Buffer
+	restored := New(nil, 0, 0, Options{Stdout: &restoredOut})
+	if err := restored.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if restored.PC() != machine.PC() || restored.CallDepth() != machine.CallDepth() {
+		t.Errorf("Expected pc %d at depth %d, got pc %d at depth %d", machine.PC(), machine.CallDepth(), restored.PC(), restored.CallDepth())
+	}
+	if err := restored.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if restoredOut.String() != expected.String() || expected.String() != "610\n" {
+		t.Errorf("Expected %q, restored machine printed %q", expected.String(), restoredOut.String())
+	}
+	if restored.executed != full.executed {
+		t.Errorf("Expected %d instructions in total, got %d", full.executed, restored.executed)
+	}
+
+	// the original carries on unaffected
+	if err := machine.Run(); err != nil || out.String() != expected.String() {
+		t.Errorf("Expected the original to print %q, got %q, %v", expected.String(), out.String(), err)
+	}
+}
+
+func TestSnapshotCanceled(t *testing.T) {
+	// count to 10000 in global 0, calling tick on every iteration
+	m := &Module{
+		Code: []int{
+			CONST_I32, 0, GSTORE, 0, // 0
+			CONST_I32, 0, GLOAD, CONST_I32, 10000, LT_I32, JMPF, 26, // 4
+			CONST_I32, 0, GLOAD, CONST_I32, 1, ADD_I32, GSTORE, 0, // 12
+			CALL_NATIVE, 0, 0, POP, // 20
+			JMP, 4, // 24
+			CONST_I32, 0, GLOAD, PRINT, HALT, // 26
+		},
+		DataSize: 1,
+		Natives:  []string{"tick"},
+	}
+	noop := func(args []Value) (Value, error) {
+		return Int(0), nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ticks := 0
+	machine := NewFromModule(m, Options{})
+	machine.RegisterNative("tick", 0, func(args []Value) (Value, error) {
+		if ticks++; ticks == 5000 {
+			cancel()
+		}
+		return Int(0), nil
+	})
+	err := machine.RunContext(ctx)
+	if fault, ok := err.(*Fault); !ok || fault.Kind != Canceled {
+		t.Fatalf("Expected the run to be canceled, got %v", err)
+	}
+
+	snapshot, err := machine.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	restored := New(nil, 0, 0, Options{Stdout: &out})
+	restored.RegisterNative("tick", 0, noop)
+	if err := restored.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "10000\n" {
+		t.Errorf("Expected 10000, got %q", out.String())
+	}
+
+	// without tick registered the resumed program faults
+	unregistered := New(nil, 0, 0, Options{})
+	if err := unregistered.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if fault, ok := unregistered.Run().(*Fault); !ok || fault.Kind != BadNative {
+		t.Errorf("Expected a bad native fault, got %v", fault)
+	}
+}
+
+func TestSnapshotHeap(t *testing.T) {
+	machine := New([]int{HALT}, 0, 2, Options{})
+	array := machine.NewArray(3)
+	machine.locals[0] = array
+	machine.NewString("garbage")
+	machine.heap[array.bits].array[0] = machine.NewString("shared")
+	machine.heap[array.bits].array[1] = machine.heap[array.bits].array[0]
+	machine.heap[array.bits].array[2] = Float(1.5)
+	machine.locals[1] = machine.heap[array.bits].array[0]
+	machine.GC()
+
+	snapshot, err := machine.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := New(nil, 0, 0, Options{})
+	if err := restored.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := restored.Format(restored.locals[0]), machine.Format(array); got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if restored.locals[1] != restored.heap[restored.locals[0].bits].array[1] {
+		t.Error("Expected references to the same string to stay shared")
+	}
+	if restored.heapBytes != machine.heapBytes || len(restored.free) != len(machine.free) {
+		t.Errorf("Expected %d heap bytes and %d free slots, got %d and %d", machine.heapBytes, len(machine.free), restored.heapBytes, len(restored.free))
+	}
+}
+
+func TestSnapshotCorrupt(t *testing.T) {
+	code := append([]int(nil), fibonacci...)
+	machine := New(code, fibMain, 0, Options{})
+	for i := 0; i < 20; i++ {
+		if err := machine.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshot, err := machine.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fresh := New(nil, 0, 0, Options{})
+	if err := fresh.Restore([]byte("VMOD")); err != ErrNotSnapshot {
+		t.Errorf("Expected ErrNotSnapshot, got %v", err)
+	}
+
+	version := append([]byte("VSNP"), SnapshotVersion+1)
+	if err := fresh.Restore(version); err == nil || !strings.Contains(err.Error(), "unsupported snapshot version") {
+		t.Errorf("Expected a version error, got %v", err)
+	}
+
+	for n := len(snapshotMagic); n < len(snapshot); n++ {
+		if err := fresh.Restore(snapshot[:n]); err == nil {
+			t.Fatalf("Expected an error for a snapshot truncated to %d bytes", n)
+		}
+	}
+	// a count larger than the rest of the snapshot fails before allocating
+	var inflated bytes.Buffer
+	inflated.Write(snapshotMagic)
+	putUvarint(&inflated, SnapshotVersion)
+	putUvarint(&inflated, 1<<24)
+	inflated.Write([]byte{1, 2, 3})
+	if err := fresh.Restore(inflated.Bytes()); err == nil || !strings.Contains(err.Error(), "count 16777216 exceeds the 3 bytes left") {
+		t.Errorf("Expected a count error, got %v", err)
+	}
+	if err := fresh.Restore(append(snapshot, 0)); err == nil || !strings.Contains(err.Error(), "trailing") {
+		t.Errorf("Expected a trailing bytes error, got %v", err)
+	}
+	if fresh.pc != 0 || fresh.code != nil {
+		t.Error("Expected a failed restore to leave the machine untouched")
+	}
+
+	small := New(nil, 0, 0, Options{MaxStackDepth: 2})
+	if err := small.Restore(snapshot); err == nil || !strings.Contains(err.Error(), "does not fit") {
+		t.Errorf("Expected a stack size error, got %v", err)
+	}
+}
@@ -0,0 +1,352 @@
+package vm
+
+// Green threads and channels. The registers of the running thread live in
+// the vm exactly as for a single threaded program, switching threads saves
+// them into its thread and loads those of the next, so a program that
+// never spawns pays nothing for threads.
+//
+// Scheduling is cooperative: a thread runs until it executes YIELD, blocks
+// on a channel or returns from the function it was spawned with, then the
+// next runnable thread in line takes over. HALT in any thread stops the
+// program. When the running thread blocks and no other thread can run the
+// program faults with Deadlock.
+//
+// A thread blocked in SEND, RECV or SELECT leaves the operands on its
+// stack, which keeps them reachable for the garbage collector, and is
+// completed by the thread that performs the matching operation: that
+// thread pops the operands from the blocked thread's stack, pushes its
+// results and makes it runnable again.
+
+type thread struct {
+	id       int // 0 for the main thread
+	pc, ip   int
+	sp, fp   int
+	stack    []Value
+	frames   []frame
+	handlers []handler
+
+	blocked int // SEND, RECV or SELECT while blocked, 0 when it can run
+	resume  int // address after the blocking instruction
+	selects int // number of channels of a blocked SELECT
+
+	bytes int // size accounted in vm.threadBytes
+}
+
+// Accounted sizes of a spawned thread besides its stack, see threadSize
+const (
+	threadHeader = 128
+	frameSize    = 40
+	handlerSize  = 24
+)
+
+// threadSize is an estimate of the memory used by a spawned thread. The
+// main thread's stack is allocated with the vm and not counted.
+func threadSize(t *thread) int {
+	return threadHeader + valueSize*len(t.stack) + frameSize*cap(t.frames) + handlerSize*cap(t.handlers)
+}
+
+// account updates the size of a spawned thread against MaxHeapBytes, its
+// frames and handlers grow as it runs
+func (machine *vm) account(t *thread) {
+	size := threadSize(t)
+	if size > t.bytes {
+		machine.reserve(size-t.bytes, "allocating a thread of")
+	}
+	machine.threadBytes += size - t.bytes
+	t.bytes = size
+}
+
+// channel is the heap object behind a channel reference
+type channel struct {
+	capacity  int
+	buffer    []Value   // values sent but not yet received, oldest first
+	senders   []*thread // threads blocked in SEND, oldest first
+	receivers []*thread // threads blocked in RECV or SELECT, oldest first
+}
+
+func (ch *channel) remove(t *thread) {
+	for i, r := range ch.receivers {
+		if r == t {
+			ch.receivers = append(ch.receivers[:i], ch.receivers[i+1:]...)
+			return
+		}
+	}
+}
+
+// threaded sets up the main thread the first time a program uses threads
+// or channels
+func (machine *vm) threaded() {
+	if machine.current == nil {
+		machine.current = &thread{}
+		machine.threads = []*thread{machine.current}
+	}
+}
+
+// Threads returns the number of live threads, including the main thread
+func (machine *vm) Threads() int {
+	if machine.current == nil {
+		return 1
+	}
+	return len(machine.threads)
+}
+
+// save copies the registers into the current thread
+func (machine *vm) save() {
+	t := machine.current
+	t.pc, t.ip, t.sp, t.fp = machine.pc, machine.ip, machine.sp, machine.fp
+	t.stack, t.frames, t.handlers = machine.stack, machine.frames, machine.handlers
+	if t.bytes > 0 { // a spawned thread that has not exited
+		machine.account(t)
+	}
+}
+
+// load makes t the current thread
+func (machine *vm) load(t *thread) {
+	machine.current = t
+	machine.pc, machine.ip, machine.sp, machine.fp = t.pc, t.ip, t.sp, t.fp
+	machine.stack, machine.frames, machine.handlers = t.stack, t.frames, t.handlers
+}
+
+// switchThread saves the current thread and runs the next runnable one
+func (machine *vm) switchThread() {
+	if len(machine.runnable) == 0 {
+		machine.fault(Deadlock, "all %d thread(s) are blocked", len(machine.threads))
+	}
+	next := machine.runnable[0]
+	machine.runnable = machine.runnable[1:]
+	machine.save()
+	machine.load(next)
+}
+
+// ready puts a thread that was blocked at the back of the line
+func (machine *vm) ready(t *thread) {
+	t.blocked = 0
+	t.pc = t.resume
+	machine.runnable = append(machine.runnable, t)
+}
+
+// spawn executes SPAWN, moving the arguments to the stack of a new thread
+// that starts at addr once its turn comes
+func (machine *vm) spawn(addr, argc int) {
+	current := machine.frames[len(machine.frames)-1]
+	if argc < 0 || argc > machine.sp-(current.base+current.size-1) {
+		machine.fault(StackUnderflow, "SPAWN with %d argument(s)", argc)
+	}
+	machine.threaded()
+
+	machine.threadID++
+	t := &thread{
+		id:     machine.threadID,
+		pc:     addr,
+		ip:     addr,
+		sp:     argc - 1,
+		stack:  make([]Value, len(machine.stack)),
+		frames: []frame{{ret: -1, base: 0, size: argc, fn: addr}},
+	}
+	machine.account(t)
+	base := machine.sp - argc + 1
+	copy(t.stack, machine.stack[base:machine.sp+1])
+	for machine.sp >= base {
+		machine.StackPop()
+	}
+
+	machine.threads = append(machine.threads, t)
+	machine.runnable = append(machine.runnable, t)
+}
+
+// yield executes YIELD, letting every runnable thread have a turn first
+func (machine *vm) yield() {
+	if len(machine.runnable) == 0 {
+		return
+	}
+	machine.runnable = append(machine.runnable, machine.current)
+	machine.switchThread()
+}
+
+// exit ends the current thread, which returned from its function
+func (machine *vm) exit() {
+	for i, t := range machine.threads {
+		if t == machine.current {
+			machine.threads = append(machine.threads[:i], machine.threads[i+1:]...)
+			machine.threadBytes -= t.bytes
+			t.bytes = 0
+			break
+		}
+	}
+	machine.switchThread()
+}
+
+// block stops the current thread in a channel operation until another
+// thread completes it
+func (machine *vm) block(code int) {
+	t := machine.current
+	t.blocked = code
+	t.resume = machine.pc
+	machine.pc = machine.ip // shown at the blocking instruction while it waits
+	machine.switchThread()
+}
+
+// makeChan executes MAKE_CHAN
+func (machine *vm) makeChan() {
+	capacity := machine.popKind(KindInt).AsInt()
+	if capacity < 0 || capacity > maxChanCapacity {
+		machine.fault(IndexOutOfRange, "channel capacity %d", capacity)
+	}
+	machine.threaded()
+	machine.StackPush(machine.alloc(&object{kind: KindChan, ch: &channel{capacity: int(capacity)}}))
+}
+
+// maxChanCapacity bounds the buffer of a channel, which is allocated as it
+// fills up
+const maxChanCapacity = 1 << 24
+
+// send executes SEND
+func (machine *vm) send() {
+	value := machine.StackPop()
+	ref := machine.StackPop()
+	ch := machine.deref(ref, KindChan).ch
+
+	if len(ch.receivers) > 0 {
+		r := ch.receivers[0]
+		ch.receivers = ch.receivers[1:]
+		machine.deliver(r, ref, value)
+		return
+	}
+	if len(ch.buffer) < ch.capacity {
+		ch.buffer = append(ch.buffer, value)
+		return
+	}
+
+	machine.StackPush(ref)
+	machine.StackPush(value)
+	ch.senders = append(ch.senders, machine.current)
+	machine.block(SEND)
+}
+
+// take receives from a channel without blocking, completing the oldest
+// blocked sender if there is one
+func (machine *vm) take(ch *channel) (Value, bool) {
+	var value Value
+	switch {
+	case len(ch.buffer) > 0:
+		value = ch.buffer[0]
+		ch.buffer = ch.buffer[1:]
+		if len(ch.senders) > 0 {
+			ch.buffer = append(ch.buffer, machine.release(ch))
+		}
+	case len(ch.senders) > 0:
+		value = machine.release(ch)
+	default:
+		return Value{}, false
+	}
+	return value, true
+}
+
+// release completes the oldest blocked sender, returning its value
+func (machine *vm) release(ch *channel) Value {
+	s := ch.senders[0]
+	ch.senders = ch.senders[1:]
+
+	value := s.stack[s.sp]
+	s.stack[s.sp], s.stack[s.sp-1] = Value{}, Value{}
+	s.sp -= 2
+	machine.ready(s)
+	return value
+}
+
+// deliver completes a thread blocked receiving from the channel ref
+func (machine *vm) deliver(r *thread, ref Value, value Value) {
+	if r.blocked == RECV {
+		r.stack[r.sp] = value
+		machine.ready(r)
+		return
+	}
+
+	// SELECT: stop waiting on the other channels, then replace them with
+	// the value and the index of ref
+	base := r.sp - r.selects + 1
+	index := -1
+	for i, other := range r.stack[base : r.sp+1] {
+		if other == ref && index < 0 {
+			index = i
+		}
+		machine.heap[other.bits].ch.remove(r)
+	}
+	for i := base; i <= r.sp; i++ {
+		r.stack[i] = Value{}
+	}
+	r.stack[base] = value
+	r.stack[base+1] = Int(int64(index))
+	r.sp = base + 1
+	machine.ready(r)
+}
+
+// recv executes RECV
+func (machine *vm) recv() {
+	ref := machine.StackPop()
+	ch := machine.deref(ref, KindChan).ch
+
+	if value, ok := machine.take(ch); ok {
+		machine.StackPush(value)
+		return
+	}
+
+	machine.StackPush(ref)
+	ch.receivers = append(ch.receivers, machine.current)
+	machine.block(RECV)
+}
+
+// selectRecv executes SELECT n, wait: receive from the first of n
+// channels that has a value, waiting for one unless wait is 0
+func (machine *vm) selectRecv(n, wait int) {
+	current := machine.frames[len(machine.frames)-1]
+	if n < 1 || n > machine.sp-(current.base+current.size-1) {
+		machine.fault(StackUnderflow, "SELECT of %d channel(s)", n)
+	}
+	base := machine.sp - n + 1
+	if base+1 >= len(machine.stack) {
+		panic(trapOverflow) // no room for the value and index
+	}
+
+	channels := make([]*channel, n)
+	for i := range channels {
+		channels[i] = machine.deref(machine.stack[base+i], KindChan).ch
+	}
+
+	for i, ch := range channels {
+		if value, ok := machine.take(ch); ok {
+			machine.popSelect(base, value, i)
+			return
+		}
+	}
+	if wait == 0 {
+		machine.popSelect(base, Int(0), -1)
+		return
+	}
+
+	for i, ch := range channels {
+		if i == 0 || !containsChannel(channels[:i], ch) {
+			ch.receivers = append(ch.receivers, machine.current)
+		}
+	}
+	machine.current.selects = n
+	machine.block(SELECT)
+}
+
+// popSelect replaces the channels of a SELECT with its results
+func (machine *vm) popSelect(base int, value Value, index int) {
+	for machine.sp >= base {
+		machine.StackPop()
+	}
+	machine.StackPush(value)
+	machine.StackPush(Int(int64(index)))
+}
+
+func containsChannel(channels []*channel, ch *channel) bool {
+	for _, c := range channels {
+		if c == ch {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,215 @@
+package vm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// producer sends 1, 2 and 3 on the channel passed as its argument
+var producer = []int{
+	LOAD, 0, CONST_I32, 1, SEND, // 0
+	LOAD, 0, CONST_I32, 2, SEND, // 5
+	LOAD, 0, CONST_I32, 3, SEND, // 10
+	CONST_I32, 0, RET, // 15
+}
+
+func TestChannelUnbuffered(t *testing.T) {
+	code := append(append([]int(nil), producer...),
+		CONST_I32, 0, MAKE_CHAN, GSTORE, 0, // 18 - global 0 = channel
+		CONST_I32, 0, GLOAD, SPAWN, 0, 1, // 23 - spawn producer(channel)
+		CONST_I32, 0, GLOAD, RECV, PRINT, // 29
+		CONST_I32, 0, GLOAD, RECV, PRINT, // 34
+		CONST_I32, 0, GLOAD, RECV, PRINT, // 39
+		HALT, // 44
+	)
+	out, err := runVerified(t, &Module{Code: code, Entry: 18, DataSize: 1}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "1\n2\n3\n" {
+		t.Errorf("Expected 1, 2, 3, got %q", out)
+	}
+}
+
+func TestChannelBuffered(t *testing.T) {
+	code := []int{
+		CONST_I32, 2, MAKE_CHAN, GSTORE, 0, // 0
+		CONST_I32, 0, GLOAD, CONST_I32, 1, SEND, // 5 - neither send blocks
+		CONST_I32, 0, GLOAD, CONST_I32, 2, SEND, // 11
+		CONST_I32, 0, GLOAD, RECV, PRINT, // 17
+		CONST_I32, 0, GLOAD, RECV, PRINT, // 22
+		HALT, // 27
+	}
+	out, err := runVerified(t, &Module{Code: code, DataSize: 1}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "1\n2\n" {
+		t.Errorf("Expected 1, 2, got %q", out)
+	}
+}
+
+func TestDeadlock(t *testing.T) {
+	tests := []struct {
+		name  string
+		code  []int
+		entry int
+	}{
+		{"receive", []int{CONST_I32, 0, MAKE_CHAN, RECV, HALT}, 0},
+		{"send", []int{CONST_I32, 0, MAKE_CHAN, CONST_I32, 1, SEND, HALT}, 0},
+		{"full buffer", []int{CONST_I32, 1, MAKE_CHAN, DUP, CONST_I32, 1, SEND, CONST_I32, 2, SEND, HALT}, 0},
+		// the producer blocks on its second send, then main on a receive
+		// from a channel nobody sends on
+		{"all threads", append(append([]int(nil), producer...),
+			CONST_I32, 0, MAKE_CHAN, DUP, SPAWN, 0, 1, // 18
+			RECV, PRINT, // 25
+			CONST_I32, 0, MAKE_CHAN, RECV, HALT, // 27
+		), len(producer)},
+	}
+
+	for _, test := range tests {
+		err := New(test.code, test.entry, 0, Options{Stdout: &bytes.Buffer{}}).Run()
+		if fault, ok := err.(*Fault); !ok || fault.Kind != Deadlock {
+			t.Errorf("%s: expected a deadlock, got %v", test.name, err)
+		}
+	}
+}
+
+func TestYield(t *testing.T) {
+	const worker = 0
+	code := []int{
+		LOAD, 0, PRINT, YIELD, LOAD, 0, PRINT, CONST_I32, 0, RET, // 0 - worker(n)
+		CONST_I32, 1, SPAWN, worker, 1, // 10
+		CONST_I32, 2, SPAWN, worker, 1, // 15
+		YIELD, YIELD, YIELD, HALT, // 20
+	}
+	var out bytes.Buffer
+	machine := New(code, 10, 0, Options{Stdout: &out})
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "1\n2\n1\n2\n" {
+		t.Errorf("Expected the workers to take turns, got %q", out.String())
+	}
+	if machine.Threads() != 1 {
+		t.Errorf("Expected the workers to have ended, %d threads left", machine.Threads())
+	}
+}
+
+func TestSelect(t *testing.T) {
+	// main selects on a and b, a thread sends 7 on b
+	code := []int{
+		LOAD, 0, CONST_I32, 7, SEND, CONST_I32, 0, RET, // 0 - send7(ch)
+		CONST_I32, 0, MAKE_CHAN, GSTORE, 0, // 8 - a
+		CONST_I32, 0, MAKE_CHAN, GSTORE, 1, // 13 - b
+		CONST_I32, 0, GLOAD, CONST_I32, 1, GLOAD, SELECT, 2, 0, // 18 - nothing ready
+		PRINT, PRINT, // 27 - -1, 0
+		CONST_I32, 1, GLOAD, SPAWN, 0, 1, // 29
+		CONST_I32, 0, GLOAD, CONST_I32, 1, GLOAD, SELECT, 2, 1, // 35 - blocks
+		PRINT, PRINT, // 44 - 1, 7
+		HALT, // 46
+	}
+	m := &Module{Code: code, Entry: 8, DataSize: 2}
+	if diagnostics := Verify(m); len(diagnostics) > 0 {
+		t.Fatal(diagnostics)
+	}
+
+	var out bytes.Buffer
+	machine := NewFromModule(m, Options{Stdout: &out})
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "-1\n0\n1\n7\n" {
+		t.Errorf("Expected -1, 0, 1, 7, got %q", out.String())
+	}
+	if a := machine.heap[machine.locals[0].bits].ch; len(a.receivers) != 0 {
+		t.Errorf("Expected main to stop waiting on a, got %d receiver(s)", len(a.receivers))
+	}
+}
+
+func TestBlockedSenderSurvivesGC(t *testing.T) {
+	code := []int{
+		LOAD, 0, CONST_STR, 0, SEND, CONST_I32, 0, RET, // 0 - sends a new string
+		CONST_I32, 0, MAKE_CHAN, GSTORE, 0, // 8
+		CONST_I32, 0, GLOAD, SPAWN, 0, 1, // 13
+		YIELD,                            // 19 - the thread blocks in SEND
+		CONST_I32, 0, GLOAD, RECV, PRINT, // 20
+		HALT,
+	}
+	var out bytes.Buffer
+	machine := NewFromModule(&Module{Code: code, Entry: 8, DataSize: 1, Consts: []string{"sent"}}, Options{Stdout: &out})
+	for machine.PC() != 20 {
+		if err := machine.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	machine.GC()
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "sent\n" {
+		t.Errorf("Expected sent, got %q", out.String())
+	}
+}
+
+func TestThreadFaults(t *testing.T) {
+	// a fault in a thread stops the program unless the thread catches it
+	err := New([]int{
+		CONST_I32, 1, CONST_I32, 0, DIV_I32, RET, // 0
+		SPAWN, 0, 0, YIELD, HALT, // 6
+	}, 6, 0, Options{}).Run()
+	if fault, ok := err.(*Fault); !ok || fault.Kind != DivisionByZero {
+		t.Errorf("Expected division by zero, got %v", err)
+	}
+
+	err = New([]int{CONST_I32, 0, RECV, HALT}, 0, 0, Options{}).Run()
+	if fault, ok := err.(*Fault); !ok || fault.Kind != TypeError {
+		t.Errorf("Expected a type error for RECV of an int, got %v", err)
+	}
+
+	machine := New([]int{CONST_I32, 0, MAKE_CHAN, HALT}, 0, 0, Options{})
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := machine.Snapshot(); err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Errorf("Expected snapshots of threaded programs to be refused, got %v", err)
+	}
+}
+
+func TestVerifyThreads(t *testing.T) {
+	if d := Verify(&Module{Code: []int{SELECT, 0, 1, HALT}}); len(d) == 0 || !strings.Contains(d[0].Msg, "SELECT of 0 channel(s)") {
+		t.Errorf("Expected a SELECT diagnostic, got %v", d)
+	}
+	if d := Verify(&Module{Code: []int{SPAWN, 4, 1, HALT, CONST_I32, 0, RET}}); len(d) == 0 || !strings.Contains(d[0].Msg, "SPAWN needs 1 value(s)") {
+		t.Errorf("Expected a SPAWN diagnostic, got %v", d)
+	}
+}
+
+func TestSpawnHeapLimit(t *testing.T) {
+	// the spawned threads never get a turn, their stacks count against the
+	// heap limit and the fault can not be caught
+	machine := New([]int{
+		CONST_I32, 0, RET, // 0
+		TRY, 11, // 3
+		SPAWN, 0, 0, JMP, 5, // 5
+		HALT,        // 10
+		PRINT, HALT, // 11 - not reached
+	}, 3, 0, Options{MaxHeapBytes: 1 << 16, MaxInstructions: 2000000})
+	err := machine.Run()
+	if fault, ok := err.(*Fault); !ok || fault.Kind != HeapLimit {
+		t.Fatalf("Expected the heap limit, got %v", err)
+	}
+	if n := machine.Threads(); n*STACK_SIZE*valueSize > 1<<16 {
+		t.Errorf("Expected the stacks of %d threads to exceed the limit", n)
+	}
+
+	// threads that return give their bytes back
+	err = New([]int{
+		CONST_I32, 0, RET, // 0
+		SPAWN, 0, 0, YIELD, JMP, 3, // 3
+	}, 3, 0, Options{MaxHeapBytes: 1 << 16, MaxInstructions: 100000}).Run()
+	if fault, ok := err.(*Fault); !ok || fault.Kind != InstructionLimit {
+		t.Errorf("Expected the instruction limit, got %v", err)
+	}
+}
@@ -0,0 +1,323 @@
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Execution traces. With Options.Trace set the machine writes an event per
+// executed instruction: its address, opcode and operands, how it changed
+// the depth of the stack, the thread that ran it, the integer read by READ
+// and the fault it raised, if any. Running a program again with the input
+// of its trace, see TraceInput, and comparing the traces with DiffTrace
+// finds the first instruction where a change to the program or to the
+// machine made them diverge. Native functions are not recorded, they have
+// to behave the same way in both runs.
+//
+// Traces are JSON lines by default, one object per event:
+//
+//	{"pc":40,"op":"CALL","operands":[0,1],"delta":0}
+//
+// With Options.TraceFormat TraceBinary they use a compact binary format,
+// like modules with varints for all integers after the magic:
+//
+//	magic     "VTRC"
+//	version   uvarint, TraceVersion
+//	events    repeated until the end of the input: varint pc, uvarint
+//	          opcode, uvarint count, varint per operand, varint delta,
+//	          uvarint thread, uvarint fault kind (0 for none), varint
+//	          input for READ
+
+const TraceVersion = 1
+
+var traceMagic = []byte("VTRC")
+
+// TraceFormat selects how Options.Trace is written
+type TraceFormat int
+
+const (
+	TraceJSON   TraceFormat = iota // JSON lines
+	TraceBinary                    // compact binary
+)
+
+// TraceEvent is an executed instruction
+type TraceEvent struct {
+	PC       int       // address of the instruction
+	Opcode   int       // instruction, HALT when running off the end of the code
+	Operands []int     // operands of the instruction
+	Delta    int       // change in the depth of the thread's stack
+	Thread   int       // id of the thread that ran it, 0 for the main thread
+	Input    int64     // integer read by READ
+	Fault    FaultKind // fault raised by the instruction, 0 for none
+}
+
+func (e TraceEvent) String() string {
+	s := fmt.Sprintf("pc %d %s", e.PC, opcodeName(e.Opcode))
+	for _, operand := range e.Operands {
+		s += fmt.Sprintf(" %d", operand)
+	}
+	s += fmt.Sprintf(", stack %+d", e.Delta)
+	if e.Thread != 0 {
+		s += fmt.Sprintf(", thread %d", e.Thread)
+	}
+	if e.Opcode == READ && e.Fault == 0 {
+		s += fmt.Sprintf(", read %d", e.Input)
+	}
+	if e.Fault != 0 {
+		s += fmt.Sprintf(", %s", e.Fault)
+	}
+	return s
+}
+
+func opcodeName(code int) string {
+	if op, ok := LookupOpcode(code); ok {
+		return op.Name
+	}
+	return fmt.Sprintf("opcode(%d)", code)
+}
+
+func (e TraceEvent) equal(other TraceEvent) bool {
+	if len(e.Operands) != len(other.Operands) {
+		return false
+	}
+	for i := range e.Operands {
+		if e.Operands[i] != other.Operands[i] {
+			return false
+		}
+	}
+	return e.PC == other.PC && e.Opcode == other.Opcode && e.Delta == other.Delta &&
+		e.Thread == other.Thread && e.Input == other.Input && e.Fault == other.Fault
+}
+
+// jsonEvent is the JSON lines form of a TraceEvent
+type jsonEvent struct {
+	PC       int    `json:"pc"`
+	Op       string `json:"op"`
+	Operands []int  `json:"operands,omitempty"`
+	Delta    int    `json:"delta"`
+	Thread   int    `json:"thread,omitempty"`
+	Input    int64  `json:"input,omitempty"`
+	Fault    string `json:"fault,omitempty"`
+}
+
+// tracer writes the trace of a machine. The event of the instruction being
+// executed is started before it runs and written once it is done, or with
+// the fault it raised.
+type tracer struct {
+	w      *bufio.Writer
+	format TraceFormat
+	buf    bytes.Buffer
+
+	event   TraceEvent // instruction being executed
+	sp      int        // stack pointer before it
+	thread  *thread    // thread running it
+	pending bool       // event is started but not written
+}
+
+func newTracer(w io.Writer, format TraceFormat) *tracer {
+	t := &tracer{w: bufio.NewWriter(w), format: format}
+	if format == TraceBinary {
+		t.buf.Write(traceMagic)
+		putUvarint(&t.buf, TraceVersion)
+		t.w.Write(t.buf.Bytes())
+	}
+	return t
+}
+
+// begin starts the event of the instruction at machine.ip
+func (t *tracer) begin(machine *vm, code int) {
+	t.event = TraceEvent{PC: machine.ip, Opcode: code}
+	if op, ok := LookupOpcode(code); ok && machine.ip < len(machine.code) {
+		end := machine.ip + 1 + op.Operands
+		if end > len(machine.code) {
+			end = len(machine.code)
+		}
+		t.event.Operands = append(t.event.Operands, machine.code[machine.ip+1:end]...)
+	}
+	t.sp, t.thread = machine.sp, machine.current
+	if t.thread != nil {
+		t.event.Thread = t.thread.id
+	}
+	t.pending = true
+}
+
+// end writes the event of an instruction that completed
+func (t *tracer) end(machine *vm) {
+	sp := machine.sp
+	if t.thread != nil && machine.current != t.thread {
+		sp = t.thread.sp // the thread blocked, yielded or exited
+	}
+	t.event.Delta = sp - t.sp
+	if t.event.Opcode == READ {
+		t.event.Input = machine.stack[machine.sp].AsInt()
+	}
+	t.write()
+}
+
+// finish is deferred with recoverFault, writing the event of an
+// instruction that faulted and flushing the trace
+func (t *tracer) finish(err error) {
+	if fault, ok := err.(*Fault); ok && t.pending {
+		t.event.Fault = fault.Kind
+		t.write()
+	}
+	t.pending = false
+	t.w.Flush()
+}
+
+func (t *tracer) write() {
+	t.pending = false
+	e := t.event
+	if t.format == TraceBinary {
+		t.buf.Reset()
+		putVarint(&t.buf, int64(e.PC))
+		putUvarint(&t.buf, uint64(e.Opcode))
+		putUvarint(&t.buf, uint64(len(e.Operands)))
+		for _, operand := range e.Operands {
+			putVarint(&t.buf, int64(operand))
+		}
+		putVarint(&t.buf, int64(e.Delta))
+		putUvarint(&t.buf, uint64(e.Thread))
+		putUvarint(&t.buf, uint64(e.Fault))
+		if e.Opcode == READ {
+			putVarint(&t.buf, e.Input)
+		}
+		t.w.Write(t.buf.Bytes())
+		return
+	}
+
+	line := jsonEvent{PC: e.PC, Op: opcodeName(e.Opcode), Operands: e.Operands, Delta: e.Delta, Thread: e.Thread, Input: e.Input}
+	if e.Fault != 0 {
+		line.Fault = e.Fault.String()
+	}
+	b, _ := json.Marshal(line)
+	t.w.Write(append(b, '\n'))
+}
+
+// ReadTrace reads a trace written in either format
+func ReadTrace(r io.Reader) ([]TraceEvent, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(traceMagic)); bytes.Equal(magic, traceMagic) {
+		br.Discard(len(traceMagic))
+		return readBinaryTrace(br)
+	}
+
+	var events []TraceEvent
+	d := json.NewDecoder(br)
+	for d.More() {
+		var line jsonEvent
+		if err := d.Decode(&line); err != nil {
+			return nil, fmt.Errorf("vm: corrupt trace, event %d: %v", len(events), err)
+		}
+		e := TraceEvent{PC: line.PC, Operands: line.Operands, Delta: line.Delta, Thread: line.Thread, Input: line.Input}
+		code, ok := OpcodeByName(line.Op)
+		if !ok {
+			// an invalid opcode that faulted, written by opcodeName
+			if _, err := fmt.Sscanf(line.Op, "opcode(%d)", &code); err != nil {
+				return nil, fmt.Errorf("vm: corrupt trace, event %d: unknown opcode %q", len(events), line.Op)
+			}
+		}
+		e.Opcode = code
+		if line.Fault != "" {
+			if e.Fault, ok = faultByName(line.Fault); !ok {
+				return nil, fmt.Errorf("vm: corrupt trace, event %d: unknown fault %q", len(events), line.Fault)
+			}
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+func readBinaryTrace(r *bufio.Reader) ([]TraceEvent, error) {
+	d := &decoder{r: r}
+	if version := d.uvarint(); d.err == nil && version != TraceVersion {
+		return nil, fmt.Errorf("vm: unsupported trace version %d, expected %d", version, TraceVersion)
+	}
+
+	var events []TraceEvent
+	for d.err == nil {
+		if _, err := r.Peek(1); err == io.EOF {
+			return events, nil
+		}
+		e := TraceEvent{PC: d.int(), Opcode: int(d.uvarint())}
+		if n := d.count(); n > 0 {
+			e.Operands = make([]int, n)
+			for i := range e.Operands {
+				e.Operands[i] = d.int()
+			}
+		}
+		e.Delta = d.int()
+		e.Thread = int(d.uvarint())
+		e.Fault = FaultKind(d.uvarint())
+		if e.Opcode == READ {
+			e.Input = int64(d.int())
+		}
+		if d.err == nil {
+			events = append(events, e)
+		}
+	}
+	if d.err == io.EOF {
+		d.err = io.ErrUnexpectedEOF
+	}
+	return nil, fmt.Errorf("vm: corrupt trace, event %d: %v", len(events), d.err)
+}
+
+func faultByName(name string) (FaultKind, bool) {
+	for kind, n := range faultNames {
+		if n == name {
+			return kind, true
+		}
+	}
+	return 0, false
+}
+
+// TraceInput returns the integers read by READ in a trace, as input for
+// running the program again
+func TraceInput(events []TraceEvent) io.Reader {
+	var input strings.Builder
+	for _, e := range events {
+		if e.Opcode == READ && e.Fault == 0 {
+			fmt.Fprintln(&input, e.Input)
+		}
+	}
+	return strings.NewReader(input.String())
+}
+
+// Divergence is the first difference between two traces
+type Divergence struct {
+	Index    int         // position of the differing event, from 0
+	Recorded *TraceEvent // nil if the recorded trace ended first
+	Replayed *TraceEvent // nil if the replayed trace ended first
+}
+
+func (d *Divergence) String() string {
+	describe := func(e *TraceEvent) string {
+		if e == nil {
+			return "end of trace"
+		}
+		return e.String()
+	}
+	return fmt.Sprintf("traces diverge at instruction %d: recorded %s, replayed %s", d.Index+1, describe(d.Recorded), describe(d.Replayed))
+}
+
+// DiffTrace compares a recorded trace with the trace of a replay, returning
+// the first difference or nil when they are the same
+func DiffTrace(recorded, replayed []TraceEvent) *Divergence {
+	for i := 0; i < len(recorded) || i < len(replayed); i++ {
+		d := &Divergence{Index: i}
+		if i < len(recorded) {
+			d.Recorded = &recorded[i]
+		}
+		if i < len(replayed) {
+			d.Replayed = &replayed[i]
+		}
+		if d.Recorded == nil || d.Replayed == nil || !d.Recorded.equal(*d.Replayed) {
+			return d
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package vm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// traced runs a module and reads back its trace
+func traced(t *testing.T, m *Module, input string, format TraceFormat) ([]TraceEvent, error) {
+	t.Helper()
+	var trace bytes.Buffer
+	err := NewFromModule(m, Options{Stdout: ioutil.Discard, Stdin: strings.NewReader(input), Trace: &trace, TraceFormat: format}).Run()
+
+	events, rerr := ReadTrace(&trace)
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	return events, err
+}
+
+// addInput returns its argument plus an integer read from the input
+var addInput = &Module{Code: []int{
+	CONST_I32, 2, CALL, 7, 1, PRINT, HALT, // 0
+	LOAD, 0, READ, ADD_I32, RET, // 7
+}}
+
+func TestTraceEvents(t *testing.T) {
+	expected := []TraceEvent{
+		{PC: 0, Opcode: CONST_I32, Operands: []int{2}, Delta: 1},
+		{PC: 2, Opcode: CALL, Operands: []int{7, 1}},
+		{PC: 7, Opcode: LOAD, Operands: []int{0}, Delta: 1},
+		{PC: 9, Opcode: READ, Delta: 1, Input: 40},
+		{PC: 10, Opcode: ADD_I32, Delta: -1},
+		{PC: 11, Opcode: RET, Delta: -1},
+		{PC: 5, Opcode: PRINT, Delta: -1},
+		{PC: 6, Opcode: HALT},
+	}
+
+	for _, format := range []TraceFormat{TraceJSON, TraceBinary} {
+		events, err := traced(t, addInput, "40", format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(events, expected) {
+			t.Errorf("Format %d: expected\n%v\ngot\n%v", format, expected, events)
+		}
+	}
+
+	var text, binary bytes.Buffer
+	NewFromModule(addInput, Options{Stdout: ioutil.Discard, Stdin: strings.NewReader("40"), Trace: &text}).Run()
+	NewFromModule(addInput, Options{Stdout: ioutil.Discard, Stdin: strings.NewReader("40"), Trace: &binary, TraceFormat: TraceBinary}).Run()
+	if binary.Len() >= text.Len()/4 {
+		t.Errorf("Expected the binary trace to be compact, %d bytes against %d", binary.Len(), text.Len())
+	}
+}
+
+func TestTraceFaults(t *testing.T) {
+	events, err := traced(t, &Module{Code: []int{CONST_I32, 1, CONST_I32, 0, DIV_I32, HALT}}, "", TraceJSON)
+	if err == nil {
+		t.Fatal("Expected division by zero")
+	}
+	if last := events[len(events)-1]; len(events) != 3 || last.Opcode != DIV_I32 || last.Fault != DivisionByZero {
+		t.Errorf("Expected the trace to end with the faulting DIV_I32, got %v", events)
+	}
+
+	// a caught fault carries on at the handler
+	events, err = traced(t, &Module{Code: []int{TRY, 7, CONST_I32, 1, CONST_I32, 0, DIV_I32, PRINT, HALT}}, "", TraceBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []int
+	for _, e := range events {
+		ops = append(ops, e.Opcode)
+	}
+	if expected := []int{TRY, CONST_I32, CONST_I32, DIV_I32, PRINT, HALT}; !reflect.DeepEqual(ops, expected) || events[3].Fault != DivisionByZero {
+		t.Errorf("Expected %v with the fault at DIV_I32, got %v", expected, events)
+	}
+}
+
+func TestTraceReplay(t *testing.T) {
+	recorded, _ := traced(t, addInput, "40", TraceBinary)
+	input, _ := ioutil.ReadAll(TraceInput(recorded))
+	if string(input) != "40\n" {
+		t.Errorf("Expected the recorded input, got %q", input)
+	}
+
+	replayed, _ := traced(t, addInput, string(input), TraceJSON)
+	if d := DiffTrace(recorded, replayed); d != nil {
+		t.Errorf("Expected the replay to match, got %v", d)
+	}
+
+	changed := &Module{Code: append([]int(nil), addInput.Code...)}
+	changed.Code[10] = SUB_I32
+	replayed, _ = traced(t, changed, string(input), TraceJSON)
+	d := DiffTrace(recorded, replayed)
+	if d == nil || d.Index != 4 || d.Recorded.Opcode != ADD_I32 || d.Replayed.Opcode != SUB_I32 {
+		t.Fatalf("Expected the traces to diverge at the SUB_I32, got %v", d)
+	}
+	if !strings.Contains(d.String(), "instruction 5: recorded pc 10 ADD_I32, stack -1, replayed pc 10 SUB_I32") {
+		t.Errorf("Unexpected description %q", d)
+	}
+
+	if d := DiffTrace(recorded[:3], recorded); d == nil || d.Index != 3 || d.Recorded != nil {
+		t.Errorf("Expected the recorded trace to end first, got %v", d)
+	}
+}
+
+func TestReadTraceErrors(t *testing.T) {
+	var trace bytes.Buffer
+	NewFromModule(addInput, Options{Stdout: ioutil.Discard, Stdin: strings.NewReader("40"), Trace: &trace, TraceFormat: TraceBinary}).Run()
+	binary := trace.Bytes()
+
+	tests := []struct {
+		name     string
+		trace    []byte
+		expected string
+	}{
+		{"version", append([]byte("VTRC"), TraceVersion+1), "unsupported trace version"},
+		{"truncated", binary[:len(binary)-1], "corrupt trace, event 7"},
+		{"opcode", []byte(`{"pc":0,"op":"NOPE","delta":0}`), "unknown opcode"},
+		{"fault", []byte(`{"pc":0,"op":"HALT","delta":0,"fault":"oops"}`), "unknown fault"},
+		{"json", []byte(`{"pc":`), "corrupt trace"},
+	}
+
+	for _, test := range tests {
+		if _, err := ReadTrace(bytes.NewReader(test.trace)); err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected %q, got %v", test.name, test.expected, err)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Translation of stack bytecode to register code. Each function, the entry
+// point and every CALL target, is translated on its own using the frame
+// states found by the verifier, which give the stack depth, and so the
+// register, of every operand.
+//
+// Loads and constants are not copied to the register of their stack
+// position straight away. The translator remembers where the value is and
+// the instruction that consumes it reads the local slot or constant
+// directly, so LOAD 0, LOAD 1, ADD_I32 becomes a single instruction. The
+// remembered operands are written out before a STORE that would change
+// them, before calls and branches and at jump targets, where every path
+// has to leave the stack in its registers.
+
+// operand is where the value at a stack position is found
+type operand struct {
+	konst bool // n indexes the constants rather than the registers
+	n     int
+}
+
+type translator struct {
+	v      *verifier
+	prog   *RegisterProgram
+	consts map[Value]int
+	sizes  map[int]int // window size by function address
+	starts map[int]int // first instruction by function address
+	calls  []int       // rCall instructions, patched once every function is done
+	jumps  []int       // branches of the current function
+
+	addr    int       // stack bytecode address being translated
+	slots   int       // local slots at addr
+	scratch int       // scratch register of the current function
+	stack   []operand // the stack at addr
+}
+
+// Translate turns a module into a program for the register machine. The
+// module must verify. Only the instructions on ints, floats and bools,
+// globals, locals and calls are supported: programs using the heap,
+// natives, exceptions or threads are rejected.
+func Translate(m *Module) (*RegisterProgram, error) {
+	v := analyze(m)
+	if len(v.diagnostics) > 0 {
+		return nil, fmt.Errorf("translate: module does not verify, %s", v.diagnostics[0])
+	}
+	for addr, ins := range v.instructions {
+		if ins.code == CALL && ins.operands[0] == m.Entry {
+			return nil, fmt.Errorf("translate: CALL at %d of the entry point", addr)
+		}
+	}
+
+	t := &translator{
+		v:      v,
+		prog:   &RegisterProgram{dataSize: m.DataSize},
+		consts: map[Value]int{},
+		sizes:  map[int]int{},
+		starts: map[int]int{},
+	}
+
+	var functions, reachable []int
+	for fn, states := range v.functions {
+		functions = append(functions, fn)
+		size := 0
+		for addr, state := range states {
+			reachable = append(reachable, addr)
+			ins := v.instructions[addr]
+			if ins.code == ENTER {
+				state.slots += ins.operands[0]
+			}
+			if n := state.slots + state.depth + ins.op.Pushes; n > size {
+				size = n
+			}
+		}
+		t.sizes[fn] = size + 1 // the scratch register
+	}
+	sort.Ints(functions)
+	sort.Ints(reachable)
+
+	for _, addr := range reachable {
+		switch ins := v.instructions[addr]; ins.code {
+		case CONST_STR, NEW_ARRAY, ALOAD, ASTORE, ALEN, CONCAT, CALL_NATIVE,
+			TRY, END_TRY, THROW, SPAWN, YIELD, MAKE_CHAN, SEND, RECV, SELECT:
+			return nil, fmt.Errorf("translate: %s at %d is not supported by the register machine", ins.op.Name, addr)
+		}
+	}
+
+	// instruction 0 is the end of the code, running off it halts
+	t.addr = len(m.Code)
+	t.emit(rHalt, 0, 0, 0)
+
+	for _, fn := range functions {
+		t.function(fn)
+	}
+	for _, pc := range t.calls {
+		in := &t.prog.code[pc]
+		in.a, in.c = t.starts[in.a], t.sizes[in.a]
+	}
+	t.prog.entry = t.starts[m.Entry]
+	t.prog.frame = t.sizes[m.Entry]
+	return t.prog, nil
+}
+
+// function translates the instructions of the function at start in
+// address order
+func (t *translator) function(start int) {
+	states := t.v.functions[start]
+	end := len(t.v.module.Code)
+
+	var addrs []int
+	labels := map[int]bool{start: true}
+	for addr := range states {
+		addrs = append(addrs, addr)
+		if ins := t.v.instructions[addr]; ins.code == JMP || ins.code == JMPT || ins.code == JMPF {
+			labels[ins.operands[0]] = true
+		}
+	}
+	sort.Ints(addrs)
+
+	t.scratch = t.sizes[start] - 1
+	t.stack = t.stack[:0]
+	at := map[int]int{} // first instruction by address
+	falls := false      // whether the previous instruction continues at addr
+	for _, addr := range addrs {
+		ins, state := t.v.instructions[addr], states[addr]
+		if labels[addr] || !falls {
+			if falls {
+				t.flush()
+			}
+			t.slots = state.slots
+			t.stack = t.stack[:0]
+			for i := 0; i < state.depth; i++ {
+				t.stack = append(t.stack, operand{n: t.own(i)})
+			}
+		}
+
+		t.addr, t.slots = addr, state.slots
+		at[addr] = len(t.prog.code)
+		falls = t.instruction(ins)
+		if falls && ins.next == end {
+			t.emit(rHalt, 0, 0, 0)
+			falls = false
+		}
+	}
+
+	t.starts[start] = at[start]
+	for _, pc := range t.jumps {
+		in := &t.prog.code[pc]
+		if in.a == end {
+			in.a = 0
+		} else {
+			in.a = at[in.a]
+		}
+	}
+	t.jumps = t.jumps[:0]
+}
+
+// instruction translates a single instruction, reporting whether execution
+// continues with the next one
+func (t *translator) instruction(ins verifiedInstruction) bool {
+	d := len(t.stack)
+	switch ins.code {
+	case CONST_I32:
+		t.push(t.constant(Int(int64(ins.operands[0]))))
+	case CONST_F64:
+		t.push(t.constant(Float(math.Float64frombits(uint64(ins.operands[0])))))
+	case CONST_BOOL:
+		t.push(t.constant(Bool(ins.operands[0] != 0)))
+	case LOAD:
+		t.push(operand{n: ins.operands[0]})
+	case STORE:
+		slot := ins.operands[0]
+		x := t.pop()
+		for i, y := range t.stack {
+			if y == (operand{n: slot}) {
+				t.move(t.own(i), y)
+				t.stack[i] = operand{n: t.own(i)}
+			}
+		}
+		t.move(slot, x)
+	case GLOAD:
+		if x := t.stack[d-1]; x.konst && t.prog.consts[x.n].Kind == KindInt {
+			t.emit(rGLoad, t.own(d-1), int(t.prog.consts[x.n].AsInt()), 0)
+		} else {
+			t.emit(rGLoadR, t.own(d-1), t.use(d-1), 0)
+		}
+		t.stack[d-1] = operand{n: t.own(d - 1)}
+	case GSTORE:
+		t.emit(rGStore, ins.operands[0], t.use(d-1), 0)
+		t.pop()
+	case DUP:
+		t.push(t.alias(d - 1))
+	case OVER:
+		t.push(t.alias(d - 2))
+	case SWAP:
+		t.swap()
+	case POP:
+		t.pop()
+	case JMP:
+		t.flush()
+		t.jump(rJmp, ins.operands[0], 0)
+		return false
+	case JMPT, JMPF:
+		r := t.use(d - 1)
+		t.pop()
+		t.flush()
+		op := rJmpT
+		if ins.code == JMPF {
+			op = rJmpF
+		}
+		t.jump(op, ins.operands[0], r)
+	case CALL:
+		fn, argc := ins.operands[0], ins.operands[1]
+		t.flush()
+		t.calls = append(t.calls, len(t.prog.code))
+		t.emit(rCall, fn, t.own(d-argc), 0)
+		t.stack = t.stack[:d-argc]
+		t.push(operand{n: t.own(d - argc)})
+	case RET:
+		t.emit(rRet, t.use(d-1), 0, 0)
+		return false
+	case ENTER:
+		if n := ins.operands[0]; n > 0 {
+			t.emit(rEnter, t.slots, n, 0)
+		}
+	case PRINT:
+		t.emit(rPrint, t.use(d-1), 0, 0)
+		t.pop()
+	case READ:
+		t.emit(rRead, t.own(d), 0, 0)
+		t.push(operand{n: t.own(d)})
+	case HALT:
+		t.emit(rHalt, 0, 0, 0)
+		return false
+	default:
+		if ins.op.Pops == 1 {
+			t.emit(ins.code, t.own(d-1), t.use(d-1), 0)
+			t.stack[d-1] = operand{n: t.own(d - 1)}
+			break
+		}
+		c := t.use(d - 1)
+		b := t.use(d - 2)
+		t.emit(ins.code, t.own(d-2), b, c)
+		t.stack = t.stack[:d-1]
+		t.stack[d-2] = operand{n: t.own(d - 2)}
+	}
+	return true
+}
+
+// own returns the register of stack position i
+func (t *translator) own(i int) int {
+	return t.slots + i
+}
+
+func (t *translator) emit(op, a, b, c int) {
+	t.prog.code = append(t.prog.code, rinstr{op, a, b, c})
+	t.prog.addrs = append(t.prog.addrs, t.addr)
+}
+
+func (t *translator) jump(op, addr, r int) {
+	t.jumps = append(t.jumps, len(t.prog.code))
+	t.emit(op, addr, r, 0)
+}
+
+func (t *translator) constant(value Value) operand {
+	n, ok := t.consts[value]
+	if !ok {
+		n = len(t.prog.consts)
+		t.consts[value] = n
+		t.prog.consts = append(t.prog.consts, value)
+	}
+	return operand{konst: true, n: n}
+}
+
+func (t *translator) push(x operand) {
+	t.stack = append(t.stack, x)
+}
+
+func (t *translator) pop() operand {
+	x := t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
+	return x
+}
+
+// alias returns an operand for a copy of stack position i, which is the
+// register of i once it holds the value. Copies therefore only refer to
+// positions below them.
+func (t *translator) alias(i int) operand {
+	return t.stack[i]
+}
+
+// use returns the register holding stack position i, loading a constant
+// into the position's own register
+func (t *translator) use(i int) int {
+	x := t.stack[i]
+	if x.konst {
+		t.move(t.own(i), x)
+		t.stack[i] = operand{n: t.own(i)}
+		return t.own(i)
+	}
+	return x.n
+}
+
+// move copies an operand to register r
+func (t *translator) move(r int, x operand) {
+	switch {
+	case x.konst:
+		t.emit(rConst, r, x.n, 0)
+	case x.n != r:
+		t.emit(rMove, r, x.n, 0)
+	}
+}
+
+// flush writes every remembered operand to the register of its position
+func (t *translator) flush() {
+	for i, x := range t.stack {
+		if x != (operand{n: t.own(i)}) {
+			t.move(t.own(i), x)
+			t.stack[i] = operand{n: t.own(i)}
+		}
+	}
+}
+
+// swap exchanges the top two positions. While neither is in its own
+// register the remembered operands trade places, otherwise the values are
+// exchanged through the scratch register.
+func (t *translator) swap() {
+	d := len(t.stack)
+	x, y := t.stack[d-2], t.stack[d-1]
+	inPlace := func(o operand) bool {
+		return !o.konst && (o.n == t.own(d-2) || o.n == t.own(d-1))
+	}
+	if !inPlace(x) && !inPlace(y) {
+		t.stack[d-2], t.stack[d-1] = y, x
+		return
+	}
+
+	t.move(t.scratch, operand{n: t.use(d - 2)})
+	t.move(t.own(d-2), operand{n: t.use(d - 1)})
+	t.move(t.own(d-1), operand{n: t.scratch})
+	t.stack[d-2], t.stack[d-1] = operand{n: t.own(d - 2)}, operand{n: t.own(d - 1)}
+}
@@ -0,0 +1,87 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Kind is the type tag of a Value
+type Kind uint8
+
+const (
+	KindInt    Kind = iota // 64 bit signed integer, the zero Value is Int(0)
+	KindFloat              // 64 bit IEEE float
+	KindBool               // true or false
+	KindString             // reference to a string on the heap
+	KindArray              // reference to an array on the heap
+	KindChan               // reference to a channel on the heap
+)
+
+var kindNames = map[Kind]string{
+	KindInt:    "int",
+	KindFloat:  "float",
+	KindBool:   "bool",
+	KindString: "string",
+	KindArray:  "array",
+	KindChan:   "chan",
+}
+
+func (k Kind) String() string {
+	if name, ok := kindNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("kind(%d)", int(k))
+}
+
+// Value is a tagged machine word held on the stack and in global memory.
+// The payload is kept as raw bits and interpreted according to Kind.
+type Value struct {
+	Kind Kind
+	bits uint64
+}
+
+func Int(i int64) Value {
+	return Value{KindInt, uint64(i)}
+}
+
+func Float(f float64) Value {
+	return Value{KindFloat, math.Float64bits(f)}
+}
+
+func Bool(b bool) Value {
+	if b {
+		return Value{KindBool, 1}
+	}
+	return Value{KindBool, 0}
+}
+
+// AsInt returns the payload of an int Value
+func (v Value) AsInt() int64 {
+	return int64(v.bits)
+}
+
+// AsFloat returns the payload of a float Value
+func (v Value) AsFloat() float64 {
+	return math.Float64frombits(v.bits)
+}
+
+// AsBool returns the payload of a bool Value
+func (v Value) AsBool() bool {
+	return v.bits != 0
+}
+
+func (v Value) String() string {
+	switch v.Kind {
+	case KindInt:
+		return strconv.FormatInt(v.AsInt(), 10)
+	case KindFloat:
+		return strconv.FormatFloat(v.AsFloat(), 'g', -1, 64)
+	case KindBool:
+		return strconv.FormatBool(v.AsBool())
+	case KindString, KindArray, KindChan:
+		return fmt.Sprintf("%s#%d", v.Kind, v.bits) // the contents live on the heap, see vm.Format
+	default:
+		return fmt.Sprintf("%s(%#x)", v.Kind, v.bits)
+	}
+}
@@ -0,0 +1,94 @@
+package vm
+
+import (
+	"math"
+	"testing"
+)
+
+func f64(f float64) int {
+	return int(math.Float64bits(f))
+}
+
+func TestFloatInstructions(t *testing.T) {
+	tests := []struct {
+		name     string
+		op       int
+		a, b     float64
+		expected string
+	}{
+		{"add", ADD_F64, 1.5, 2.25, "3.75"},
+		{"sub", SUB_F64, 1.5, 2.25, "-0.75"},
+		{"mul", MUL_F64, 1.5, -2, "-3"},
+		{"div", DIV_F64, 7, 2, "3.5"},
+		{"div zero", DIV_F64, 1, 0, "+Inf"},
+		{"lt", LT_F64, 1.5, 2, "true"},
+		{"gt", GT_F64, 1.5, 2, "false"},
+		{"le", LE_F64, 2, 2, "true"},
+		{"ge", GE_F64, 1, 2, "false"},
+		{"eq", EQ_F64, 0.5, 0.5, "true"},
+		{"ne", NE_F64, 0.5, 0.5, "false"},
+	}
+
+	for _, test := range tests {
+		code := []int{CONST_F64, f64(test.a), CONST_F64, f64(test.b), test.op, PRINT, HALT}
+		if out := run(t, code, 0, 0); out != test.expected+"\n" {
+			t.Errorf("%s: %v %s %v expected %s, got %q", test.name, test.a, Opcodes[test.op].Name, test.b, test.expected, out)
+		}
+	}
+}
+
+func TestConversions(t *testing.T) {
+	code := []int{
+		CONST_I32, 7, I2F, CONST_F64, f64(2), DIV_F64, PRINT, // 7 / 2.0
+		CONST_F64, f64(-3.9), F2I, PRINT,
+		CONST_F64, f64(1.5), NEG_F64, PRINT,
+		HALT,
+	}
+
+	if out := run(t, code, 0, 0); out != "3.5\n-3\n-1.5\n" {
+		t.Errorf("Expected 3.5, -3 and -1.5, got %q", out)
+	}
+
+	for _, f := range []float64{math.NaN(), math.Inf(1), 1e19} {
+		err := New([]int{CONST_F64, f64(f), F2I}, 0, 0, Options{}).Run()
+		if fault, ok := err.(*Fault); !ok || fault.Kind != BadConversion {
+			t.Errorf("F2I %v: expected bad conversion, got %v", f, err)
+		}
+	}
+}
+
+func TestLogicalInstructions(t *testing.T) {
+	code := []int{
+		CONST_BOOL, 1, CONST_BOOL, 0, AND_I32, PRINT,
+		CONST_BOOL, 1, CONST_BOOL, 0, OR_I32, PRINT,
+		CONST_BOOL, 1, CONST_BOOL, 1, XOR_I32, PRINT,
+		CONST_BOOL, 0, NOT_I32, PRINT,
+		HALT,
+	}
+
+	if out := run(t, code, 0, 0); out != "false\ntrue\nfalse\ntrue\n" {
+		t.Errorf("Expected false, true, false, true, got %q", out)
+	}
+}
+
+func TestTypeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		code []int
+	}{
+		{"int add of float", []int{CONST_I32, 1, CONST_F64, f64(1), ADD_I32}},
+		{"float add of int", []int{CONST_F64, f64(1), CONST_I32, 1, ADD_F64}},
+		{"jump on int", []int{CONST_I32, 1, JMPT, 0}},
+		{"and of int and bool", []int{CONST_I32, 1, CONST_BOOL, 1, AND_I32}},
+		{"not of float", []int{CONST_F64, f64(1), NOT_I32}},
+		{"gload of bool", []int{CONST_BOOL, 0, GLOAD}},
+		{"i2f of float", []int{CONST_F64, f64(1), I2F}},
+	}
+
+	for _, test := range tests {
+		err := New(test.code, 0, 1, Options{}).Run()
+		if fault, ok := err.(*Fault); !ok || fault.Kind != TypeError {
+			t.Errorf("%s: expected type error, got %v", test.name, err)
+		}
+	}
+}
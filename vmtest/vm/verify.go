@@ -0,0 +1,319 @@
+package vm
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Static checks of a module before it is run. The verifier decodes the
+// instruction stream, checks operands that can be known statically (branch
+// targets, global addresses, constant indexes) and then follows every path
+// through each function, the entry point and every CALL and SPAWN target,
+// tracking the number of values on the stack, the number of local slots
+// and the number of TRY handlers installed. Inside a TRY nothing may pop
+// the values pushed before it, which the handler gets back. It does not
+// check value kinds, which are only known at run time.
+
+// Diagnostic is a problem found by Verify
+type Diagnostic struct {
+	Addr int
+	Msg  string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%d: %s", d.Addr, d.Msg)
+}
+
+// Verify returns the problems found in the module, ordered by address. A
+// module without diagnostics can still fault at run time, e.g. on a type
+// error, but will not execute operands as opcodes or jump outside the code.
+func Verify(m *Module) []Diagnostic {
+	return analyze(m).diagnostics
+}
+
+// analyze runs the checks, keeping the frame states found for use by the
+// register translator
+func analyze(m *Module) *verifier {
+	v := &verifier{
+		module:       m,
+		instructions: map[int]verifiedInstruction{},
+		seen:         map[Diagnostic]bool{},
+		functions:    map[int]map[int]frameState{},
+		scopes:       []tryScope{{}},
+		scopeIndex:   map[tryScope]int{},
+	}
+
+	v.decode()
+	v.checkOperands()
+	v.checkFunctions()
+
+	sort.SliceStable(v.diagnostics, func(i, j int) bool {
+		return v.diagnostics[i].Addr < v.diagnostics[j].Addr
+	})
+	return v
+}
+
+type verifiedInstruction struct {
+	code     int
+	op       Opcode
+	operands []int
+	next     int // address of the following instruction
+}
+
+// frameState is what the verifier knows about a frame at an instruction
+type frameState struct {
+	depth    int // values on the stack above the local slots
+	slots    int // arguments plus ENTER locals
+	handlers int // TRYs without their END_TRY yet
+	try      int // innermost of them, an index into verifier.scopes, 0 for none
+}
+
+// tryScope is a TRY and the stack depth it was installed at. Scopes are
+// shared by every path through the same nesting of TRYs, so frame states
+// can be compared.
+type tryScope struct {
+	addr   int // address of the TRY
+	depth  int // values on the stack when it was installed
+	parent int // enclosing scope, 0 for none
+}
+
+type verifier struct {
+	module       *Module
+	instructions map[int]verifiedInstruction // by address, only valid instructions
+	diagnostics  []Diagnostic
+	seen         map[Diagnostic]bool
+	functions    map[int]map[int]frameState // function start -> address -> state on entry
+	scopes       []tryScope                 // TRY scopes by index, 0 is outside any
+	scopeIndex   map[tryScope]int
+}
+
+func (v *verifier) report(addr int, format string, args ...interface{}) {
+	d := Diagnostic{addr, fmt.Sprintf(format, args...)}
+	if !v.seen[d] {
+		v.seen[d] = true
+		v.diagnostics = append(v.diagnostics, d)
+	}
+}
+
+// decode walks the code once, recording the instruction boundaries
+func (v *verifier) decode() {
+	code := v.module.Code
+	for pc := 0; pc < len(code); {
+		op, ok := LookupOpcode(code[pc])
+		if !ok {
+			v.report(pc, "invalid opcode %d", code[pc])
+			pc++
+			continue
+		}
+
+		next := pc + 1 + op.Operands
+		if next > len(code) {
+			v.report(pc, "%s truncated, expects %d operand(s), got %d", op.Name, op.Operands, len(code)-pc-1)
+			return
+		}
+
+		v.instructions[pc] = verifiedInstruction{code[pc], op, code[pc+1 : next], next}
+		pc = next
+	}
+}
+
+// scope returns the index of a TRY scope, adding it on first use
+func (v *verifier) scope(s tryScope) int {
+	n, ok := v.scopeIndex[s]
+	if !ok {
+		n = len(v.scopes)
+		v.scopes = append(v.scopes, s)
+		v.scopeIndex[s] = n
+	}
+	return n
+}
+
+// target reports whether addr is the start of an instruction. The end of
+// the code is also valid, running off the end halts the program.
+func (v *verifier) target(addr int) bool {
+	_, ok := v.instructions[addr]
+	return ok || addr == len(v.module.Code)
+}
+
+// checkOperands validates operands that do not depend on the path taken
+func (v *verifier) checkOperands() {
+	m := v.module
+	if !v.target(m.Entry) {
+		v.report(m.Entry, "entry point is not an instruction")
+	}
+
+	for addr, ins := range v.instructions {
+		if ins.op.Branch && !v.target(ins.operands[0]) {
+			v.report(addr, "%s target %d is not an instruction", ins.op.Name, ins.operands[0])
+		}
+
+		switch ins.code {
+		case GSTORE:
+			if ins.operands[0] < 0 || ins.operands[0] >= m.DataSize {
+				v.report(addr, "global address %d outside data size %d", ins.operands[0], m.DataSize)
+			}
+		case CONST_STR:
+			if ins.operands[0] < 0 || ins.operands[0] >= len(m.Consts) {
+				v.report(addr, "constant %d outside pool of %d", ins.operands[0], len(m.Consts))
+			}
+		case ENTER:
+			if ins.operands[0] < 0 {
+				v.report(addr, "negative local count %d", ins.operands[0])
+			}
+		case CALL, SPAWN:
+			if ins.operands[1] < 0 {
+				v.report(addr, "negative argument count %d", ins.operands[1])
+			}
+		case SELECT:
+			if ins.operands[0] < 1 {
+				v.report(addr, "SELECT of %d channel(s)", ins.operands[0])
+			}
+			if ins.operands[1] != 0 && ins.operands[1] != 1 {
+				v.report(addr, "SELECT wait %d is not 0 or 1", ins.operands[1])
+			}
+		case CALL_NATIVE:
+			if ins.operands[0] < 0 {
+				v.report(addr, "negative native index %d", ins.operands[0])
+			}
+			if ins.operands[1] < 0 {
+				v.report(addr, "negative argument count %d", ins.operands[1])
+			}
+		}
+	}
+}
+
+// checkFunctions follows the paths through the top level program and
+// every function
+func (v *verifier) checkFunctions() {
+	// argument count of each function, from its call sites
+	argcs := map[int]int{}
+	var addrs []int
+	for addr := range v.instructions {
+		addrs = append(addrs, addr)
+	}
+	sort.Ints(addrs)
+
+	var functions []int
+	for _, addr := range addrs {
+		ins := v.instructions[addr]
+		if (ins.code != CALL && ins.code != SPAWN) || !v.target(ins.operands[0]) || ins.operands[1] < 0 {
+			continue
+		}
+
+		fn, argc := ins.operands[0], ins.operands[1]
+		if previous, ok := argcs[fn]; !ok {
+			argcs[fn] = argc
+			functions = append(functions, fn)
+		} else if previous != argc {
+			v.report(addr, "%s %d with %d argument(s), other calls pass %d", ins.op.Name, fn, argc, previous)
+		}
+	}
+
+	if v.target(v.module.Entry) {
+		v.checkPaths(v.module.Entry, 0, true)
+	}
+	for _, fn := range functions {
+		v.checkPaths(fn, argcs[fn], false)
+	}
+}
+
+// checkPaths walks every instruction reachable from the start of a
+// function, making sure each one is reached with the same frame state
+func (v *verifier) checkPaths(start int, argc int, topLevel bool) {
+	states := map[int]frameState{start: {depth: 0, slots: argc}}
+	v.functions[start] = states
+	pending := []int{start}
+
+	// visit records the state at a successor, queueing it on first visit
+	visit := func(from, addr int, state frameState) {
+		if addr == len(v.module.Code) || !v.target(addr) {
+			return // halts, or an invalid target which is already reported
+		}
+		if previous, ok := states[addr]; ok {
+			if previous.depth != state.depth {
+				v.report(from, "inconsistent stack depth at %d: %d on one path, %d on another", addr, previous.depth, state.depth)
+			} else if previous.slots != state.slots {
+				v.report(from, "inconsistent locals at %d: %d on one path, %d on another", addr, previous.slots, state.slots)
+			} else if previous.handlers != state.handlers {
+				v.report(from, "inconsistent handlers at %d: %d on one path, %d on another", addr, previous.handlers, state.handlers)
+			} else if previous.try != state.try {
+				v.report(from, "inconsistent handlers at %d: TRY at %d on one path, at %d on another", addr, v.scopes[previous.try].addr, v.scopes[state.try].addr)
+			}
+			return
+		}
+		states[addr] = state
+		pending = append(pending, addr)
+	}
+
+	for len(pending) > 0 {
+		addr := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		ins := v.instructions[addr]
+		state := states[addr]
+
+		pops := ins.op.Pops
+		switch ins.code {
+		case CALL, CALL_NATIVE, SPAWN:
+			pops += ins.operands[1]
+		case SELECT:
+			pops += ins.operands[0]
+		}
+		if state.depth < pops {
+			v.report(addr, "stack underflow: %s needs %d value(s), %d on the stack", ins.op.Name, pops, state.depth)
+			continue
+		}
+		if s := v.scopes[state.try]; state.try != 0 && state.depth-pops < s.depth {
+			// a fault here could not be caught, the handler's values are gone
+			v.report(addr, "%s pops %d value(s) pushed before the TRY at %d", ins.op.Name, s.depth-(state.depth-pops), s.addr)
+			continue
+		}
+
+		switch ins.code {
+		case LOAD, STORE:
+			if slot := ins.operands[0]; slot < 0 || slot >= state.slots {
+				v.report(addr, "local slot %d, frame has %d", slot, state.slots)
+			}
+		case ENTER:
+			if state.depth != 0 {
+				v.report(addr, "ENTER with %d value(s) on the stack", state.depth)
+			}
+			if ins.operands[0] > 0 {
+				state.slots += ins.operands[0]
+			}
+		case RET:
+			if topLevel {
+				v.report(addr, "RET outside of a function")
+			}
+			continue
+		case END_TRY:
+			if state.handlers == 0 {
+				v.report(addr, "END_TRY without a TRY")
+				continue
+			}
+			state.handlers--
+			state.try = v.scopes[state.try].parent
+		case HALT, THROW:
+			continue
+		}
+
+		state.depth += ins.op.Pushes - pops
+		if state.slots+state.depth > STACK_SIZE {
+			v.report(addr, "stack depth %d exceeds stack size %d", state.slots+state.depth, STACK_SIZE)
+			continue
+		}
+
+		switch {
+		case ins.code == TRY:
+			// the handler starts with the thrown value on the stack
+			visit(addr, ins.operands[0], frameState{state.depth + 1, state.slots, state.handlers, state.try})
+			state.handlers++
+			state.try = v.scope(tryScope{addr, state.depth, state.try})
+		case ins.op.Branch && ins.code != CALL && ins.code != SPAWN:
+			visit(addr, ins.operands[0], state)
+		}
+		if ins.code != JMP {
+			visit(addr, ins.next, state)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVerifyValidPrograms(t *testing.T) {
+	programs := map[string]*Module{
+		"fibonacci": {Code: fibonacci, Entry: fibMain},
+		"alloc":     {Code: allocLoop(10), DataSize: 2, Consts: []string{"s"}},
+		"locals": {Code: []int{
+			ENTER, 2, LOAD, 0, CONST_I32, 3, LT_I32, JMPF, 12, CONST_I32, 1, RET,
+			LOAD, 0, CONST_I32, 1, SUB_I32, CALL, 0, 1, STORE, 1,
+			LOAD, 1, RET,
+			CONST_I32, 20, CALL, 0, 1, PRINT, HALT,
+		}, Entry: 25},
+		"nested try": {Code: []int{
+			TRY, 13, // 0
+			CONST_I32, 1, // 2
+			TRY, 10, // 4
+			END_TRY,      // 6 - back in the outer TRY, which pushed the 1
+			POP, END_TRY, // 7
+			HALT,           // 9
+			POP, POP, HALT, // 10 - inner catch
+			POP, HALT, // 13 - outer catch
+		}},
+	}
+
+	for name, m := range programs {
+		if diagnostics := Verify(m); len(diagnostics) != 0 {
+			t.Errorf("%s: expected no diagnostics, got %v", name, diagnostics)
+		}
+	}
+}
+
+func TestVerifyDiagnostics(t *testing.T) {
+	tests := []struct {
+		name string
+		m    *Module
+		addr int
+		msg  string
+	}{
+		{"invalid opcode", &Module{Code: []int{999}}, 0, "invalid opcode 999"},
+		{"truncated", &Module{Code: []int{CONST_I32, 1, JMP}}, 2, "JMP truncated"},
+		{"jump into operand", &Module{Code: []int{CONST_I32, 1, JMP, 1}}, 2, "JMP target 1 is not an instruction"},
+		{"jump outside code", &Module{Code: []int{JMP, 10}}, 0, "JMP target 10 is not an instruction"},
+		{"entry", &Module{Code: []int{CONST_I32, 1, HALT}, Entry: 1}, 1, "entry point is not an instruction"},
+		{"gstore", &Module{Code: []int{CONST_I32, 1, GSTORE, 2}, DataSize: 2}, 2, "global address 2 outside data size 2"},
+		{"constant", &Module{Code: []int{CONST_STR, 0}}, 0, "constant 0 outside pool of 0"},
+		{"underflow", &Module{Code: []int{CONST_I32, 1, ADD_I32}}, 2, "ADD_I32 needs 2 value(s), 1 on the stack"},
+		{"call argc", &Module{Code: []int{CONST_I32, 1, CALL, 6, 2, HALT, CONST_I32, 0, RET}}, 2, "CALL needs 2 value(s), 1 on the stack"},
+		{"call conflict", &Module{Code: []int{CALL, 8, 0, POP, CALL, 8, 1, HALT, CONST_I32, 0, RET}}, 4, "CALL 8 with 1 argument(s), other calls pass 0"},
+		{"ret top level", &Module{Code: []int{CONST_I32, 1, RET}}, 2, "RET outside of a function"},
+		{"ret empty", &Module{Code: []int{CALL, 4, 0, HALT, RET}}, 4, "RET needs 1 value(s), 0 on the stack"},
+		{"load slot", &Module{Code: []int{CALL, 4, 0, HALT, LOAD, 0, RET}}, 4, "local slot 0, frame has 0"},
+		{"enter", &Module{Code: []int{CONST_I32, 1, ENTER, 1}}, 2, "ENTER with 1 value(s) on the stack"},
+		{"loop grows stack", &Module{Code: []int{CONST_I32, 1, JMP, 0}}, 2, "inconsistent stack depth at 0: 0 on one path, 1 on another"},
+		{"branches disagree", &Module{Code: []int{
+			CONST_BOOL, 1, JMPT, 7, // 0
+			CONST_I32, 1, // 4 - pushes on one path only
+			DUP,  // 6
+			HALT, // 7
+		}}, 6, "inconsistent stack depth at 7: 0 on one path, 2 on another"},
+		{"end try", &Module{Code: []int{END_TRY, HALT}}, 0, "END_TRY without a TRY"},
+		{"handlers disagree", &Module{Code: []int{
+			CONST_BOOL, 1, JMPT, 8, // 0
+			TRY, 9, // 4
+			JMP, 8, // 6 - the handler is still installed
+			HALT,      // 8
+			POP, HALT, // 9 - catch
+		}}, 6, "inconsistent handlers at 8: 0 on one path, 1 on another"},
+		{"catch depth", &Module{Code: []int{
+			TRY, 4, // 0
+			JMP, 4, // 2 - joins the catch without a value
+			POP, HALT, // 4
+		}}, 2, "inconsistent stack depth at 4: 1 on one path, 0 on another"},
+		{"pops below try", &Module{Code: []int{
+			CONST_I32, 1, // 0
+			TRY, 11, // 2
+			CONST_I32, 0, DIV_I32, // 4 - pops the 1 pushed before the TRY
+			END_TRY, PRINT, HALT, HALT, // 7
+			PRINT, POP, HALT, // 11 - catch
+		}}, 6, "DIV_I32 pops 1 value(s) pushed before the TRY at 2"},
+		{"overflow", &Module{Code: append(repeat([]int{CONST_I32, 0}, STACK_SIZE+1), HALT)}, 2 * STACK_SIZE, "exceeds stack size"},
+	}
+
+	for _, test := range tests {
+		diagnostics := Verify(test.m)
+		found := false
+		for _, d := range diagnostics {
+			if d.Addr == test.addr && strings.Contains(d.Msg, test.msg) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s: expected %d: %q, got %v", test.name, test.addr, test.msg, diagnostics)
+		}
+	}
+}
+
+func repeat(code []int, n int) []int {
+	var out []int
+	for i := 0; i < n; i++ {
+		out = append(out, code...)
+	}
+	return out
+}
@@ -1,7 +1,12 @@
 package vm
 
 import (
+	"bufio"
+	"context"
 	"fmt"
+	"io"
+	"math"
+	"os"
 )
 
 // Based on: http://bartoszsypytkowski.com/simple-virtual-machine/
@@ -17,58 +22,190 @@ import (
 
 const STACK_SIZE int = 100
 
+// MAX_CALL_DEPTH limits recursion, functions without arguments or locals
+// use no stack
+const MAX_CALL_DEPTH int = 1000
+
+// frame is a function activation. Its local slots live on the stack from
+// base: first the arguments pushed by the caller, then the locals reserved
+// by ENTER. The function's working values are pushed above them. The
+// bottom frame is the top level program, which has no arguments but can
+// still ENTER locals.
+type frame struct {
+	ret  int // return address
+	base int // stack index of slot 0
+	size int // number of slots, arguments plus locals
+	fn   int // address of the function, the entry point for the bottom frame
+
+	stack int // call stack in the profile, see Profile.push
+}
+
+// Options configures a vm
+type Options struct {
+	Stdout io.Writer // PRINT output, defaults to os.Stdout
+	Stdin  io.Reader // READ input, defaults to os.Stdin
+	Trace  io.Writer // an event per executed instruction, disabled when nil, see trace.go
+
+	TraceFormat TraceFormat // format of Trace, JSON lines by default
+
+	GCThreshold int // heap bytes before the first collection, defaults to DefaultGCThreshold
+
+	// Limits for running untrusted programs, zero means unlimited. Each
+	// fails with its own FaultKind.
+	MaxInstructions int64 // instructions executed, InstructionLimit
+	MaxStackDepth   int   // stack size in values instead of STACK_SIZE, StackLimit
+	MaxHeapBytes    int   // live heap and thread bytes after a collection, HeapLimit
+
+	Profile *Profile // counts executed instructions when set, see NewProfile
+}
+
 type vm struct {
-	locals []int // local scoped data
-	code   []int // array od byte codes to be executed
-	stack  []int // virtual stack
-	pc     int   // program counter (aka. IP - instruction pointer)
-	sp     int   // stack pointer
-	fp     int   // frame pointer (for local scope)
+	locals   []Value   // local scoped data
+	code     []int     // array od byte codes to be executed
+	stack    []Value   // virtual stack
+	pc       int       // program counter (aka. IP - instruction pointer)
+	ip       int       // address of the instruction being executed
+	sp       int       // stack pointer
+	fp       int       // frame pointer, stack index of local slot 0 of the current frame
+	frames   []frame   // call frames, the last is the current one
+	handlers []handler // active TRY handlers, the last is the innermost
+
+	threads  []*thread // live threads, the main thread first, once one is spawned
+	current  *thread   // thread the registers belong to, nil until then
+	runnable []*thread // threads waiting for their turn, in order
+	threadID int       // id of the most recent thread
+	halted   bool      // set by HALT
+
+	heap        []*object // strings and arrays, referenced by index
+	heapBytes   int       // accounted size of the heap objects
+	threadBytes int       // accounted size of the spawned threads, see threadSize
+	free        []int     // heap slots released by the garbage collector
+	consts      []string  // constant pool
+	natives     []native  // Go functions for CALL_NATIVE
+
+	gcThreshold int   // minimum heap size that triggers a collection
+	nextGC      int   // heap size that triggers the next collection
+	gcStats     Stats // collector counters
+
+	executed        int64     // instructions executed
+	maxInstructions int64     // see Options.MaxInstructions
+	maxHeapBytes    int       // see Options.MaxHeapBytes
+	stackFault      FaultKind // raised when the stack is full
+
+	profile *Profile
+	ops     []compiledOp // closures by address once compiled, see Compile
+
+	tracer       *tracer
+	tracing      bool // Options.Trace was given
+	instrumented bool // any of maxInstructions, profile or tracing is set
+
+	stdout io.Writer
+	stdin  *bufio.Reader
 }
 
-func New(code []int, pc int, datasize int) *vm {
+func New(code []int, pc int, datasize int, opts Options) *vm {
+	if opts.Stdout == nil {
+		opts.Stdout = os.Stdout
+	}
+	if opts.Stdin == nil {
+		opts.Stdin = os.Stdin
+	}
+	if opts.GCThreshold <= 0 {
+		opts.GCThreshold = DefaultGCThreshold
+	}
+
+	stackSize, stackFault := STACK_SIZE, StackOverflow
+	if opts.MaxStackDepth > 0 {
+		stackSize, stackFault = opts.MaxStackDepth, StackLimit
+	}
+
+	var trace *tracer
+	if opts.Trace != nil {
+		trace = newTracer(opts.Trace, opts.TraceFormat)
+	}
+
 	return &vm{
-		locals: make([]int, datasize),
+		locals: make([]Value, datasize),
 		code:   code,
-		stack:  make([]int, STACK_SIZE),
+		stack:  make([]Value, stackSize),
 		pc:     pc,
 		sp:     -1,
 		fp:     0,
+		frames: []frame{{ret: -1, fn: pc}},
+		stdout: opts.Stdout,
+		stdin:  bufio.NewReader(opts.Stdin),
+
+		gcThreshold: opts.GCThreshold,
+		nextGC:      opts.GCThreshold,
+
+		maxInstructions: opts.MaxInstructions,
+		maxHeapBytes:    opts.MaxHeapBytes,
+		stackFault:      stackFault,
+
+		profile: opts.Profile,
+
+		tracer:       trace,
+		tracing:      trace != nil,
+		instrumented: trace != nil || opts.Profile != nil || opts.MaxInstructions > 0,
 	}
 }
 
+// The stack and code accessors run for every instruction. They are kept
+// small enough to be inlined by raising a trap rather than calling fault.
+
 // #define PUSH(vm, v) vm->stack[++vm->sp] = v // push value on top of the stack
-func (machine *vm) StackPush(value int) {
-	machine.sp++
-	machine.stack[machine.sp] = value
+func (machine *vm) StackPush(value Value) {
+	sp := machine.sp + 1
+	if sp >= len(machine.stack) {
+		panic(trapOverflow)
+	}
+	machine.stack[sp] = value
+	machine.sp = sp
 }
 
-//#define POP(vm)     vm->stack[vm->sp--]     // pop value from top of the stack
-func (machine *vm) StackPop() int {
-	defer func() {
-		// cleanup the stack
-		machine.stack[machine.sp] = 0
-		machine.sp--
-	}()
-
-	return machine.stack[machine.sp]
+// #define POP(vm)     vm->stack[vm->sp--]     // pop value from top of the stack
+func (machine *vm) StackPop() Value {
+	sp := machine.sp
+	if sp < 0 {
+		panic(trapUnderflow)
+	}
+	value := machine.stack[sp]
+	machine.stack[sp] = Value{} // cleanup the stack
+	machine.sp = sp - 1
+	return value
 }
 
-//#define NCODE(vm)   vm->code[vm->pc++]      // get next bytecode
+// #define NCODE(vm)   vm->code[vm->pc++]      // get next bytecode
 func (machine *vm) Next() int {
-	defer func() {
-		machine.pc++
-	}()
+	pc := machine.pc
+	machine.pc = pc + 1
+	if uint(pc) < uint(len(machine.code)) {
+		return machine.code[pc]
+	}
+	return machine.endOfCode(pc)
+}
 
-	if machine.pc < len(machine.code) {
-		return machine.code[machine.pc]
-	} else {
-		fmt.Println("End of program")
-		return HALT
+// operand is Next for the operands of the instruction being executed,
+// which always follow a valid address
+func (machine *vm) operand() int {
+	pc := machine.pc
+	machine.pc = pc + 1
+	if pc < len(machine.code) {
+		return machine.code[pc]
 	}
+	return HALT
 }
 
-var EMPTY_STACK []int = []int{}
+// endOfCode is Next for an address outside the code, running off the end
+// halts the program
+func (machine *vm) endOfCode(pc int) int {
+	if pc < 0 {
+		machine.fault(BadAddress, "code address %d", pc)
+	}
+	return HALT
+}
+
+var EMPTY_STACK []Value = []Value{}
 
 func (machine *vm) String() string {
 	stack := EMPTY_STACK
@@ -79,111 +216,512 @@ func (machine *vm) String() string {
 	return fmt.Sprintf(" SP:%d, Stack:%v, PC:%d, Prog:%v", machine.sp, stack, machine.pc-1, machine.code)
 }
 
-func (machine *vm) Run() {
+// global returns a checked index into global memory
+func (machine *vm) global(addr int) int {
+	if addr < 0 || addr >= len(machine.locals) {
+		machine.fault(BadAddress, "global address %d, data size %d", addr, len(machine.locals))
+	}
+	return addr
+}
+
+// local returns the stack index of a slot in the current frame, slot is
+// the operand of the instruction being executed
+func (machine *vm) local(slot int) int {
+	if uint(slot) >= uint(machine.frames[len(machine.frames)-1].size) {
+		panic(trapLocal)
+	}
+	return machine.fp + slot
+}
+
+// popKind pops a value, faulting unless it has the expected kind
+func (machine *vm) popKind(kind Kind) Value {
+	value := machine.StackPop()
+	if value.Kind != kind {
+		machine.typeError(kind, value)
+	}
+	return value
+}
+
+func (machine *vm) typeError(kind Kind, value Value) {
+	machine.fault(TypeError, "expected %s, got %s %v", kind, value.Kind, value)
+}
+
+func (machine *vm) popInt() int64 {
+	return machine.popKind(KindInt).AsInt()
+}
+
+func (machine *vm) popFloat() float64 {
+	return machine.popKind(KindFloat).AsFloat()
+}
+
+func (machine *vm) popBool() bool {
+	return machine.popKind(KindBool).AsBool()
+}
+
+// Binary instructions pop their operands right hand side first, as they
+// were pushed left to right. So for a - b, b is on top of the stack.
+
+func (machine *vm) pop2() (a, b Value) {
+	b = machine.StackPop()
+	a = machine.StackPop()
+	return a, b
+}
+
+// pop2Int and pop2Float check both operands at once in the common case,
+// falling back to popping one at a time to raise the same fault as before
+// when they are missing or of the wrong kind
+
+func (machine *vm) pop2Int() (a, b int64) {
+	sp := machine.sp
+	if sp < 1 || machine.stack[sp].Kind != KindInt || machine.stack[sp-1].Kind != KindInt {
+		return machine.pop2Checked()
+	}
+	a, b = int64(machine.stack[sp-1].bits), int64(machine.stack[sp].bits)
+	machine.sp = sp - 2
+	return a, b
+}
+
+func (machine *vm) pop2Checked() (a, b int64) {
+	b = machine.popInt()
+	a = machine.popInt()
+	return a, b
+}
+
+func (machine *vm) pop2Float() (a, b float64) {
+	sp := machine.sp
+	if sp < 1 || machine.stack[sp].Kind != KindFloat || machine.stack[sp-1].Kind != KindFloat {
+		b = machine.popFloat()
+		a = machine.popFloat()
+		return a, b
+	}
+	a, b = machine.stack[sp-1].AsFloat(), machine.stack[sp].AsFloat()
+	machine.sp = sp - 2
+	return a, b
+}
+
+// Run executes the program until HALT. Runtime errors stop execution and
+// are returned as a *Fault.
+func (machine *vm) Run() error {
+	return machine.RunContext(context.Background())
+}
+
+// cancelCheckInterval is how many instructions RunContext executes between
+// polls of the context
+const cancelCheckInterval = 1024
+
+// RunContext is Run, stopping with a Canceled fault once ctx is done. Use
+// context.WithTimeout to bound the wall clock time of a program.
+func (machine *vm) RunContext(ctx context.Context) error {
 	for {
-		code := machine.Next()
-
-		fmt.Println(machine)
-
-		switch code {
-		case CONST_I32:
-			value := machine.Next()
-			machine.StackPush(value)
-		case ADD_I32:
-			a := machine.StackPop()
-			b := machine.StackPop()
-			machine.StackPush(a + b)
-		case SUB_I32:
-			b := machine.StackPop()
-			a := machine.StackPop()
-			machine.StackPush(a - b)
-		case MUL_I32:
-			a := machine.StackPop()
-			b := machine.StackPop()
-			machine.StackPush(a * b)
-		case LT_I32:
-			b := machine.StackPop()
-			a := machine.StackPop()
-			if a < b {
-				machine.StackPush(1)
-			} else {
-				machine.StackPush(0)
-			}
-		case EQ_I32:
-			a := machine.StackPop()
-			b := machine.StackPop()
-			if a == b {
-				machine.StackPush(1)
-			} else {
-				machine.StackPush(0)
-			}
-		case JMP:
-			machine.pc = machine.Next()
+		err := machine.run(ctx)
+		if err == nil {
+			return nil
+		}
+		// a caught fault continues at the handler
+		if err = machine.handle(err); err != nil {
+			return err
+		}
+	}
+}
 
-		case JMPF: // jump if false
-			addr := machine.Next()
-			value := machine.StackPop()
+// run executes instructions until HALT or a fault
+func (machine *vm) run(ctx context.Context) (err error) {
+	defer machine.recoverFault(&err)
 
-			if value == 0 {
-				machine.pc = addr
+	done := ctx.Done()
+	if machine.ops != nil {
+		return machine.runCompiled(ctx)
+	}
+	for !machine.halted {
+		if done != nil && machine.executed%cancelCheckInterval == 0 {
+			if err := machine.canceled(ctx); err != nil {
+				return err
 			}
-		case JMPT: // jump if true
-			addr := machine.Next()
-			value := machine.StackPop()
+		}
+		machine.step()
+	}
+	return nil
+}
 
-			if value == 1 {
-				machine.pc = addr
-			}
-		case GLOAD:
-			addr := machine.StackPop()
-			value := machine.locals[addr] // read from global memory
-			machine.StackPush(value)
-		case GSTORE:
-			value := machine.StackPop()
-			addr := machine.Next()
-			machine.locals[addr] = value // store in global memory
-		case STORE:
-			value := machine.StackPop()
-			offset := machine.Next()
-			machine.locals[machine.fp+offset] = value
-		case LOAD:
-			offset := machine.Next()
-			machine.StackPush(machine.stack[machine.fp+offset])
-		case CALL:
-			addr := machine.Next()
-			argc := machine.Next()
-
-			machine.StackPush(argc)       // number of args
-			machine.StackPush(machine.fp) // function pointer
-			machine.StackPush(machine.pc) // program counter
-			machine.fp = machine.sp       // frame pointer points to bottom of stack for this frame
-			machine.pc = addr             // program counter jumps to function
-		case RET:
-			rval := machine.StackPop() // should contain the return value
-
-			machine.sp = machine.fp         // should return sp to the stack as it was at the start of the frame
-			machine.pc = machine.StackPop() // previous program counter
-			machine.fp = machine.StackPop() // restore previous fp
-
-			argc := machine.StackPop()
-
-			for argc > 0 {
-				machine.StackPop() // pop arguments off stack
-				argc--
-			}
+// canceled returns a Canceled fault once ctx is done
+func (machine *vm) canceled(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		machine.ip = machine.pc
+		return machine.newFault(Canceled, ctx.Err(), "%v", ctx.Err())
+	default:
+		return nil
+	}
+}
+
+// Step executes a single instruction, it does nothing once the program
+// has halted. Runtime errors are returned as a *Fault.
+func (machine *vm) Step() error {
+	if err := machine.stepOnce(); err != nil {
+		return machine.handle(err)
+	}
+	return nil
+}
+
+func (machine *vm) stepOnce() (err error) {
+	defer machine.recoverFault(&err)
+
+	if !machine.halted {
+		machine.step()
+	}
+	return nil
+}
 
-			machine.StackPush(rval)
+// Halted reports whether the program has executed HALT
+func (machine *vm) Halted() bool {
+	return machine.halted
+}
 
-		case POP:
-			machine.StackPop()
-		case PRINT:
-			value := machine.StackPop() // pop value from top of the stack ...
-			fmt.Printf("%d\n", value)   // ... and print it
-		case HALT:
-			fmt.Println("Halting")
-			return
+// instrument runs the optional per instruction work before code is
+// executed: the instruction limit, profiling and tracing. It is kept out of
+// step, which only tests the instrumented flag.
+func (machine *vm) instrument(code int) {
+	if machine.maxInstructions > 0 && machine.executed > machine.maxInstructions {
+		machine.executed--
+		machine.fault(InstructionLimit, "%d instructions executed", machine.executed)
+	}
+	if machine.profile != nil {
+		machine.profile.record(machine, code)
+	}
+	if machine.tracing {
+		machine.tracer.begin(machine, code)
+	}
+}
+
+// recoverFault is deferred by the entry points into the interpreter to turn
+// a fault raised while executing an instruction into an error
+func (machine *vm) recoverFault(err *error) {
+	if r := recover(); r != nil {
+		switch r := r.(type) {
+		case *Fault:
+			*err = r
+		case trap:
+			*err = machine.trapFault(r)
 		default:
-			fmt.Printf("ERROR: invalid opcode '%d'\n", code)
+			panic(r)
 		}
 	}
+	if machine.tracing {
+		machine.tracer.finish(*err)
+	}
+}
+
+// step executes the instruction at pc
+func (machine *vm) step() {
+	pc := machine.pc
+	machine.ip = pc
+
+	var code int
+	if uint(pc) < uint(len(machine.code)) {
+		code = machine.code[pc]
+		machine.pc = pc + 1
+	} else {
+		code = machine.Next()
+	}
+	machine.executed++
+
+	if machine.instrumented {
+		machine.instrument(code)
+	}
+
+	switch code {
+	case CONST_I32:
+		machine.StackPush(Int(int64(machine.operand())))
+	case CONST_F64:
+		machine.StackPush(Float(math.Float64frombits(uint64(machine.operand()))))
+	case CONST_BOOL:
+		machine.StackPush(Bool(machine.operand() != 0))
+	case ADD_I32:
+		a, b := machine.pop2Int()
+		machine.StackPush(Int(a + b))
+	case SUB_I32:
+		a, b := machine.pop2Int()
+		machine.StackPush(Int(a - b))
+	case MUL_I32:
+		a, b := machine.pop2Int()
+		machine.StackPush(Int(a * b))
+	case DIV_I32:
+		value, f := divInt(machine.pop2Int())
+		if f != nil {
+			machine.raise(f)
+		}
+		machine.StackPush(Int(value))
+	case MOD_I32:
+		value, f := modInt(machine.pop2Int())
+		if f != nil {
+			machine.raise(f)
+		}
+		machine.StackPush(Int(value))
+	case NEG_I32:
+		machine.StackPush(Int(-machine.popInt()))
+	case AND_I32, OR_I32, XOR_I32:
+		a, b := machine.pop2()
+		value, f := logical(code, a, b)
+		if f != nil {
+			machine.raise(f)
+		}
+		machine.StackPush(value)
+	case NOT_I32:
+		value, f := not(machine.StackPop())
+		if f != nil {
+			machine.raise(f)
+		}
+		machine.StackPush(value)
+	case SHL_I32:
+		machine.StackPush(Int(shiftLeft(machine.pop2Int())))
+	case SHR_I32:
+		machine.StackPush(Int(shiftRight(machine.pop2Int())))
+	case LT_I32:
+		a, b := machine.pop2Int()
+		machine.StackPush(Bool(a < b))
+	case GT_I32:
+		a, b := machine.pop2Int()
+		machine.StackPush(Bool(a > b))
+	case LE_I32:
+		a, b := machine.pop2Int()
+		machine.StackPush(Bool(a <= b))
+	case GE_I32:
+		a, b := machine.pop2Int()
+		machine.StackPush(Bool(a >= b))
+	case EQ_I32:
+		a, b := machine.pop2Int()
+		machine.StackPush(Bool(a == b))
+	case NE_I32:
+		a, b := machine.pop2Int()
+		machine.StackPush(Bool(a != b))
+	case ADD_F64:
+		a, b := machine.pop2Float()
+		machine.StackPush(Float(a + b))
+	case SUB_F64:
+		a, b := machine.pop2Float()
+		machine.StackPush(Float(a - b))
+	case MUL_F64:
+		a, b := machine.pop2Float()
+		machine.StackPush(Float(a * b))
+	case DIV_F64:
+		a, b := machine.pop2Float() // IEEE semantics, x / 0 is +/-Inf or NaN
+		machine.StackPush(Float(a / b))
+	case NEG_F64:
+		machine.StackPush(Float(-machine.popFloat()))
+	case LT_F64:
+		a, b := machine.pop2Float()
+		machine.StackPush(Bool(a < b))
+	case GT_F64:
+		a, b := machine.pop2Float()
+		machine.StackPush(Bool(a > b))
+	case LE_F64:
+		a, b := machine.pop2Float()
+		machine.StackPush(Bool(a <= b))
+	case GE_F64:
+		a, b := machine.pop2Float()
+		machine.StackPush(Bool(a >= b))
+	case EQ_F64:
+		a, b := machine.pop2Float()
+		machine.StackPush(Bool(a == b))
+	case NE_F64:
+		a, b := machine.pop2Float()
+		machine.StackPush(Bool(a != b))
+	case I2F:
+		machine.StackPush(Float(float64(machine.popInt())))
+	case F2I:
+		value, f := f2i(machine.popFloat())
+		if f != nil {
+			machine.raise(f)
+		}
+		machine.StackPush(Int(value))
+	case DUP:
+		a := machine.StackPop()
+		machine.StackPush(a)
+		machine.StackPush(a)
+	case SWAP:
+		a, b := machine.pop2()
+		machine.StackPush(b)
+		machine.StackPush(a)
+	case OVER:
+		a, b := machine.pop2()
+		machine.StackPush(a)
+		machine.StackPush(b)
+		machine.StackPush(a)
+	case JMP:
+		machine.pc = machine.operand()
+
+	case JMPF: // jump if false
+		addr := machine.operand()
+		value := machine.popBool()
+
+		if !value {
+			machine.pc = addr
+		}
+	case JMPT: // jump if true
+		addr := machine.operand()
+		value := machine.popBool()
+
+		if value {
+			machine.pc = addr
+		}
+	case GLOAD:
+		addr := int(machine.popInt())
+		value := machine.locals[machine.global(addr)] // read from global memory
+		machine.StackPush(value)
+	case GSTORE:
+		value := machine.StackPop()
+		addr := machine.operand()
+		machine.locals[machine.global(addr)] = value // store in global memory
+	case STORE:
+		value := machine.StackPop()
+		slot := machine.operand()
+		machine.stack[machine.local(slot)] = value
+	case LOAD:
+		slot := machine.operand()
+		machine.StackPush(machine.stack[machine.local(slot)])
+	case ENTER:
+		n := machine.operand()
+		if n < 0 {
+			machine.fault(BadAddress, "negative local count %d", n)
+		}
+		for i := 0; i < n; i++ {
+			machine.StackPush(Value{})
+		}
+		machine.frames[len(machine.frames)-1].size += n
+	case CALL:
+		addr := machine.operand()
+		argc := machine.operand()
+		machine.call(addr, argc)
+	case CALL_NATIVE:
+		index := machine.operand()
+		argc := machine.operand()
+		machine.callNative(index, argc)
+	case TRY:
+		machine.handlers = append(machine.handlers, handler{catch: machine.operand(), frames: len(machine.frames), sp: machine.sp})
+	case END_TRY:
+		n := len(machine.handlers)
+		if n == 0 || machine.handlers[n-1].frames != len(machine.frames) {
+			machine.fault(BadHandler, "no TRY in the current frame")
+		}
+		machine.handlers = machine.handlers[:n-1]
+	case THROW:
+		machine.throw(machine.StackPop())
+	case SPAWN:
+		addr := machine.operand()
+		argc := machine.operand()
+		machine.spawn(addr, argc)
+	case YIELD:
+		machine.yield()
+	case MAKE_CHAN:
+		machine.makeChan()
+	case SEND:
+		machine.send()
+	case RECV:
+		machine.recv()
+	case SELECT:
+		n := machine.operand()
+		wait := machine.operand()
+		machine.selectRecv(n, wait)
+	case RET:
+		machine.ret()
+	case POP:
+		machine.StackPop()
+	case CONST_STR:
+		index := machine.operand()
+		if index < 0 || index >= len(machine.consts) {
+			machine.fault(BadAddress, "constant %d, pool size %d", index, len(machine.consts))
+		}
+		machine.StackPush(machine.NewString(machine.consts[index]))
+	case NEW_ARRAY:
+		length := machine.popInt()
+		if length < 0 {
+			machine.fault(IndexOutOfRange, "negative array length %d", length)
+		}
+		machine.StackPush(machine.NewArray(int(length)))
+	case ALOAD:
+		index := machine.popInt()
+		array := machine.deref(machine.StackPop(), KindArray).array
+		machine.StackPush(array[machine.index(index, len(array))])
+	case ASTORE:
+		value := machine.StackPop()
+		index := machine.popInt()
+		array := machine.deref(machine.StackPop(), KindArray).array
+		array[machine.index(index, len(array))] = value
+	case ALEN:
+		value := machine.StackPop()
+		if value.Kind == KindString {
+			machine.StackPush(Int(int64(len(machine.deref(value, KindString).str))))
+		} else {
+			machine.StackPush(Int(int64(len(machine.deref(value, KindArray).array))))
+		}
+	case CONCAT:
+		b := machine.deref(machine.StackPop(), KindString).str
+		a := machine.deref(machine.StackPop(), KindString).str
+		machine.StackPush(machine.NewString(a + b))
+	case PRINT:
+		value := machine.StackPop()                         // pop value from top of the stack ...
+		fmt.Fprintln(machine.stdout, machine.Format(value)) // ... and print it
+	case READ:
+		var value int64
+		if _, err := fmt.Fscan(machine.stdin, &value); err != nil {
+			machine.fault(InputError, "%v", err)
+		}
+		machine.StackPush(Int(value))
+	case HALT:
+		machine.halted = true
+	default:
+		machine.fault(BadOpcode, "opcode %d", code)
+	}
+
+	if machine.tracing {
+		machine.tracer.end(machine)
+	}
+}
+
+// call executes CALL, pc is the return address
+func (machine *vm) call(addr, argc int) {
+	current := machine.frames[len(machine.frames)-1]
+	if argc < 0 || argc > machine.sp-(current.base+current.size-1) {
+		machine.fault(StackUnderflow, "CALL with %d argument(s)", argc)
+	}
+	if len(machine.frames) >= MAX_CALL_DEPTH {
+		machine.fault(StackOverflow, "call depth %d", len(machine.frames))
+	}
+
+	// the arguments already on the stack become the first slots of the frame
+	machine.fp = machine.sp - argc + 1
+	callee := frame{ret: machine.pc, base: machine.fp, size: argc, fn: addr}
+	if machine.profile != nil {
+		callee.stack = machine.profile.push(current.stack, machine.ip, addr)
+	}
+	machine.frames = append(machine.frames, callee)
+	machine.pc = addr // program counter jumps to function
+}
+
+// ret executes RET
+func (machine *vm) ret() {
+	if len(machine.frames) == 1 {
+		if machine.current == nil || machine.current.id == 0 {
+			machine.fault(StackUnderflow, "RET outside of a function")
+		}
+		machine.exit()
+		return
+	}
+
+	rval := machine.StackPop() // should contain the return value
+
+	// discard arguments, locals and anything else left by the function
+	callee := machine.frames[len(machine.frames)-1]
+	for machine.sp >= callee.base {
+		machine.StackPop()
+	}
+
+	machine.frames = machine.frames[:len(machine.frames)-1]
+	machine.fp = machine.frames[len(machine.frames)-1].base
+	machine.pc = callee.ret
+	if n := len(machine.handlers); n > 0 && machine.handlers[n-1].frames > len(machine.frames) {
+		machine.dropHandlers()
+	}
+
+	machine.StackPush(rval)
 }
@@ -1,68 +1,248 @@
 package vm
 
 import (
+	"bytes"
+	"reflect"
+	"strings"
 	"testing"
 )
 
+// run executes code and returns everything it printed
+func run(t *testing.T, code []int, pc int, datasize int) string {
+	var out bytes.Buffer
+	if err := New(code, pc, datasize, Options{Stdout: &out}).Run(); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
 func TestAdd(t *testing.T) {
 	code := []int{
-		CONST_I32, 1,      // push 1 onto the stack
-		CONST_I32, 2,      // push 2 onto the stack
-		ADD_I32, PRINT,     // add values, result should be left on stack
+		CONST_I32, 1, // push 1 onto the stack
+		CONST_I32, 2, // push 2 onto the stack
+		ADD_I32, PRINT, // add values, result should be left on stack
 	}
 
-	New(code, 0, 0).Run()
+	if out := run(t, code, 0, 0); out != "3\n" {
+		t.Errorf("Expected 3, got %q", out)
+	}
 }
 
 func TestJmpT(t *testing.T) {
 	code := []int{
-		CONST_I32, 1,      // push 1 onto the stack
-		JMPT, 9,  // if true, jump to branch that prints 3
+		CONST_BOOL, 1, // push true onto the stack
+		JMPT, 9, // if true, jump to branch that prints 3
 		CONST_I32, 2, // otherwise print 2
-		PRINT, JMP, 12,  // then skip to end
+		PRINT, JMP, 12, // then skip to end
 		CONST_I32, 3,
 		PRINT,
 		HALT,
 	}
 
-	New(code, 0, 0).Run()
+	if out := run(t, code, 0, 0); out != "3\n" {
+		t.Errorf("Expected 3, got %q", out)
+	}
+}
+
+// fib is the address of the fibonacci procedure and fibMain the entry point
+// of the program calling it
+const fib, fibMain = 0, 38
+
+var fibonacci = []int{
+	// int fib(n) {
+	//     if(n == 0) return 0;
+	LOAD, 0, // 0 - load function argument N (slot 0)
+	CONST_I32, 0, // 2 - put 0
+	EQ_I32,   // 4 - check equality: N == 0
+	JMPF, 10, // 5 - if they are NOT equal, goto 10
+	CONST_I32, 0, // 7 - otherwise put 0
+	RET, // 9 - and return it
+	//     if(n < 3) return 1;
+	LOAD, 0, // 10 - load function argument N (slot 0)
+	CONST_I32, 3, // 12 - put 3
+	LT_I32,   // 14 - check if 3 is less than N
+	JMPF, 20, // 15 - if 3 is NOT less than N, goto 20
+	CONST_I32, 1, // 17 - otherwise put 1
+	RET, // 19 - and return it
+	//     else return fib(n-1) + fib(n-2);
+	LOAD, 0, // 20 - load function argument N (slot 0)
+	CONST_I32, 1, // 22 - put 1
+	SUB_I32,      // 24 - calculate: N-1, result is on the stack
+	CALL, fib, 1, // 25 - call fib function with 1 arg. from the stack
+	LOAD, 0, // 28 - load N again
+	CONST_I32, 2, // 30 - put 2
+	SUB_I32,      // 32 - calculate: N-2, result is on the stack
+	CALL, fib, 1, // 33 - call fib function with 1 arg. from the stack
+	ADD_I32, // 36 - since 2 fibs pushed their ret values on the stack, just add them
+	RET,     // 37 - return from procedure
+	// entrypoint - main function
+	CONST_I32, 6, // 38 - put 6
+	CALL, fib, 1, // 40 - call function: fib(arg) where arg = 6;
+	PRINT, // 43 - print result
+	HALT,  // 44 - stop program
 }
 
 func TestFibonacci(t *testing.T) {
-	fib := 0  // address of the fibonacci procedure
-	prog := []int{
-		// int fib(n) {
-		//     if(n == 0) return 0;
-		LOAD, -3,       // 0 - load last function argument N
-		CONST_I32, 0,   // 2 - put 0
-		EQ_I32,         // 4 - check equality: N == 0
-		JMPF, 10,       // 5 - if they are NOT equal, goto 10
-		CONST_I32, 0,   // 7 - otherwise put 0
-		RET,            // 9 - and return it
-		//     if(n < 3) return 1;
-		LOAD, -3,       // 10 - load last function argument N
-		CONST_I32, 3,   // 12 - put 3
-		LT_I32,         // 14 - check if 3 is less than N
-		JMPF, 20,       // 15 - if 3 is NOT less than N, goto 20
-		CONST_I32, 1,   // 17 - otherwise put 1
-		RET,            // 19 - and return it
-		//     else return fib(n-1) + fib(n-2);
-		LOAD, -3,       // 20 - load last function argument N
-		CONST_I32, 1,   // 22 - put 1
-		SUB_I32,        // 24 - calculate: N-1, result is on the stack
-		CALL, fib, 1,   // 25 - call fib function with 1 arg. from the stack
-		LOAD, -3,       // 28 - load N again
-		CONST_I32, 2,   // 30 - put 2
-		SUB_I32,        // 32 - calculate: N-2, result is on the stack
-		CALL, fib, 1,   // 33 - call fib function with 1 arg. from the stack
-		ADD_I32,        // 36 - since 2 fibs pushed their ret values on the stack, just add them
-		RET,            // 37 - return from procedure
-		// entrypoint - main function
-		CONST_I32, 6,   // 38 - put 6
-		CALL, fib, 1,   // 40 - call function: fib(arg) where arg = 6;
-		PRINT,          // 43 - print result
-		HALT,           // 44 - stop program
-	};
-
-	New(prog, 38, 0).Run()
-}
\ No newline at end of file
+	if out := run(t, fibonacci, fibMain, 0); out != "8\n" {
+		t.Errorf("Expected 8, got %q", out)
+	}
+}
+
+func TestRead(t *testing.T) {
+	code := []int{
+		READ, READ, // read two integers from input
+		MUL_I32, PRINT,
+		HALT,
+	}
+
+	var out bytes.Buffer
+	err := New(code, 0, 0, Options{Stdin: strings.NewReader("6 7\n"), Stdout: &out}).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "42\n" {
+		t.Errorf("Expected 42, got %q", out.String())
+	}
+
+	err = New(code, 0, 0, Options{Stdin: strings.NewReader("6")}).Run()
+	if fault, ok := err.(*Fault); !ok || fault.Kind != InputError || fault.PC != 1 {
+		t.Errorf("Expected input error at pc 1, got %v", err)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	var out, trace bytes.Buffer
+	err := New([]int{CONST_I32, 5, PRINT, HALT}, 0, 0, Options{Stdout: &out, Trace: &trace}).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out.String() != "5\n" {
+		t.Errorf("Expected program output 5, got %q", out.String())
+	}
+	if lines := strings.Count(trace.String(), "\n"); lines != 3 {
+		t.Errorf("Expected 3 traced instructions, got\n%s", trace.String())
+	}
+}
+
+func TestFaults(t *testing.T) {
+	overflow := []int{CONST_I32, 1, JMP, 0}
+
+	tests := []struct {
+		name string
+		code []int
+		kind FaultKind
+		pc   int
+	}{
+		{"bad opcode", []int{CONST_I32, 1, 999}, BadOpcode, 2},
+		{"underflow", []int{CONST_I32, 1, ADD_I32}, StackUnderflow, 2},
+		{"overflow", overflow, StackOverflow, 0},
+		{"gstore", []int{CONST_I32, 1, GSTORE, 5}, BadAddress, 2},
+		{"gload", []int{CONST_I32, -1, GLOAD}, BadAddress, 2},
+		{"load", []int{LOAD, 3}, BadAddress, 0},
+		{"jump", []int{JMP, -4}, BadAddress, -4},
+	}
+
+	for _, test := range tests {
+		err := New(test.code, 0, 1, Options{}).Run()
+		fault, ok := err.(*Fault)
+		if !ok {
+			t.Errorf("%s: expected *Fault, got %v", test.name, err)
+			continue
+		}
+		if fault.Kind != test.kind || fault.PC != test.pc {
+			t.Errorf("%s: expected %s at pc %d, got %v", test.name, test.kind, test.pc, fault)
+		}
+	}
+}
+
+func TestFaultStackSnapshot(t *testing.T) {
+	err := New([]int{CONST_I32, 7, CONST_I32, 8, 999}, 0, 0, Options{}).Run()
+
+	fault, ok := err.(*Fault)
+	if !ok {
+		t.Fatalf("Expected *Fault, got %v", err)
+	}
+	if !reflect.DeepEqual(fault.Stack, []Value{Int(7), Int(8)}) {
+		t.Errorf("Expected stack [7 8], got %v", fault.Stack)
+	}
+}
+
+func TestIntegerInstructions(t *testing.T) {
+	tests := []struct {
+		name     string
+		op       int
+		a, b     int
+		expected string
+	}{
+		{"add", ADD_I32, 7, 3, "10"},
+		{"sub", SUB_I32, 7, 3, "4"},
+		{"mul", MUL_I32, 7, -3, "-21"},
+		{"div", DIV_I32, 7, 2, "3"},
+		{"div negative", DIV_I32, -7, 2, "-3"},
+		{"mod", MOD_I32, 7, 3, "1"},
+		{"mod negative", MOD_I32, -7, 3, "-1"},
+		{"and", AND_I32, 12, 10, "8"},
+		{"or", OR_I32, 12, 10, "14"},
+		{"xor", XOR_I32, 12, 10, "6"},
+		{"shl", SHL_I32, 3, 4, "48"},
+		{"shr", SHR_I32, -16, 2, "-4"},
+		{"lt", LT_I32, 2, 3, "true"},
+		{"lt equal", LT_I32, 3, 3, "false"},
+		{"gt", GT_I32, 3, 2, "true"},
+		{"gt equal", GT_I32, 3, 3, "false"},
+		{"le", LE_I32, 3, 3, "true"},
+		{"le greater", LE_I32, 4, 3, "false"},
+		{"ge", GE_I32, 3, 3, "true"},
+		{"ge less", GE_I32, 2, 3, "false"},
+		{"eq", EQ_I32, 3, 3, "true"},
+		{"ne", NE_I32, 3, 3, "false"},
+		{"ne different", NE_I32, 3, 4, "true"},
+	}
+
+	for _, test := range tests {
+		code := []int{CONST_I32, test.a, CONST_I32, test.b, test.op, PRINT, HALT}
+		out := run(t, code, 0, 0)
+		if expected := test.expected + "\n"; out != expected {
+			t.Errorf("%s: %d %s %d expected %q, got %q", test.name, test.a, Opcodes[test.op].Name, test.b, expected, out)
+		}
+	}
+}
+
+func TestUnaryInstructions(t *testing.T) {
+	code := []int{
+		CONST_I32, 5, NEG_I32, PRINT,
+		CONST_I32, 5, NOT_I32, PRINT,
+		HALT,
+	}
+
+	if out := run(t, code, 0, 0); out != "-5\n-6\n" {
+		t.Errorf("Expected -5 and -6, got %q", out)
+	}
+}
+
+func TestStackInstructions(t *testing.T) {
+	code := []int{
+		CONST_I32, 1, CONST_I32, 2, // [1 2]
+		OVER,         // [1 2 1]
+		DUP,          // [1 2 1 1]
+		SWAP,         // unchanged, top two are equal
+		CONST_I32, 3, // [1 2 1 1 3]
+		SWAP, // [1 2 1 3 1]
+		PRINT, PRINT, PRINT, PRINT, PRINT,
+		HALT,
+	}
+
+	if out := run(t, code, 0, 0); out != "1\n3\n1\n2\n1\n" {
+		t.Errorf("Expected 1 3 1 2 1, got %q", out)
+	}
+}
+
+func TestDivisionByZero(t *testing.T) {
+	for _, op := range []int{DIV_I32, MOD_I32} {
+		err := New([]int{CONST_I32, 1, CONST_I32, 0, op, HALT}, 0, 0, Options{}).Run()
+		if fault, ok := err.(*Fault); !ok || fault.Kind != DivisionByZero || fault.PC != 4 {
+			t.Errorf("%s: expected division by zero at 4, got %v", Opcodes[op].Name, err)
+		}
+	}
+}